@@ -28,12 +28,15 @@ bakapyControllers.controller('BackupDetailCtrl', ['$scope', '$http', '$routePara
           i,
           j;
 
-      if (data.Output) {
-        data.Output = base64.decode(data.Output);
-      }
+      // output excerpts are base64 encoded in metadata older than schema version 2
+      if (!(data.SchemaVersion >= 2)) {
+        if (data.Output) {
+          data.Output = base64.decode(data.Output);
+        }
 
-      if (data.Errput) {
-        data.Errput = base64.decode(data.Errput);
+        if (data.Errput) {
+          data.Errput = base64.decode(data.Errput);
+        }
       }
 
       if (data.Files) {
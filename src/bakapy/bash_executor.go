@@ -2,52 +2,149 @@ package bakapy
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/op/go-logging"
 	"io"
+	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type Executer interface {
-	Execute(script []byte, output io.Writer, errput io.Writer) error
+	Execute(script []byte, output io.Writer, errput io.Writer) (*ExecutionResult, error)
+}
+
+// ArgsExecuter is implemented by executors which can run commands
+// with additional arguments, e.g. for job steps.
+type ArgsExecuter interface {
+	WithArgs(args map[string]string) Executer
+}
+
+type ExecutionResult struct {
+	ExitCode   int
+	Signal     string
+	WallTime   time.Duration
+	UserTime   time.Duration
+	SystemTime time.Duration
+	MaxRSS     int64 // kilobytes
+}
+
+// exitStatus returns exit code of finished process, -1 if it was
+// killed by signal
+func exitStatus(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok {
+		return status.ExitStatus()
+	}
+	if state.Success() {
+		return 0
+	}
+	return -1
+}
+
+func NewExecutionResult(state *os.ProcessState, wallTime time.Duration) *ExecutionResult {
+	result := &ExecutionResult{
+		ExitCode:   exitStatus(state),
+		WallTime:   wallTime,
+		UserTime:   state.UserTime(),
+		SystemTime: state.SystemTime(),
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		result.Signal = status.Signal().String()
+	}
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		result.MaxRSS = int64(rusage.Maxrss)
+	}
+	return result
+}
+
+func (r *ExecutionResult) CPUTime() time.Duration {
+	return r.UserTime + r.SystemTime
 }
 
 type BashExecutor struct {
-	Args   map[string]string
-	Host   string
-	Port   uint
-	Sudo   bool
-	logger *logging.Logger
+	Args       map[string]string
+	SecretArgs []string
+	Host       string
+	Port       uint
+	Sudo       bool
+	SSHOptions SSHOptions
+	Secrets    *SecretResolver
+	// Called with pid of started command, which leads its own process
+	// group, and with 0 once command exited
+	OnProcess func(pid int)
+	logger    *logging.Logger
 }
 
 func NewBashExecutor(args map[string]string, host string, port uint, sudo bool) *BashExecutor {
 	return &BashExecutor{
-		Args:   args,
-		Host:   host,
-		Port:   port,
-		Sudo:   sudo,
-		logger: logging.MustGetLogger("bakapy.executor.ssh"),
+		Args:    args,
+		Host:    host,
+		Port:    port,
+		Sudo:    sudo,
+		Secrets: NewSecretResolver(""),
+		logger:  logging.MustGetLogger("bakapy.executor.ssh"),
 	}
 }
 
-func (e *BashExecutor) GetCmd() (*exec.Cmd, error) {
-	var remoteCmd string
-	env := make([]string, len(e.Args))
+// WithArgs returns executor copy with args merged over executor args
+func (e *BashExecutor) WithArgs(args map[string]string) Executer {
+	merged := make(map[string]string, len(e.Args)+len(args))
 	for argName, argValue := range e.Args {
-		arg := fmt.Sprintf("%s='%s'", strings.ToUpper(argName), argValue)
-		env = append(env, arg)
+		merged[argName] = argValue
+	}
+	for argName, argValue := range args {
+		merged[argName] = argValue
+	}
+	executor := *e
+	executor.Args = merged
+	return &executor
+}
+
+// GetArgsScript returns script header exporting job arguments.
+// Secret references resolved here, so it must be called only right
+// before execution. If mask is true, nothing is resolved and values
+// of secret arguments replaced with SECRET_MASK.
+func (e *BashExecutor) GetArgsScript(mask bool) ([]byte, error) {
+	names := make([]string, 0, len(e.Args))
+	for argName := range e.Args {
+		names = append(names, argName)
+	}
+	sort.Strings(names)
+
+	header := new(bytes.Buffer)
+	for _, argName := range names {
+		argValue := e.Args[argName]
+		ref, isRef := ParseSecretRef(argValue)
+		if mask && (isRef || IsSecretArg(e.SecretArgs, argName)) {
+			argValue = SECRET_MASK
+		} else if isRef {
+			var err error
+			argValue, err = e.Secrets.Resolve(ref)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("argument %s: %s", argName, err))
+			}
+		}
+		fmt.Fprintf(header, "export %s=%s\n", strings.ToUpper(argName), ShellQuote(argValue))
 	}
+	return header.Bytes(), nil
+}
+
+func (e *BashExecutor) GetCmd() (*exec.Cmd, error) {
+	var remoteCmd string
 
 	if e.Port == 0 {
 		e.Port = 22
 	}
 
 	if e.Sudo {
-		remoteCmd = fmt.Sprintf("sudo %s /bin/bash", strings.Join(env, " "))
+		remoteCmd = "sudo /bin/bash"
 	} else {
-		remoteCmd = fmt.Sprintf("%s /bin/bash", strings.Join(env, " "))
+		remoteCmd = "/bin/bash"
 	}
 
 	var args []string
@@ -57,8 +154,9 @@ func (e *BashExecutor) GetCmd() (*exec.Cmd, error) {
 			"ssh", e.Host,
 			"-oBatchMode=yes",
 			"-p", strconv.FormatInt(int64(e.Port), 10),
-			remoteCmd,
 		}
+		args = append(args, e.sshArgs()...)
+		args = append(args, remoteCmd)
 	} else {
 		args = []string{
 			"bash", "-c",
@@ -79,27 +177,74 @@ func (e *BashExecutor) GetCmd() (*exec.Cmd, error) {
 	return cmd, nil
 }
 
-func (e *BashExecutor) Execute(script []byte, output io.Writer, errput io.Writer) error {
+func (e *BashExecutor) sshArgs() []string {
+	var args []string
+	opts := e.SSHOptions
+	if opts.User != "" {
+		args = append(args, "-l", opts.User)
+	}
+	if opts.IdentityFile != "" {
+		args = append(args, "-i", opts.IdentityFile, "-oIdentitiesOnly=yes")
+	}
+	if len(opts.JumpHosts) > 0 {
+		args = append(args, "-J", strings.Join(opts.JumpHosts, ","))
+	}
+	if opts.ConnectTimeout != 0 {
+		args = append(args, fmt.Sprintf("-oConnectTimeout=%d", int64(opts.ConnectTimeout.Seconds())))
+	}
+	if opts.StrictHostKeyChecking != "" {
+		args = append(args, "-oStrictHostKeyChecking="+opts.StrictHostKeyChecking)
+	}
+	for _, option := range opts.Options {
+		args = append(args, "-o"+option)
+	}
+	return args
+}
+
+func (e *BashExecutor) Execute(script []byte, output io.Writer, errput io.Writer) (*ExecutionResult, error) {
 	cmd, err := e.GetCmd()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	argsScript, err := e.GetArgsScript(false)
+	if err != nil {
+		return nil, err
 	}
+	maskedArgsScript, _ := e.GetArgsScript(true)
 
 	cmd.Stderr = errput
 	cmd.Stdout = output
-	cmd.Stdin = bytes.NewReader(script)
+	cmd.Stdin = io.MultiReader(bytes.NewReader(argsScript), bytes.NewReader(script))
 
+	e.logger.Debug(string(maskedArgsScript))
 	e.logger.Debug(string(script))
 	e.logger.Debug("executing command '%s'",
 		strings.Join(cmd.Args, " "))
 
+	if e.OnProcess != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	startTime := time.Now()
 	err = cmd.Start()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if e.OnProcess != nil {
+		e.OnProcess(cmd.Process.Pid)
 	}
 	err = cmd.Wait()
+	if e.OnProcess != nil {
+		e.OnProcess(0)
+	}
+	if cmd.ProcessState == nil {
+		return nil, err
+	}
+	result := NewExecutionResult(cmd.ProcessState, time.Since(startTime))
+	e.logger.Debug("command finished: exit code %d, signal '%s', wall time %s, cpu time %s, max rss %dkB",
+		result.ExitCode, result.Signal, result.WallTime, result.CPUTime(), result.MaxRSS)
 	if err != nil {
-		return err
+		return result, err
 	}
-	return nil
+	return result, nil
 }
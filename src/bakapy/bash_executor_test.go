@@ -2,10 +2,21 @@ package bakapy
 
 import (
 	"bytes"
+	"os"
+	"os/exec"
 	"strings"
 	"testing"
+	"time"
 )
 
+func bashPath(t *testing.T) string {
+	path, err := exec.LookPath("bash")
+	if err != nil {
+		t.Fatal("cannot find bash:", err)
+	}
+	return path
+}
+
 func TestBashExecutor_GetCmd_Local(t *testing.T) {
 	args := map[string]string{
 		"test": "oneone",
@@ -19,8 +30,9 @@ func TestBashExecutor_GetCmd_Local(t *testing.T) {
 	if err != nil {
 		t.Fatal("Error:", err)
 	}
-	if strings.Join(cmd.Args, "|||") != "/bin/bash|||-c||| TEST='oneone' /bin/bash" {
-		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"), "expected '/bin/bash|||-c||| TEST='oneone' /bin/bash'")
+	expected_args := bashPath(t) + "|||-c|||/bin/bash"
+	if strings.Join(cmd.Args, "|||") != expected_args {
+		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"), "expected", expected_args)
 	}
 	t.Log(cmd.Args)
 }
@@ -37,7 +49,7 @@ func TestBashExecutor_GetCmd_LocalSudo(t *testing.T) {
 	if err != nil {
 		t.Fatal("Error:", err)
 	}
-	expected_args := "/bin/bash|||-c|||sudo  TEST='oneone' /bin/bash"
+	expected_args := bashPath(t) + "|||-c|||sudo /bin/bash"
 	if strings.Join(cmd.Args, "|||") != expected_args {
 		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"), "expected", expected_args)
 	}
@@ -57,7 +69,7 @@ func TestBashExecutor_GetCmd_Remote(t *testing.T) {
 	if err != nil {
 		t.Fatal("Error:", err)
 	}
-	expected_args := "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||2424||| TEST='oneone' /bin/bash"
+	expected_args := "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||2424|||/bin/bash"
 	if strings.Join(cmd.Args, "|||") != expected_args {
 		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"), "expected", expected_args)
 	}
@@ -77,7 +89,7 @@ func TestBashExecutor_GetCmd_RemoteSudo(t *testing.T) {
 	if err != nil {
 		t.Fatal("Error:", err)
 	}
-	expected_args := "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||2424|||sudo  TEST='oneone' /bin/bash"
+	expected_args := "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||2424|||sudo /bin/bash"
 	if strings.Join(cmd.Args, "|||") != expected_args {
 		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"), "expected", expected_args)
 	}
@@ -97,7 +109,7 @@ func TestBashExecutor_GetCmd_RemoteNoPort(t *testing.T) {
 	if err != nil {
 		t.Fatal("Error:", err)
 	}
-	expected_args := "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||22||| TEST='oneone' /bin/bash"
+	expected_args := "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||22|||/bin/bash"
 	if strings.Join(cmd.Args, "|||") != expected_args {
 		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"), "expected", expected_args)
 	}
@@ -115,7 +127,7 @@ func TestBashExecutor_GetCmd_RemoteNoArgs(t *testing.T) {
 	if err != nil {
 		t.Fatal("Error:", err)
 	}
-	if strings.Join(cmd.Args, "|||") != "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||2323||| /bin/bash" {
+	if strings.Join(cmd.Args, "|||") != "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||2323|||/bin/bash" {
 		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"))
 	}
 	t.Log(cmd.Args)
@@ -131,10 +143,16 @@ func TestBashExecutor_Execute_CommandOk(t *testing.T) {
 	script := []byte(`echo -n hello; exit 0;`)
 	output := new(bytes.Buffer)
 	errput := new(bytes.Buffer)
-	err := executor.Execute(script, output, errput)
+	result, err := executor.Execute(script, output, errput)
 	if err != nil {
 		t.Fatal("Error:", err)
 	}
+	if result.ExitCode != 0 {
+		t.Fatal("result.ExitCode must be 0 not", result.ExitCode)
+	}
+	if result.MaxRSS <= 0 {
+		t.Fatal("result.MaxRSS must be positive, not", result.MaxRSS)
+	}
 	if output.String() != "hello" {
 		t.Fatalf("Output must be 'hello', not '%s'", output)
 	}
@@ -153,12 +171,150 @@ func TestBashExecutor_Execute_CommandFailed(t *testing.T) {
 	script := []byte(`echo -n some errput >&2; exit 19;`)
 	output := new(bytes.Buffer)
 	errput := new(bytes.Buffer)
-	err := executor.Execute(script, output, errput)
+	result, err := executor.Execute(script, output, errput)
 	if err.Error() != "exit status 19" {
 		t.Fatalf("err must be 'exit status 19', not '%s'", err)
 	}
+	if result.ExitCode != 19 {
+		t.Fatal("result.ExitCode must be 19 not", result.ExitCode)
+	}
+	if result.Signal != "" {
+		t.Fatal("result.Signal must be empty not", result.Signal)
+	}
 
 	if errput.String() != "some errput" {
 		t.Fatalf("Errput must be 'some errput', not '%s'", errput)
 	}
 }
+
+func TestBashExecutor_GetCmd_RemoteSSHOptions(t *testing.T) {
+	args := map[string]string{}
+	host := "test-host.example"
+	port := uint(22)
+	sudo := false
+	executor := NewBashExecutor(args, host, port, sudo)
+	executor.SSHOptions = SSHOptions{
+		User:                  "backup",
+		IdentityFile:          "/etc/bakapy/id_rsa",
+		JumpHosts:             []string{"gw1.example", "backup@gw2.example:2222"},
+		ConnectTimeout:        time.Second * 15,
+		StrictHostKeyChecking: "accept-new",
+		Options:               []string{"Compression=yes", "ServerAliveInterval=30"},
+	}
+	cmd, err := executor.GetCmd()
+
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	expected_args := "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||22|||" +
+		"-l|||backup|||-i|||/etc/bakapy/id_rsa|||-oIdentitiesOnly=yes|||" +
+		"-J|||gw1.example,backup@gw2.example:2222|||-oConnectTimeout=15|||" +
+		"-oStrictHostKeyChecking=accept-new|||-oCompression=yes|||-oServerAliveInterval=30|||/bin/bash"
+	if strings.Join(cmd.Args, "|||") != expected_args {
+		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"), "expected", expected_args)
+	}
+}
+
+func TestBashExecutor_GetArgsScript_Quoting(t *testing.T) {
+	args := map[string]string{
+		"test":      "oneone",
+		"mysql_pwd": "it's secret",
+	}
+	executor := NewBashExecutor(args, "", 22, false)
+	expected := "export MYSQL_PWD='it'\\''s secret'\nexport TEST='oneone'\n"
+	script, err := executor.GetArgsScript(false)
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if string(script) != expected {
+		t.Fatalf("args script must be '%s', not '%s'", expected, script)
+	}
+}
+
+func TestBashExecutor_GetArgsScript_MaskSecrets(t *testing.T) {
+	args := map[string]string{
+		"test":      "oneone",
+		"mysql_pwd": "it's secret",
+	}
+	executor := NewBashExecutor(args, "", 22, false)
+	executor.SecretArgs = []string{"mysql_pwd"}
+	expected := "export MYSQL_PWD='" + SECRET_MASK + "'\nexport TEST='oneone'\n"
+	script, err := executor.GetArgsScript(true)
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if string(script) != expected {
+		t.Fatalf("args script must be '%s', not '%s'", expected, script)
+	}
+}
+
+func TestBashExecutor_Execute_ArgsExported(t *testing.T) {
+	args := map[string]string{
+		"test": "it's \"quoted\" $HOME",
+	}
+	executor := NewBashExecutor(args, "", 22, false)
+
+	script := []byte(`echo -n "$TEST"`)
+	output := new(bytes.Buffer)
+	errput := new(bytes.Buffer)
+	_, err := executor.Execute(script, output, errput)
+	if err != nil {
+		t.Fatal("Error:", err, errput.String())
+	}
+	if output.String() != args["test"] {
+		t.Fatalf("Output must be '%s', not '%s'", args["test"], output)
+	}
+}
+
+func TestBashExecutor_GetArgsScript_SecretRefResolved(t *testing.T) {
+	os.Setenv("BAKAPY_TEST_SECRET", "topsecret")
+	defer os.Unsetenv("BAKAPY_TEST_SECRET")
+	args := map[string]string{
+		"mysql_pwd": "${env:BAKAPY_TEST_SECRET}",
+	}
+	executor := NewBashExecutor(args, "", 22, false)
+
+	script, err := executor.GetArgsScript(false)
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if string(script) != "export MYSQL_PWD='topsecret'\n" {
+		t.Fatal("wrong args script:", string(script))
+	}
+
+	script, err = executor.GetArgsScript(true)
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if string(script) != "export MYSQL_PWD='"+SECRET_MASK+"'\n" {
+		t.Fatal("wrong masked args script:", string(script))
+	}
+}
+
+func TestBashExecutor_Execute_SecretRefFailed(t *testing.T) {
+	args := map[string]string{
+		"mysql_pwd": "${env:BAKAPY_TEST_DOES_NOT_EXIST}",
+	}
+	executor := NewBashExecutor(args, "", 22, false)
+	_, err := executor.Execute([]byte("exit 0"), new(bytes.Buffer), new(bytes.Buffer))
+	expectedErr := "argument mysql_pwd: environment variable for secret ${env:BAKAPY_TEST_DOES_NOT_EXIST} is not set"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+}
+
+func TestBashExecutor_Execute_CommandKilled(t *testing.T) {
+	executor := NewBashExecutor(map[string]string{}, "", 22, false)
+
+	script := []byte(`kill -KILL $$`)
+	result, err := executor.Execute(script, new(bytes.Buffer), new(bytes.Buffer))
+	if err == nil {
+		t.Fatal("err must not be nil")
+	}
+	if result.ExitCode != -1 {
+		t.Fatal("result.ExitCode must be -1 not", result.ExitCode)
+	}
+	if result.Signal != "killed" {
+		t.Fatal("result.Signal must be 'killed' not", result.Signal)
+	}
+}
@@ -0,0 +1,147 @@
+package bakapy
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"github.com/robfig/cron"
+	"os"
+	"time"
+)
+
+const (
+	BLACKOUT_ACTION_SKIP  = "skip"
+	BLACKOUT_ACTION_DEFER = "defer"
+)
+
+var BLACKOUT_TIME_FORMATS = []string{"2006-01-02 15:04", "2006-01-02"}
+
+// BlackoutWindow is period when scheduled runs are skipped or deferred.
+// It is either absolute (from/to) or recurring (schedule/duration).
+type BlackoutWindow struct {
+	Name     string
+	From     string
+	To       string
+	Schedule string
+	Duration time.Duration
+	// skip (default) or defer run until window end
+	Action   string
+	schedule cron.Schedule
+}
+
+func parseBlackoutTime(value string, location *time.Location) (time.Time, error) {
+	var err error
+	for _, format := range BLACKOUT_TIME_FORMATS {
+		var t time.Time
+		t, err = time.ParseInLocation(format, value, location)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+func (w *BlackoutWindow) Sanitize() error {
+	absolute := w.From != "" || w.To != ""
+	recurring := w.Schedule != "" || w.Duration != 0
+	if absolute == recurring {
+		return errors.New(fmt.Sprintf("blackout %s: either from/to or schedule/duration must be defined", w.Name))
+	}
+	if absolute {
+		from, err := parseBlackoutTime(w.From, time.UTC)
+		if err != nil {
+			return errors.New(fmt.Sprintf("blackout %s: from: %s", w.Name, err))
+		}
+		to, err := parseBlackoutTime(w.To, time.UTC)
+		if err != nil {
+			return errors.New(fmt.Sprintf("blackout %s: to: %s", w.Name, err))
+		}
+		if !to.After(from) {
+			return errors.New(fmt.Sprintf("blackout %s: to must be after from", w.Name))
+		}
+	}
+	if recurring {
+		if w.Duration <= 0 {
+			return errors.New(fmt.Sprintf("blackout %s: duration must be positive", w.Name))
+		}
+		spec := RunAtSpec{Specs: []string{w.Schedule}}
+		if err := spec.Sanitize(); err != nil {
+			return errors.New(fmt.Sprintf("blackout %s: %s", w.Name, err))
+		}
+		schedule, err := cron.Parse(spec.Specs[0])
+		if err != nil {
+			return errors.New(fmt.Sprintf("blackout %s: schedule: %s", w.Name, err))
+		}
+		w.schedule = schedule
+	}
+	if w.Action == "" {
+		w.Action = BLACKOUT_ACTION_SKIP
+	}
+	if w.Action != BLACKOUT_ACTION_SKIP && w.Action != BLACKOUT_ACTION_DEFER {
+		return errors.New(fmt.Sprintf("blackout %s: action must be %s or %s, not '%s'",
+			w.Name, BLACKOUT_ACTION_SKIP, BLACKOUT_ACTION_DEFER, w.Action))
+	}
+	return nil
+}
+
+// ActiveUntil returns end of window if t is inside it,
+// time values are evaluated in location.
+func (w *BlackoutWindow) ActiveUntil(t time.Time, location *time.Location) (time.Time, bool) {
+	if w.schedule != nil {
+		start := ZonedSchedule{w.schedule, location}.Next(t.Add(-w.Duration))
+		if start.After(t) {
+			return time.Time{}, false
+		}
+		return start.Add(w.Duration), true
+	}
+	from, err := parseBlackoutTime(w.From, location)
+	if err != nil {
+		return time.Time{}, false
+	}
+	to, err := parseBlackoutTime(w.To, location)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if t.Before(from) || !t.Before(to) {
+		return time.Time{}, false
+	}
+	return to, true
+}
+
+// ActiveBlackout returns global or job blackout window active at t
+// and its end. For several active windows the latest end is returned.
+func (cfg *Config) ActiveBlackout(jobConfig *JobConfig, t time.Time) (*BlackoutWindow, time.Time) {
+	var active *BlackoutWindow
+	var activeEnd time.Time
+	windows := append(append([]BlackoutWindow{}, cfg.Blackouts...), jobConfig.Blackouts...)
+	for idx := range windows {
+		end, isActive := windows[idx].ActiveUntil(t, jobConfig.Location())
+		if isActive && end.After(activeEnd) {
+			active = &windows[idx]
+			activeEnd = end
+		}
+	}
+	return active, activeEnd
+}
+
+// NewSkippedJobMetadata returns metadata for run not started due to blackout
+func NewSkippedJobMetadata(jobName string, jobConfig *JobConfig, trigger JobTrigger, reason string) *JobMetadata {
+	now := time.Now().In(jobConfig.Location())
+	metadata := &JobMetadata{
+		JobName:   jobName,
+		Namespace: jobConfig.Namespace,
+		TaskId:    TaskId(uuid.NewUUID().String()),
+		Pid:       os.Getpid(),
+		Command:   jobConfig.Command,
+		Config:    jobConfig.Masked(),
+		StartTime: now,
+		EndTime:   now,
+		Timezone:  jobConfig.Location().String(),
+		Skipped:   reason,
+		Status:    JOB_STATUS_SKIPPED,
+		Message:   reason,
+	}
+	metadata.ExpireTime = metadata.StartTime.Add(jobConfig.MaxAge)
+	metadata.SetTrigger(trigger)
+	return metadata
+}
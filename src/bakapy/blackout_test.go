@@ -0,0 +1,113 @@
+package bakapy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBlackoutWindow_Sanitize_Errors(t *testing.T) {
+	cases := map[string]BlackoutWindow{
+		"blackout x: either from/to or schedule/duration must be defined": {Name: "x"},
+		"blackout x: to must be after from":                               {Name: "x", From: "2026-12-20", To: "2026-12-01"},
+		"blackout x: duration must be positive":                           {Name: "x", Schedule: "0 2 * * 6"},
+		"blackout x: action must be skip or defer, not 'wait'":            {Name: "x", Schedule: "@daily", Duration: time.Hour, Action: "wait"},
+	}
+	for expectedErr, window := range cases {
+		err := window.Sanitize()
+		if err == nil || err.Error() != expectedErr {
+			t.Fatal("error must be", expectedErr, "not", err)
+		}
+	}
+}
+
+func TestBlackoutWindow_ActiveUntil_Absolute(t *testing.T) {
+	window := BlackoutWindow{Name: "freeze", From: "2026-12-20", To: "2027-01-05 12:00"}
+	if err := window.Sanitize(); err != nil {
+		t.Fatal(err)
+	}
+	end, active := window.ActiveUntil(time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC), time.UTC)
+	if !active || !end.Equal(time.Date(2027, 1, 5, 12, 0, 0, 0, time.UTC)) {
+		t.Fatal("window must be active until 2027-01-05 12:00, got", active, end)
+	}
+	if _, active := window.ActiveUntil(time.Date(2027, 1, 5, 12, 0, 0, 0, time.UTC), time.UTC); active {
+		t.Fatal("window must not be active at its end")
+	}
+}
+
+func TestBlackoutWindow_ActiveUntil_Recurring(t *testing.T) {
+	window := BlackoutWindow{Name: "maintenance", Schedule: "0 2 * * *", Duration: 4 * time.Hour}
+	if err := window.Sanitize(); err != nil {
+		t.Fatal(err)
+	}
+	end, active := window.ActiveUntil(time.Date(2026, 10, 19, 3, 30, 0, 0, time.UTC), time.UTC)
+	if !active || !end.Equal(time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)) {
+		t.Fatal("window must be active until 06:00, got", active, end)
+	}
+	if _, active := window.ActiveUntil(time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC), time.UTC); active {
+		t.Fatal("window must not be active at 07:00")
+	}
+}
+
+func TestScheduler_RunJob_SkippedInBlackout(t *testing.T) {
+	gConfig := newTestSchedulerConfig()
+	defer removeTestSchedulerConfig(gConfig)
+
+	gConfig.Blackouts = []BlackoutWindow{{Name: "always", From: "2000-01-01", To: "2100-01-01"}}
+	gConfig.Blackouts[0].Sanitize()
+	executor := &TestCountExecutor{}
+	gConfig.Jobs["dump"] = &JobConfig{Command: "wow.cmd", executor: executor}
+
+	scheduler := NewScheduler(gConfig, NewStorage(gConfig))
+	metadata := scheduler.RunJob("dump", JobTrigger{Reason: RUN_REASON_SCHEDULE})
+	if executor.calls != 0 {
+		t.Fatal("job must not be run in blackout")
+	}
+	if metadata.Skipped == "" || metadata.Success {
+		t.Fatal("metadata must be marked as skipped", metadata.Skipped, metadata.Success)
+	}
+	saved, err := LoadJobMetadata(metadata.Filepath)
+	if err != nil {
+		t.Fatal("cannot load metadata:", err)
+	}
+	if saved.Skipped != metadata.Skipped {
+		t.Fatal("saved metadata must have skip reason, not", saved.Skipped)
+	}
+
+	scheduler.RunJob("dump", JobTrigger{Reason: RUN_REASON_MANUAL})
+	if executor.calls != 1 {
+		t.Fatal("manual run must ignore blackout")
+	}
+}
+
+func TestScheduler_DeferredRunPersisted(t *testing.T) {
+	gConfig := newTestSchedulerConfig()
+	defer removeTestSchedulerConfig(gConfig)
+
+	gConfig.Blackouts = []BlackoutWindow{{Name: "always", From: "2000-01-01", To: "2100-01-01", Action: BLACKOUT_ACTION_DEFER}}
+	gConfig.Blackouts[0].Sanitize()
+	gConfig.Jobs["dump"] = &JobConfig{Command: "wow.cmd", executor: &TestCountExecutor{}}
+
+	scheduler := NewScheduler(gConfig, NewStorage(gConfig))
+	scheduler.RunJob("dump", JobTrigger{Reason: RUN_REASON_SCHEDULE})
+	scheduler.Shutdown(time.Second)
+	if len(scheduler.deferred) != 0 {
+		t.Fatal("deferred runs must be cancelled on shutdown, got", scheduler.deferred)
+	}
+
+	restarted := NewScheduler(gConfig, NewStorage(gConfig))
+	at, exist := restarted.state.DeferredRuns()["dump"]
+	if !exist || at.Year() != 2100 {
+		t.Fatal("deferred run must be saved in scheduler state, got", restarted.state.DeferredRuns())
+	}
+	restarted.restoreDeferred()
+	if restarted.deferred["dump"] == nil {
+		t.Fatal("deferred run must be restored")
+	}
+	restarted.cancelDeferred()
+
+	delete(gConfig.Jobs, "dump")
+	restarted.restoreDeferred()
+	if _, exist := restarted.state.DeferredRuns()["dump"]; exist {
+		t.Fatal("deferred run of removed job must be dropped")
+	}
+}
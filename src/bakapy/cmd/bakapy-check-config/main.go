@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bakapy"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var CONFIG_PATH = flag.String("config", "/etc/bakapy/bakapy.conf", "Path to config file")
+
+func main() {
+	flag.Parse()
+	errs := bakapy.CheckConfig(*CONFIG_PATH)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+	if len(errs) != 0 {
+		fmt.Fprintf(os.Stderr, "%d configuration errors found\n", len(errs))
+		os.Exit(1)
+	}
+	fmt.Println("Configuration OK")
+}
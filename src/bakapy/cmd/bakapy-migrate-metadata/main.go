@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bakapy"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var CONFIG_PATH = flag.String("config", "/etc/bakapy/bakapy.conf", "Path to config file")
+var METADATA_DIR = flag.String("dir", "", "Metadata directory, metadata_dir from config by default")
+var DRY_RUN = flag.Bool("dry-run", false, "Only report files which would be migrated")
+
+func main() {
+	flag.Parse()
+
+	dir := *METADATA_DIR
+	if dir == "" {
+		config, err := bakapy.ParseConfig(*CONFIG_PATH)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Configuration error: %s\n", err)
+			os.Exit(1)
+		}
+		dir = config.MetadataDir
+	}
+
+	report, err := bakapy.MigrateMetadataDir(dir, *DRY_RUN)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot migrate metadata: %s\n", err)
+		os.Exit(1)
+	}
+
+	action := "migrated"
+	if *DRY_RUN {
+		action = "would migrate"
+	}
+	for _, m := range report.Migrated {
+		fmt.Printf("%s %s: version %d -> %d\n", action, m.Path, m.FromVersion, bakapy.METADATA_SCHEMA_VERSION)
+	}
+	for _, m := range report.Failed {
+		fmt.Fprintf(os.Stderr, "[warning] %s: %s\n", m.Path, m.Error)
+	}
+	fmt.Printf("%d files %s, %d up to date (version %d), %d failed\n",
+		len(report.Migrated), action, len(report.UpToDate), bakapy.METADATA_SCHEMA_VERSION, len(report.Failed))
+	if len(report.Failed) != 0 {
+		os.Exit(1)
+	}
+}
@@ -10,6 +10,7 @@ import (
 var CONFIG_PATH = flag.String("config", "/etc/bakapy/bakapy.conf", "Path to config file")
 var LOG_LEVEL = flag.String("loglevel", "debug", "Log level")
 var JOB_NAME = flag.String("job", "REQUIRED", "Job name")
+var DOWNSTREAM = flag.Bool("downstream", false, "Also run jobs triggered by this one")
 
 func main() {
 	flag.Parse()
@@ -28,12 +29,18 @@ func main() {
 	storage := bakapy.NewStorage(config)
 
 	jobName := *JOB_NAME
-	jobConfig, jobExist := config.Jobs[jobName]
+	_, jobExist := config.Jobs[jobName]
 	if !jobExist {
 		fmt.Printf("Job %s not found\n", jobName)
 		os.Exit(1)
 	}
 
 	storage.Start()
-	bakapy.RunJob(jobName, jobConfig, config, storage)
+	scheduler := bakapy.NewScheduler(config, storage)
+	trigger := bakapy.JobTrigger{Reason: bakapy.RUN_REASON_MANUAL}
+	if *DOWNSTREAM {
+		scheduler.RunJob(jobName, trigger)
+	} else {
+		scheduler.RunSingleJob(jobName, trigger)
+	}
 }
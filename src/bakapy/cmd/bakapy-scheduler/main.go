@@ -5,8 +5,11 @@ import (
 	"flag"
 	"fmt"
 	"github.com/op/go-logging"
-	"github.com/robfig/cron"
 	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
 	"time"
 )
 
@@ -14,6 +17,17 @@ var logger = logging.MustGetLogger("bakapy.scheduler")
 var CONFIG_PATH = flag.String("config", "/etc/bakapy/bakapy.conf", "Path to config file")
 var LOG_LEVEL = flag.String("loglevel", "debug", "Log level")
 var TEST_CONFIG_ONLY = flag.Bool("test", false, "Check config and exit")
+var LIST_NEXT_RUNS = flag.Bool("next", false, "List next run time of scheduled jobs and exit")
+
+func printNextRuns(config *bakapy.Config) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NEXT RUN\tJOB\tSCHEDULE\tJITTER")
+	for _, run := range config.NextRuns(time.Now()) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			run.Time.In(run.Location).Format("2006-01-02 15:04:05 MST"), run.JobName, run.Spec, run.Jitter)
+	}
+	w.Flush()
+}
 
 func main() {
 	flag.Parse()
@@ -31,32 +45,76 @@ func main() {
 
 	logger.Debug(string(config.PrettyFmt()))
 
+	if *LIST_NEXT_RUNS {
+		printNextRuns(config)
+		return
+	}
+
 	storage := bakapy.NewStorage(config)
 
-	scheduler := cron.New()
-	for jobName, jobConfig := range config.Jobs {
-		runSpec := jobConfig.RunAt.SchedulerString()
-		logger.Info("adding job %s{%s} to scheduler", jobName, runSpec)
+	scheduler := bakapy.NewScheduler(config, storage)
+	scheduler.AddJobs()
 
-		if jobConfig.Disabled {
-			logger.Warning("job %s disabled, skipping", jobName)
-			continue
+	if *TEST_CONFIG_ONLY {
+		failed := false
+		jobNames := make([]string, 0, len(config.Jobs))
+		for jobName := range config.Jobs {
+			jobNames = append(jobNames, jobName)
+		}
+		sort.Strings(jobNames)
+		for _, jobName := range jobNames {
+			fmt.Printf("# %s\n%s\n", jobName, config.Jobs[jobName].EffectiveFmt())
+		}
+		for _, err := range bakapy.CheckConfig(*CONFIG_PATH) {
+			fmt.Fprintf(os.Stderr, "Configuration error: %s\n", err)
+			failed = true
 		}
-		func(jobName string, jobConfig *bakapy.JobConfig, config *bakapy.Config, storage *bakapy.Storage) {
-			scheduler.AddFunc(runSpec, func() {
-				logger.Critical("Starting job %s", jobName)
-				bakapy.RunJob(jobName, jobConfig, config, storage)
-			})
-		}(jobName, jobConfig, config, storage)
+		if failed {
+			os.Exit(1)
+		}
+		return
 	}
 
-	if *TEST_CONFIG_ONLY {
-		return
+	recovered, err := bakapy.RecoverInterruptedTasks(config)
+	if err != nil {
+		logger.Warning("cannot recover interrupted tasks: %s", err)
+	}
+	for _, metadata := range recovered {
+		logger.Warning("task %s of job %s was interrupted, marked as failed", metadata.TaskId, metadata.JobName)
 	}
 
 	storage.Start()
+	if config.StatusListen != "" {
+		if err := bakapy.NewStatusServer(config, storage).Start(); err != nil {
+			logger.Critical("cannot start status server: %s", err)
+			os.Exit(1)
+		}
+	}
 	scheduler.Start()
 
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			logger.Info("SIGHUP received, reloading config %s", *CONFIG_PATH)
+			scheduler.Reload(*CONFIG_PATH)
+		}
+	}()
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-shutdown
+		logger.Warning("%s received, shutting down", sig)
+		// storage keeps receiving files of running tasks until they finish
+		aborted := scheduler.Shutdown(scheduler.Config().GetShutdownGrace())
+		storage.Stop()
+		if aborted != 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
+
 	for {
 		err := storage.CleanupExpired()
 		if err != nil {
@@ -2,12 +2,31 @@ package main
 
 import (
 	"bakapy"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"sort"
+	"text/tabwriter"
+	"time"
 )
 
-var USAGE = "Usage: bakapy-show-meta files..."
+var USAGE = `Usage: bakapy-show-meta [-script] [-output] [-errput] files...
+       bakapy-show-meta [-config path] [-job name] [-namespace ns] [-status status] [-failed] [-since duration] [-limit n]
+       bakapy-show-meta [-config path] -rebuild-index
+`
+
+var CONFIG_PATH = flag.String("config", "/etc/bakapy/bakapy.conf", "Path to config file")
+var JOB = flag.String("job", "", "Show tasks of job")
+var NAMESPACE = flag.String("namespace", "", "Show tasks of namespace")
+var STATUS = flag.String("status", "", "Show tasks with status (running, finished, skipped, aborted, interrupted)")
+var FAILED = flag.Bool("failed", false, "Show failed tasks only")
+var SINCE = flag.Duration("since", 0, "Show tasks started within duration")
+var LIMIT = flag.Int("limit", 0, "Show latest tasks only")
+var REBUILD_INDEX = flag.Bool("rebuild-index", false, "Rebuild metadata index from metadata files")
+var SHOW_SCRIPT = flag.Bool("script", false, "Print task scripts")
+var SHOW_OUTPUT = flag.Bool("output", false, "Print full output from output log instead of excerpt")
+var SHOW_ERRPUT = flag.Bool("errput", false, "Print full errput from errput log instead of excerpt")
 
 type ByStartTime []*bakapy.JobMetadata
 
@@ -15,30 +34,187 @@ func (a ByStartTime) Len() int           { return len(a) }
 func (a ByStartTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByStartTime) Less(i, j int) bool { return a[i].StartTime.Before(a[j].StartTime) }
 
+func printLog(name string, logPath string) bool {
+	log, err := bakapy.OpenTaskLog(logPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[warning] cannot open %s log: %s\n", name, err)
+		return false
+	}
+	defer log.Close()
+	fmt.Printf("==> %s:\n", name)
+	if _, err := io.Copy(os.Stdout, log); err != nil {
+		fmt.Fprintf(os.Stderr, "[warning] cannot read %s log: %s\n", name, err)
+	}
+	fmt.Println()
+	return true
+}
+
+func printOutput(name string, excerpt []byte, size int64, logPath string, full bool) {
+	if logPath != "" {
+		fmt.Printf("==> %s log: %s\n", name, logPath)
+		if full && printLog(name, logPath) {
+			return
+		}
+	}
+	if size > int64(len(excerpt)) {
+		fmt.Printf("==> %s (last %d of %d bytes):\n%s\n", name, len(excerpt), size, string(excerpt))
+		return
+	}
+	fmt.Printf("==> %s:\n%s\n", name, string(excerpt))
+}
+
+func printScript(name string, load func() ([]byte, error)) {
+	script, err := load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[warning] cannot load %s: %s\n", name, err)
+		return
+	}
+	if len(script) > 0 {
+		fmt.Printf("==> %s:\n%s\n", name, script)
+	}
+}
+
 func printMetadata(metadata *bakapy.JobMetadata) {
 	fmt.Printf("==> [%s]%s\n", metadata.JobName, metadata.TaskId)
 	fmt.Println("==> Success:", metadata.Success)
 	fmt.Println("==> Command:", metadata.Command)
+	fmt.Println("==> Run reason:", metadata.RunReason)
+	if metadata.Skipped != "" {
+		fmt.Println("==> Skipped:", metadata.Skipped)
+	}
+	if metadata.Aborted {
+		fmt.Println("==> Aborted: yes")
+	}
+	if metadata.UpstreamJob != "" {
+		fmt.Printf("==> Triggered by: [%s]%s\n", metadata.UpstreamJob, metadata.UpstreamTaskId)
+	}
+	if metadata.ParentJob != "" {
+		fmt.Printf("==> Parent: [%s]%s\n", metadata.ParentJob, metadata.ParentTaskId)
+	}
+	for _, child := range metadata.Children {
+		fmt.Printf("==> Host %s: [%s]%s %s (%d bytes)\n",
+			child.Host, child.JobName, child.TaskId, child.Message, child.TotalSize)
+	}
+	if len(metadata.DownstreamJobs) > 0 {
+		fmt.Println("==> Triggered jobs:", metadata.DownstreamJobs)
+	}
 	fmt.Println("==> AvgSpeed:", metadata.AvgSpeed())
 	fmt.Println("==> PID:", metadata.Pid)
+	fmt.Println("==> Exit code:", metadata.RetCode)
+	if metadata.Signal != "" {
+		fmt.Println("==> Signal:", metadata.Signal)
+	}
+	fmt.Println("==> Wall time:", metadata.WallTime)
+	fmt.Printf("==> CPU time: %s (user %s, system %s)\n", metadata.CPUTime(), metadata.UserTime, metadata.SystemTime)
+	fmt.Printf("==> Max RSS: %dkB\n", metadata.MaxRSS)
 	fmt.Println("==> Start:", metadata.StartTime)
 	fmt.Println("==> End:", metadata.EndTime)
+	if metadata.Timezone != "" {
+		fmt.Println("==> Timezone:", metadata.Timezone)
+	}
 	fmt.Println("==> Duration:", metadata.Duration())
 	fmt.Println("==> Files:", metadata.Files)
 	fmt.Println("==> Size:", metadata.TotalSize)
 	fmt.Println("==> Expire:", metadata.ExpireTime)
-	fmt.Printf("==> Output:\n%s\n", string(metadata.Output))
-	fmt.Printf("==> Errput:\n%s\n", string(metadata.Errput))
+	for _, step := range metadata.Steps {
+		fmt.Printf("==> Step %s (%s): %s (exit code %d, %s, %d files, %d bytes)\n",
+			step.Name, step.Command, step.Message, step.RetCode, step.Duration(), len(step.Files), step.TotalSize)
+	}
+	for _, hook := range metadata.Hooks {
+		fmt.Printf("==> %s hook '%s': %s (exit code %d, %s)\n",
+			hook.Stage, hook.Command, hook.Message, hook.RetCode, hook.EndTime.Sub(hook.StartTime))
+	}
+	printOutput("Output", metadata.Output, metadata.OutputSize, metadata.OutputLog, *SHOW_OUTPUT)
+	printOutput("Errput", metadata.Errput, metadata.ErrputSize, metadata.ErrputLog, *SHOW_ERRPUT)
+	if *SHOW_SCRIPT {
+		printScript("Script", metadata.LoadScript)
+		for _, step := range metadata.Steps {
+			printScript(fmt.Sprintf("Step %s script", step.Name), step.LoadScript)
+		}
+	}
 	fmt.Println("==================================")
 }
 
-func main() {
-	if len(os.Args[1:]) == 0 {
-		fmt.Println(USAGE)
+func printEntries(entries []bakapy.MetadataIndexEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tJOB\tNAMESPACE\tSTATUS\tSUCCESS\tSTART\tDURATION\tSIZE\tFILES")
+	for _, entry := range entries {
+		duration := time.Duration(0)
+		if entry.EndTime.After(entry.StartTime) {
+			duration = entry.EndTime.Sub(entry.StartTime)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%s\t%s\t%d\t%d\n",
+			entry.TaskId, entry.JobName, entry.Namespace, entry.Status, entry.Success,
+			entry.StartTime.Format(time.RFC3339), duration, entry.TotalSize, len(entry.Files))
+	}
+	w.Flush()
+}
+
+func openIndex() *bakapy.MetadataIndex {
+	config, err := bakapy.ParseConfig(*CONFIG_PATH)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration error: %s\n", err)
+		os.Exit(1)
+	}
+	index, err := bakapy.OpenMetadataIndex(config.MetadataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot open metadata index: %s\n", err)
 		os.Exit(1)
 	}
+	return index
+}
+
+func queryIndex() {
+	index := openIndex()
+	if *REBUILD_INDEX {
+		corrupted, err := index.Rebuild()
+		for _, metaPath := range corrupted {
+			fmt.Fprintf(os.Stderr, "[warning] %s: cannot load metadata\n", metaPath)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot rebuild metadata index: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	q := bakapy.MetadataQuery{
+		JobName:   *JOB,
+		Namespace: *NAMESPACE,
+		Status:    *STATUS,
+		Failed:    *FAILED,
+		Limit:     *LIMIT,
+	}
+	if *SINCE > 0 {
+		q.Since = time.Now().Add(-*SINCE)
+	}
+	entries, err := index.Query(q)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot query metadata index: %s\n", err)
+		os.Exit(1)
+	}
+	if len(entries) == 0 {
+		fmt.Println("no tasks found")
+		return
+	}
+	printEntries(entries)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, USAGE)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		if flag.NFlag() == 0 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		queryIndex()
+		return
+	}
 	var metas []*bakapy.JobMetadata
-	for _, metaPath := range os.Args[1:] {
+	for _, metaPath := range flag.Args() {
 		meta, err := bakapy.LoadJobMetadata(metaPath)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "[warning] %s: %s\n", metaPath, err)
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bakapy"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+var CONFIG_PATH = flag.String("config", "/etc/bakapy/bakapy.conf", "Path to config file")
+var STATUS_ADDR = flag.String("addr", "", "Status API address, status_listen from config by default")
+
+func humanBytes(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+func printTask(task bakapy.TaskProgress) {
+	fmt.Printf("==> [%s]%s\n", task.JobName, task.TaskId)
+	fmt.Println("==> Namespace:", task.Namespace)
+	if !task.StartTime.IsZero() {
+		fmt.Println("==> Running:", time.Since(task.StartTime))
+	}
+	fmt.Println("==> Received:", humanBytes(task.Bytes))
+	for _, t := range task.Transfers {
+		fmt.Printf("    %s %s %s/s from %s\n",
+			t.Filename, humanBytes(t.Bytes), humanBytes(t.Throughput), t.RemoteAddr)
+	}
+	fmt.Println("==================================")
+}
+
+func main() {
+	flag.Parse()
+
+	addr := *STATUS_ADDR
+	if addr == "" {
+		config, err := bakapy.ParseConfig(*CONFIG_PATH)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Configuration error: %s\n", err)
+			os.Exit(1)
+		}
+		addr = config.StatusListen
+	}
+	if addr == "" {
+		fmt.Fprintln(os.Stderr, "status_listen is not configured")
+		os.Exit(1)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/progress", addr))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	var tasks []bakapy.TaskProgress
+	if err := json.NewDecoder(resp.Body).Decode(&tasks); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot decode status response: %s\n", err)
+		os.Exit(1)
+	}
+
+	if len(tasks) == 0 {
+		fmt.Println("no running tasks")
+		return
+	}
+	for _, task := range tasks {
+		printTask(task)
+	}
+}
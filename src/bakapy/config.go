@@ -3,21 +3,48 @@ package bakapy
 import (
 	"errors"
 	"fmt"
+	"github.com/robfig/cron"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"os"
 	"path"
-	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 )
 
 type Config struct {
 	IncludeJobs []string `yaml:"include_jobs"`
 	Listen      string
-	StorageDir  string     `yaml:"storage_dir"`
-	MetadataDir string     `yaml:"metadata_dir"`
-	CommandDir  string     `yaml:"command_dir"`
-	SMTP        SMTPConfig `yaml:"smtp"`
-	Jobs        map[string]*JobConfig
+	// HTTP address for status API, disabled if empty
+	StatusListen string          `yaml:"status_listen"`
+	StorageDir   string          `yaml:"storage_dir"`
+	MetadataDir  string          `yaml:"metadata_dir"`
+	CommandDir   string          `yaml:"command_dir"`
+	SMTP         SMTPConfig      `yaml:"smtp"`
+	OutputLog    OutputLogConfig `yaml:"output_log"`
+	// Local helper printing secret value for ${cmd:key} job arguments
+	SecretCommand string `yaml:"secret_command"`
+	// Time limit for secret_command, 30s by default
+	SecretTimeout time.Duration `yaml:"secret_timeout"`
+	// Default time zone for job schedules, server local time if empty
+	Timezone string
+	// How long scheduler waits for running jobs on shutdown
+	ShutdownGrace time.Duration `yaml:"shutdown_grace"`
+	// Runs missed while scheduler was down not earlier than catch_up
+	// before startup are run once on startup, disabled if 0
+	CatchUp time.Duration `yaml:"catch_up"`
+	// Periods when scheduled runs of all jobs are skipped or deferred
+	Blackouts []BlackoutWindow
+	// Named host groups for fan-out jobs
+	Inventory map[string][]string
+	// Values applied to every job
+	Defaults rawJobConfig
+	// Named partial job configs for "extends"
+	Templates map[string]rawJobConfig
+	Jobs      map[string]*JobConfig
 }
 
 type SMTPConfig struct {
@@ -25,11 +52,70 @@ type SMTPConfig struct {
 	Port int
 }
 
+type OutputLogConfig struct {
+	HeadSize int64 `yaml:"head_size"`
+	TailSize int64 `yaml:"tail_size"`
+}
+
+func (cfg OutputLogConfig) GetHeadSize() int64 {
+	if cfg.HeadSize == 0 {
+		return OUTPUT_LOG_HEAD_SIZE
+	}
+	return cfg.HeadSize
+}
+
+func (cfg OutputLogConfig) GetTailSize() int64 {
+	if cfg.TailSize == 0 {
+		return OUTPUT_LOG_TAIL_SIZE
+	}
+	return cfg.TailSize
+}
+
+// LogDir returns directory for job output logs, placed near metadata dir
+func (cfg *Config) LogDir() string {
+	return metadataLogDir(cfg.MetadataDir)
+}
+
+// SchedulerStatePath returns file with last run times, placed near metadata dir
+func (cfg *Config) SchedulerStatePath() string {
+	return path.Clean(cfg.MetadataDir) + "_scheduler.json"
+}
+
+func (cfg *Config) GetSecretTimeout() time.Duration {
+	if cfg.SecretTimeout == 0 {
+		return SECRET_TIMEOUT
+	}
+	return cfg.SecretTimeout
+}
+
+func (cfg *Config) GetShutdownGrace() time.Duration {
+	if cfg.ShutdownGrace == 0 {
+		return SHUTDOWN_GRACE
+	}
+	return cfg.ShutdownGrace
+}
+
+// CatchUpWindow returns catch-up window of job
+func (cfg *Config) CatchUpWindow(jobConfig *JobConfig) time.Duration {
+	if jobConfig.CatchUp != 0 {
+		return jobConfig.CatchUp
+	}
+	return cfg.CatchUp
+}
+
 func (cfg *Config) PrettyFmt() []byte {
-	s, _ := yaml.Marshal(cfg)
+	masked := *cfg
+	masked.Jobs = make(map[string]*JobConfig, len(cfg.Jobs))
+	for jobName, jobConfig := range cfg.Jobs {
+		maskedJobConfig := jobConfig.Masked()
+		masked.Jobs[jobName] = &maskedJobConfig
+	}
+	s, _ := yaml.Marshal(&masked)
 	return s
 }
 
+// RunAtSpec is job schedule. In yaml it is either map of cron fields,
+// or cron line (5 or 6 fields, or descriptor like @daily), or list of them.
 type RunAtSpec struct {
 	Second  string
 	Minute  string
@@ -37,6 +123,56 @@ type RunAtSpec struct {
 	Day     string
 	Month   string
 	Weekday string
+	// Cron lines, used instead of fields if not empty
+	Specs []string `yaml:"-"`
+}
+
+// runAtFields is RunAtSpec without custom yaml methods
+type runAtFields RunAtSpec
+
+func (r *RunAtSpec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// failed attempts are remembered by decoder, so check value kind first
+	var raw interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	switch raw.(type) {
+	case string:
+		var spec string
+		if err := unmarshal(&spec); err != nil {
+			return err
+		}
+		*r = RunAtSpec{Specs: []string{spec}}
+		return nil
+	case []interface{}:
+		var specs []string
+		if err := unmarshal(&specs); err != nil {
+			return err
+		}
+		*r = RunAtSpec{Specs: specs}
+		return nil
+	}
+	fields := runAtFields{}
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	*r = RunAtSpec(fields)
+	return nil
+}
+
+func (r RunAtSpec) MarshalYAML() (interface{}, error) {
+	if len(r.Specs) == 1 {
+		return r.Specs[0], nil
+	}
+	if len(r.Specs) > 1 {
+		return r.Specs, nil
+	}
+	return runAtFields(r), nil
+}
+
+func (r *RunAtSpec) IsEmpty() bool {
+	return len(r.Specs) == 0 && r.Second == "" && r.Minute == "" && r.Hour == "" &&
+		r.Day == "" && r.Month == "" && r.Weekday == ""
 }
 
 func (r *RunAtSpec) SchedulerString() string {
@@ -54,6 +190,118 @@ func (r *RunAtSpec) SchedulerString() string {
 	)
 }
 
+// Sanitize converts cron lines to 6-field scheduler format
+func (r *RunAtSpec) Sanitize() error {
+	for idx, spec := range r.Specs {
+		spec = strings.TrimSpace(spec)
+		if strings.HasPrefix(spec, "@") {
+			r.Specs[idx] = spec
+			continue
+		}
+		fields := strings.Fields(spec)
+		switch len(fields) {
+		case 5:
+			fields = append([]string{"0"}, fields...)
+		case 6:
+		default:
+			return errors.New(fmt.Sprintf("run_at: expected 5 or 6 fields, found %d: '%s'", len(fields), spec))
+		}
+		r.Specs[idx] = strings.Join(fields, " ")
+	}
+	return nil
+}
+
+// Schedules returns normalized scheduler specs
+func (r *RunAtSpec) Schedules() []string {
+	if r.IsEmpty() {
+		return nil
+	}
+	if len(r.Specs) != 0 {
+		return r.Specs
+	}
+	return []string{r.SchedulerString()}
+}
+
+// Check validates all schedule specs
+func (r *RunAtSpec) Check() error {
+	for _, spec := range r.Schedules() {
+		if _, err := cron.Parse(spec); err != nil {
+			return errors.New(fmt.Sprintf("run_at: '%s': %s", spec, err))
+		}
+	}
+	return nil
+}
+
+var ARG_NAME_RE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type SSHOptions struct {
+	User                  string
+	IdentityFile          string        `yaml:"identity_file"`
+	JumpHosts             []string      `yaml:"jump_hosts"`
+	ConnectTimeout        time.Duration `yaml:"connect_timeout"`
+	StrictHostKeyChecking string        `yaml:"strict_host_key_checking"`
+	Options               []string      `yaml:"ssh_options"`
+}
+
+var SSH_STRICT_HOST_KEY_CHECKING_MODES = []string{"yes", "no", "ask", "accept-new", "off"}
+
+func (opts *SSHOptions) Sanitize() error {
+	if opts.StrictHostKeyChecking != "" {
+		valid := false
+		for _, mode := range SSH_STRICT_HOST_KEY_CHECKING_MODES {
+			if opts.StrictHostKeyChecking == mode {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			e := fmt.Sprintf("invalid strict_host_key_checking '%s', must be one of %s",
+				opts.StrictHostKeyChecking, strings.Join(SSH_STRICT_HOST_KEY_CHECKING_MODES, ", "))
+			return errors.New(e)
+		}
+	}
+	if opts.ConnectTimeout < 0 {
+		return errors.New(fmt.Sprintf("negative connect_timeout '%s'", opts.ConnectTimeout))
+	}
+	if opts.ConnectTimeout%time.Second != 0 {
+		return errors.New(fmt.Sprintf("connect_timeout '%s' must be a whole number of seconds", opts.ConnectTimeout))
+	}
+	for _, jumpHost := range opts.JumpHosts {
+		if jumpHost == "" || strings.ContainsAny(jumpHost, ", \t") {
+			return errors.New(fmt.Sprintf("invalid jump host '%s'", jumpHost))
+		}
+	}
+	for _, option := range opts.Options {
+		if !strings.Contains(option, "=") {
+			return errors.New(fmt.Sprintf("invalid ssh option '%s', must be in form Key=Value", option))
+		}
+	}
+	return nil
+}
+
+// Check verifies things that may change after the config was parsed,
+// like presence of identity files. Used by bakapy-scheduler -test.
+func (opts *SSHOptions) Check() error {
+	if opts.IdentityFile == "" {
+		return nil
+	}
+	info, err := os.Stat(opts.IdentityFile)
+	if err != nil {
+		return errors.New(fmt.Sprintf("identity file: %s", err))
+	}
+	if info.IsDir() {
+		return errors.New(fmt.Sprintf("identity file %s is a directory", opts.IdentityFile))
+	}
+	return nil
+}
+
+type JobStep struct {
+	Name            string
+	Command         string
+	Args            map[string]string
+	ContinueOnError bool `yaml:"continue_on_error"`
+}
+
 type JobConfig struct {
 	Sudo       bool
 	Disabled   bool
@@ -62,11 +310,51 @@ type JobConfig struct {
 	MaxAge     time.Duration `yaml:"max_age"`
 	Namespace  string
 	Host       string
-	Port       uint
+	Hosts      []string
+	Inventory  string
+	// Max number of hosts backed up simultaneously, unlimited if 0
+	MaxParallel  int    `yaml:"max_parallel"`
+	FanOutParent string `yaml:"-"`
+	// Each combination of matrix values becomes separate job
+	Matrix       map[string][]string
+	MatrixParent string            `yaml:"-"`
+	MatrixValues map[string]string `yaml:"-"`
+	Port         uint
+	// Template name this job inherits values from
+	Extends    string
+	SSHOptions `yaml:",inline"`
 	Command    string
+	Steps      []JobStep
 	Args       map[string]string
-	RunAt      RunAtSpec `yaml:"run_at"`
-	executor   Executer  `yaml:"-"`
+	SecretArgs []string `yaml:"secret_args"`
+	PreHooks   []string `yaml:"pre_hooks"`
+	PostHooks  []string `yaml:"post_hooks"`
+	// Time limit for each hook, 10m by default
+	HookTimeout time.Duration `yaml:"hook_timeout"`
+	RunAt       RunAtSpec     `yaml:"run_at"`
+	// Time zone name for run_at, like Europe/Moscow
+	Timezone string
+	// Random delay up to this duration before each scheduled run
+	Jitter time.Duration
+	// Overrides global catch_up for this job
+	CatchUp time.Duration `yaml:"catch_up"`
+	// Periods when scheduled runs are skipped or deferred, in addition to global ones
+	Blackouts []BlackoutWindow
+	After     []string
+	OnSuccess []string `yaml:"on_success"`
+	OnFailure []string `yaml:"on_failure"`
+	executor  Executer `yaml:"-"`
+	children  []string
+	source    jobSource
+	layers    []configLayer
+	location  *time.Location
+}
+
+func (jobConfig *JobConfig) GetHookTimeout() time.Duration {
+	if jobConfig.HookTimeout == 0 {
+		return HOOK_TIMEOUT
+	}
+	return jobConfig.HookTimeout
 }
 
 func (jobConfig *JobConfig) Sanitize() error {
@@ -78,9 +366,203 @@ func (jobConfig *JobConfig) Sanitize() error {
 	if jobConfig.MaxAgeDays != 0 {
 		jobConfig.MaxAge = time.Duration(jobConfig.MaxAgeDays) * time.Hour * 24
 	}
+	if err := jobConfig.RunAt.Sanitize(); err != nil {
+		return err
+	}
+	if jobConfig.Timezone != "" {
+		location, err := time.LoadLocation(jobConfig.Timezone)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid timezone '%s': %s", jobConfig.Timezone, err))
+		}
+		jobConfig.location = location
+	}
+	if jobConfig.CatchUp < 0 {
+		return errors.New(fmt.Sprintf("negative catch_up '%s'", jobConfig.CatchUp))
+	}
+	if jobConfig.HookTimeout < 0 {
+		return errors.New(fmt.Sprintf("negative hook_timeout '%s'", jobConfig.HookTimeout))
+	}
+	if jobConfig.Jitter < 0 {
+		return errors.New(fmt.Sprintf("negative jitter '%s'", jobConfig.Jitter))
+	}
+	for idx := range jobConfig.Blackouts {
+		if err := jobConfig.Blackouts[idx].Sanitize(); err != nil {
+			return err
+		}
+	}
+	if err := jobConfig.SSHOptions.Sanitize(); err != nil {
+		return err
+	}
+	for argName := range jobConfig.Args {
+		if !ARG_NAME_RE.MatchString(argName) {
+			return errors.New(fmt.Sprintf("invalid argument name '%s'", argName))
+		}
+	}
+	for _, secretName := range jobConfig.SecretArgs {
+		if !jobConfig.hasArg(secretName) {
+			return errors.New(fmt.Sprintf("secret argument '%s' not defined in args", secretName))
+		}
+	}
+	if err := jobConfig.sanitizeSteps(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// allArgs returns job args and args of all steps
+func (jobConfig *JobConfig) allArgs() []map[string]string {
+	all := []map[string]string{jobConfig.Args}
+	for _, step := range jobConfig.Steps {
+		all = append(all, step.Args)
+	}
+	return all
+}
+
+// IsSecretArg reports whether argument is listed in secret args. Names
+// are compared ignoring case, as arguments are exported uppercased.
+func IsSecretArg(secretArgs []string, name string) bool {
+	for _, secretName := range secretArgs {
+		if strings.EqualFold(secretName, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasArg reports whether job or any of its steps defines argument,
+// names are compared like in IsSecretArg
+func (jobConfig *JobConfig) hasArg(name string) bool {
+	for _, args := range jobConfig.allArgs() {
+		for argName := range args {
+			if IsSecretArg([]string{name}, argName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (jobConfig *JobConfig) sanitizeSteps() error {
+	if len(jobConfig.Steps) == 0 {
+		return nil
+	}
+	if jobConfig.Command != "" {
+		return errors.New("both command and steps defined")
+	}
+	names := map[string]bool{}
+	for idx := range jobConfig.Steps {
+		step := &jobConfig.Steps[idx]
+		if step.Command == "" {
+			return errors.New(fmt.Sprintf("step %d: command is not defined", idx+1))
+		}
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("step%d", idx+1)
+		}
+		if names[step.Name] {
+			return errors.New(fmt.Sprintf("duplicated step name %s", step.Name))
+		}
+		names[step.Name] = true
+		for argName := range step.Args {
+			if !ARG_NAME_RE.MatchString(argName) {
+				return errors.New(fmt.Sprintf("step %s: invalid argument name '%s'", step.Name, argName))
+			}
+		}
+	}
 	return nil
 }
 
+// Copy returns deep copy of job config, sharing no slices or maps with it.
+func (jobConfig *JobConfig) Copy() JobConfig {
+	dup := *jobConfig
+	dup.Hosts = copyStrings(jobConfig.Hosts)
+	if jobConfig.Matrix != nil {
+		dup.Matrix = make(map[string][]string, len(jobConfig.Matrix))
+		for key, values := range jobConfig.Matrix {
+			dup.Matrix[key] = copyStrings(values)
+		}
+	}
+	dup.MatrixValues = copyArgs(jobConfig.MatrixValues)
+	dup.JumpHosts = copyStrings(jobConfig.JumpHosts)
+	dup.Options = copyStrings(jobConfig.Options)
+	if jobConfig.Steps != nil {
+		dup.Steps = make([]JobStep, len(jobConfig.Steps))
+		for idx, step := range jobConfig.Steps {
+			dup.Steps[idx] = step
+			dup.Steps[idx].Args = copyArgs(step.Args)
+		}
+	}
+	dup.Args = copyArgs(jobConfig.Args)
+	dup.SecretArgs = copyStrings(jobConfig.SecretArgs)
+	dup.PreHooks = copyStrings(jobConfig.PreHooks)
+	dup.PostHooks = copyStrings(jobConfig.PostHooks)
+	dup.RunAt.Specs = copyStrings(jobConfig.RunAt.Specs)
+	if jobConfig.Blackouts != nil {
+		dup.Blackouts = make([]BlackoutWindow, len(jobConfig.Blackouts))
+		copy(dup.Blackouts, jobConfig.Blackouts)
+	}
+	dup.After = copyStrings(jobConfig.After)
+	dup.OnSuccess = copyStrings(jobConfig.OnSuccess)
+	dup.OnFailure = copyStrings(jobConfig.OnFailure)
+	dup.children = copyStrings(jobConfig.children)
+	return dup
+}
+
+func copyStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	return append([]string{}, values...)
+}
+
+func copyArgs(args map[string]string) map[string]string {
+	if args == nil {
+		return nil
+	}
+	dup := make(map[string]string, len(args))
+	for argName, argValue := range args {
+		dup[argName] = argValue
+	}
+	return dup
+}
+
+// Masked returns copy of job config with secret argument values hidden.
+func (jobConfig *JobConfig) Masked() JobConfig {
+	masked := *jobConfig
+	masked.Args = jobConfig.maskArgs(jobConfig.Args)
+	masked.Steps = make([]JobStep, len(jobConfig.Steps))
+	for idx, step := range jobConfig.Steps {
+		masked.Steps[idx] = step
+		masked.Steps[idx].Args = jobConfig.maskArgs(step.Args)
+	}
+	return masked
+}
+
+func (jobConfig *JobConfig) maskArgs(args map[string]string) map[string]string {
+	masked := make(map[string]string, len(args))
+	for argName, argValue := range args {
+		if IsSecretArg(jobConfig.SecretArgs, argName) {
+			argValue = SECRET_MASK
+		}
+		masked[argName] = argValue
+	}
+	return masked
+}
+
+// Location returns time zone used for job schedule and metadata times
+func (jobConfig *JobConfig) Location() *time.Location {
+	if jobConfig.location == nil {
+		return time.Local
+	}
+	return jobConfig.location
+}
+
+func (jobConfig *JobConfig) Check() error {
+	if jobConfig.Host == "" {
+		return nil
+	}
+	return jobConfig.SSHOptions.Check()
+}
+
 func NewConfig() *Config {
 	jobs := Config{
 		Jobs: map[string]*JobConfig{},
@@ -89,56 +571,172 @@ func NewConfig() *Config {
 }
 
 func ParseConfig(configPath string) (*Config, error) {
+	return parseConfig(configPath, true)
+}
+
+// parseConfig reads config and included job files. Unknown keys are
+// errors in strict mode, CheckConfig reports them separately.
+func parseConfig(configPath string, strict bool) (*Config, error) {
+	cfg, errs := loadConfig(configPath, strict)
+	if len(errs) != 0 {
+		return nil, errs[0]
+	}
+	return cfg, nil
+}
+
+// loadConfig reads config and returns all found problems. Config is nil
+// if it cannot be read at all, otherwise it contains jobs which were
+// resolved successfully.
+func loadConfig(configPath string, strict bool) (*Config, []error) {
 	cfg := NewConfig()
 
 	rawConfig, err := ioutil.ReadFile(configPath)
 	if err != nil {
-		return nil, err
+		return nil, []error{err}
+	}
+
+	if strict {
+		errs := newConfigFile(configPath, rawConfig).UnknownKeys(reflect.TypeOf(Config{}))
+		if len(errs) != 0 {
+			return nil, []error{errs[0]}
+		}
 	}
 
 	err = yaml.Unmarshal(rawConfig, cfg)
 	if err != nil {
-		return nil, err
+		return nil, []error{err}
+	}
+
+	errs := []error{}
+	if cfg.OutputLog.HeadSize < 0 || cfg.OutputLog.TailSize < 0 {
+		errs = append(errs, errors.New("output_log: head_size and tail_size must not be negative"))
 	}
 
-	configDir := path.Dir(configPath)
+	if cfg.Timezone != "" {
+		if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("invalid timezone '%s': %s", cfg.Timezone, err)))
+			cfg.Timezone = ""
+		}
+	}
+
+	if cfg.CatchUp < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("negative catch_up '%s'", cfg.CatchUp)))
+	}
+
+	if cfg.SecretTimeout < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("negative secret_timeout '%s'", cfg.SecretTimeout)))
+	}
+
+	for idx := range cfg.Blackouts {
+		if err := cfg.Blackouts[idx].Sanitize(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	mainJobs := struct {
+		Jobs map[string]rawJobConfig
+	}{}
+	err = yaml.Unmarshal(rawConfig, &mainJobs)
+	if err != nil {
+		return nil, append(errs, err)
+	}
+
+	rawJobs := map[string]rawJobConfig{}
 	jobDefines := map[string]string{}
-	for _, relPathGlob := range cfg.IncludeJobs {
-		pathGlob := path.Join(configDir, relPathGlob)
-		paths, err := filepath.Glob(pathGlob)
+	for name, params := range mainJobs.Jobs {
+		rawJobs[name] = params
+		jobDefines[name] = configPath
+	}
+	paths, err := includedFiles(configPath, cfg.IncludeJobs)
+	if err != nil {
+		return nil, append(errs, err)
+	}
+	for _, path := range paths {
+		raw, err := ioutil.ReadFile(path)
 		if err != nil {
-			return nil, err
+			return nil, append(errs, err)
 		}
-
-		for _, path := range paths {
-			raw, err := ioutil.ReadFile(path)
-			if err != nil {
-				return nil, err
+		if strict {
+			keyErrs := newConfigFile(path, raw).UnknownKeys(reflect.TypeOf(map[string]rawJobConfig{}))
+			if len(keyErrs) != 0 {
+				return nil, append(errs, keyErrs[0])
 			}
-			jobs := map[string]*JobConfig{}
-			err = yaml.Unmarshal(raw, &jobs)
-			if err != nil {
-				return nil, err
+		}
+		jobs := map[string]rawJobConfig{}
+		err = yaml.Unmarshal(raw, &jobs)
+		if err != nil {
+			return nil, append(errs, errors.New(path+": "+err.Error()))
+		}
+		for name, params := range jobs {
+			if _, exist := jobDefines[name]; exist {
+				errString := fmt.Sprintf(
+					"%s: duplicated job name %s, previously defined at %s",
+					path, name, jobDefines[name])
+				errs = append(errs, errors.New(errString))
+				continue
 			}
-			for name, params := range jobs {
-				if _, exist := jobDefines[name]; exist {
-					errString := fmt.Sprintf(
-						"%s: duplicated job name %s, previously defined at %s",
-						path, name, jobDefines[name])
-					return nil, errors.New(errString)
+			jobDefines[name] = path
+			rawJobs[name] = params
+		}
+	}
+
+	jobNames := make([]string, 0, len(rawJobs))
+	for jobName := range rawJobs {
+		jobNames = append(jobNames, jobName)
+	}
+	sort.Strings(jobNames)
+
+	secrets := NewSecretResolver(cfg.SecretCommand)
+	broken := map[string]bool{}
+	cfg.Jobs = make(map[string]*JobConfig, len(rawJobs))
+	for _, jobName := range jobNames {
+		jobConfig, err := cfg.resolveJob(jobName, rawJobs[jobName], jobDefines[jobName], configPath)
+		if err != nil {
+			errs = append(errs, err)
+			broken[jobName] = true
+			continue
+		}
+		jobConfig.source = jobSource{jobDefines[jobName], jobName}
+		cfg.Jobs[jobName] = jobConfig
+		for _, args := range jobConfig.allArgs() {
+			for argName, argValue := range args {
+				ref, isRef := ParseSecretRef(argValue)
+				if !isRef {
+					continue
+				}
+				if err := secrets.Validate(ref); err != nil {
+					errs = append(errs, errors.New("job "+jobName+": argument "+argName+": "+err.Error()))
 				}
-				jobDefines[name] = path
-				cfg.Jobs[name] = params
 			}
 		}
 	}
 
-	for jobName, jobConfig := range cfg.Jobs {
-		err := jobConfig.Sanitize()
-		if err != nil {
-			return nil, errors.New("job " + jobName + ": " + err.Error())
+	if err := cfg.expandMatrix(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := cfg.expandFanOut(); err != nil {
+		errs = append(errs, err)
+	}
+
+	jobNames = make([]string, 0, len(cfg.Jobs))
+	for jobName := range cfg.Jobs {
+		jobNames = append(jobNames, jobName)
+	}
+	sort.Strings(jobNames)
+	for _, jobName := range jobNames {
+		jobConfig := cfg.Jobs[jobName]
+		if err := jobConfig.RunAt.ResolveHashes(jobName); err != nil {
+			errs = append(errs, errors.New("job "+jobName+": "+err.Error()))
+			continue
+		}
+		if strict {
+			if err := jobConfig.RunAt.Check(); err != nil {
+				errs = append(errs, errors.New("job "+jobName+": "+err.Error()))
+			}
 		}
 	}
 
-	return cfg, nil
+	errs = append(errs, cfg.dependencyErrors(broken)...)
+	return cfg, errs
 }
@@ -0,0 +1,370 @@
+package bakapy
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigError is configuration problem with its location
+type ConfigError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// jobSource is where job was defined, matrix sub-jobs and
+// fan-out children share it with their parent.
+type jobSource struct {
+	file string
+	name string
+}
+
+// configFile is yaml file with lines kept for error locations
+type configFile struct {
+	path  string
+	lines []string
+}
+
+func newConfigFile(filePath string, content []byte) configFile {
+	return configFile{filePath, strings.Split(string(content), "\n")}
+}
+
+// Locate returns line number of nested key, searching each path element
+// after the previous one. Returns 0 if key not found.
+func (f configFile) Locate(keys ...string) int {
+	line := 0
+	for _, key := range keys {
+		re := regexp.MustCompile(`(^|[\s{,'"])` + regexp.QuoteMeta(key) + `['"]?\s*:`)
+		found := false
+		for ; line < len(f.lines); line++ {
+			if re.MatchString(f.lines[line]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0
+		}
+	}
+	return line + 1
+}
+
+func (f configFile) Error(message string, keys ...string) ConfigError {
+	return ConfigError{File: f.path, Line: f.Locate(keys...), Message: message}
+}
+
+var rawJobConfigType = reflect.TypeOf(rawJobConfig{})
+var jobConfigType = reflect.TypeOf(JobConfig{})
+
+// yamlKeys returns keys known by yaml decoder for struct type
+func yamlKeys(typ reflect.Type) map[string]reflect.Type {
+	keys := map[string]reflect.Type{}
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		inline := false
+		for _, flag := range tag[1:] {
+			if flag == "inline" {
+				inline = true
+			}
+		}
+		if inline {
+			for key, keyType := range yamlKeys(field.Type) {
+				keys[key] = keyType
+			}
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		keys[name] = field.Type
+	}
+	return keys
+}
+
+// UnknownKeys returns errors for keys in yaml content which are not
+// used by decoding into value of type typ.
+func (f configFile) UnknownKeys(typ reflect.Type) []ConfigError {
+	var raw interface{}
+	content := []byte(strings.Join(f.lines, "\n"))
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return []ConfigError{{File: f.path, Message: err.Error()}}
+	}
+	errs := []ConfigError{}
+	f.walkKeys(raw, typ, nil, &errs)
+	return errs
+}
+
+func (f configFile) walkKeys(value interface{}, typ reflect.Type, keyPath []string, errs *[]ConfigError) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == rawJobConfigType {
+		typ = jobConfigType
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		rawMap, isMap := asRawMap(value)
+		if !isMap {
+			return
+		}
+		known := yamlKeys(typ)
+		for _, key := range sortedRawKeys(rawMap) {
+			keyType, exist := known[key]
+			if !exist {
+				message := "unknown key '" + key + "'"
+				if len(keyPath) != 0 {
+					message += " in " + strings.Join(keyPath, ".")
+				}
+				*errs = append(*errs, f.Error(message, append(keyPath, key)...))
+				continue
+			}
+			f.walkKeys(rawMap[key], keyType, append(keyPath, key), errs)
+		}
+	case reflect.Map:
+		rawMap, isMap := asRawMap(value)
+		if !isMap {
+			return
+		}
+		for _, key := range sortedRawKeys(rawMap) {
+			f.walkKeys(rawMap[key], typ.Elem(), append(keyPath, key), errs)
+		}
+	case reflect.Slice:
+		items, isSlice := value.([]interface{})
+		if !isSlice {
+			return
+		}
+		for _, item := range items {
+			f.walkKeys(item, typ.Elem(), keyPath, errs)
+		}
+	}
+}
+
+func sortedRawKeys(rawMap rawJobConfig) []string {
+	keys := make([]string, 0, len(rawMap))
+	for key := range rawMap {
+		keys = append(keys, fmt.Sprint(key))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// includedFiles returns job files matched by include_jobs globs
+func includedFiles(configPath string, includes []string) ([]string, error) {
+	configDir := path.Dir(configPath)
+	files := []string{}
+	for _, relPathGlob := range includes {
+		paths, err := filepath.Glob(path.Join(configDir, relPathGlob))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, paths...)
+	}
+	return files, nil
+}
+
+// CheckConfig parses config and returns all found problems: unknown keys,
+// invalid values, bad run_at specs, missing command files, namespace
+// collisions and invalid listen addresses.
+func CheckConfig(configPath string) []ConfigError {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return []ConfigError{{File: configPath, Message: err.Error()}}
+	}
+	mainFile := newConfigFile(configPath, content)
+	errs := mainFile.UnknownKeys(reflect.TypeOf(Config{}))
+
+	includes := struct {
+		IncludeJobs []string `yaml:"include_jobs"`
+	}{}
+	yaml.Unmarshal(content, &includes)
+	paths, err := includedFiles(configPath, includes.IncludeJobs)
+	if err != nil {
+		return append(errs, mainFile.Error(err.Error(), "include_jobs"))
+	}
+	files := map[string]configFile{configPath: mainFile}
+	for _, jobsPath := range paths {
+		content, err := ioutil.ReadFile(jobsPath)
+		if err != nil {
+			errs = append(errs, ConfigError{File: jobsPath, Message: err.Error()})
+			continue
+		}
+		files[jobsPath] = newConfigFile(jobsPath, content)
+		errs = append(errs, files[jobsPath].UnknownKeys(reflect.TypeOf(map[string]rawJobConfig{}))...)
+	}
+
+	cfg, loadErrs := loadConfig(configPath, false)
+	for _, err := range loadErrs {
+		if layerErr, ok := err.(layerError); ok {
+			message := "job " + layerErr.jobName + ": " + layerErr.message
+			errs = append(errs, files[layerErr.layer.file].Error(message, layerErr.layer.keys...))
+			continue
+		}
+		errs = append(errs, ConfigError{File: configPath, Message: err.Error()})
+	}
+	if cfg == nil {
+		return errs
+	}
+
+	for _, listen := range []struct{ key, addr string }{{"listen", cfg.Listen}, {"status_listen", cfg.StatusListen}} {
+		if listen.addr == "" && listen.key != "listen" {
+			continue
+		}
+		if err := checkListenAddress(listen.addr); err != nil {
+			errs = append(errs, mainFile.Error(listen.key+": "+err.Error(), listen.key))
+		}
+	}
+
+	jobNames := make([]string, 0, len(cfg.Jobs))
+	for jobName := range cfg.Jobs {
+		jobNames = append(jobNames, jobName)
+	}
+	sort.Strings(jobNames)
+
+	checked := map[jobSource]bool{}
+	for _, jobName := range jobNames {
+		jobConfig := cfg.Jobs[jobName]
+		source := jobConfig.source
+		if checked[source] {
+			continue
+		}
+		checked[source] = true
+		// inherited keys are reported at the template or defaults setting them
+		jobError := func(message string, key string) ConfigError {
+			message = "job " + source.name + ": " + message
+			layer, found := jobConfig.keyLayer(key)
+			if !found {
+				return ConfigError{File: source.file, Message: message}
+			}
+			if key == "" {
+				return files[layer.file].Error(message, layer.keys...)
+			}
+			return files[layer.file].Error(message, append(layer.keys, key)...)
+		}
+
+		if err := jobConfig.RunAt.Check(); err != nil {
+			errs = append(errs, jobError(err.Error(), "run_at"))
+		}
+		commands := []string{jobConfig.Command}
+		if len(jobConfig.Steps) != 0 {
+			commands = []string{}
+			for _, step := range jobConfig.Steps {
+				commands = append(commands, step.Command)
+			}
+		}
+		for _, command := range commands {
+			if command == "" {
+				errs = append(errs, jobError("command is not defined", ""))
+				continue
+			}
+			if _, err := os.Stat(path.Join(cfg.CommandDir, command)); err != nil {
+				errs = append(errs, jobError("command: "+err.Error(), "command"))
+			}
+		}
+		if err := jobConfig.Check(); err != nil {
+			errs = append(errs, jobError(err.Error(), ""))
+		}
+	}
+
+	for _, collision := range cfg.namespaceCollisions() {
+		source := cfg.Jobs[collision.jobs[0]].source
+		jobKeys := []string{source.name}
+		if source.file == configPath {
+			jobKeys = []string{"jobs", source.name}
+		}
+		message := fmt.Sprintf("namespace %s shared by jobs %s backing up different hosts or commands",
+			collision.namespace, strings.Join(collision.jobs, ", "))
+		errs = append(errs, files[source.file].Error(message, jobKeys...))
+	}
+	return errs
+}
+
+func checkListenAddress(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum < 0 || portNum > 65535 {
+		return errors.New(fmt.Sprintf("invalid port '%s'", port))
+	}
+	return nil
+}
+
+type namespaceCollision struct {
+	namespace string
+	jobs      []string
+}
+
+// namespaceCollisions returns namespaces used by jobs with different
+// host or command. Jobs sharing both (like full and incremental backups
+// of the same data) may use one namespace.
+func (cfg *Config) namespaceCollisions() []namespaceCollision {
+	byNamespace := map[string]map[string][]string{}
+	for jobName, jobConfig := range cfg.Jobs {
+		if jobConfig.IsFanOut() {
+			continue
+		}
+		what := jobConfig.Host + "\x00" + jobConfig.Command
+		for _, step := range jobConfig.Steps {
+			what += "\x00" + step.Command
+		}
+		if byNamespace[jobConfig.Namespace] == nil {
+			byNamespace[jobConfig.Namespace] = map[string][]string{}
+		}
+		byNamespace[jobConfig.Namespace][what] = append(byNamespace[jobConfig.Namespace][what], jobName)
+	}
+	collisions := []namespaceCollision{}
+	for namespace, sources := range byNamespace {
+		if len(sources) < 2 {
+			continue
+		}
+		jobs := []string{}
+		for _, jobNames := range sources {
+			jobs = append(jobs, jobNames...)
+		}
+		sort.Strings(jobs)
+		collisions = append(collisions, namespaceCollision{namespace, jobs})
+	}
+	sort.Sort(namespaceCollisionsSort(collisions))
+	return collisions
+}
+
+type namespaceCollisionsSort []namespaceCollision
+
+func (slice namespaceCollisionsSort) Len() int {
+	return len(slice)
+}
+
+func (slice namespaceCollisionsSort) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+func (slice namespaceCollisionsSort) Less(i, j int) bool {
+	return slice[i].namespace < slice[j].namespace
+}
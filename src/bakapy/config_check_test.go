@@ -0,0 +1,138 @@
+package bakapy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseConfig_UnknownKey(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+jobs:
+    www:
+      namespace: www
+      max_age_day: 5
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	_, err := ParseConfig(cfg.Name())
+	expectedErr := cfg.Name() + ":5: unknown key 'max_age_day' in jobs.www"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal("error must be", expectedErr, "not", err)
+	}
+}
+
+func TestCheckConfig_AllErrorsReported(t *testing.T) {
+	commandDir, _ := ioutil.TempDir("", "test_commands")
+	defer os.RemoveAll(commandDir)
+	ioutil.WriteFile(path.Join(commandDir, "ok.sh"), []byte("true"), 0644)
+
+	jobsFile, _ := ioutil.TempFile("", "test_jobs")
+	jobsFile.Write([]byte(`
+www:
+  namespace: www
+  command: ok.sh
+  run_at: {minute: "61", hour: "*", day: "*", month: "*", weekday: "*"}
+  sudoo: yes
+db:
+  namespace: www
+  command: missing.sh
+`))
+	jobsFile.Close()
+	defer os.Remove(jobsFile.Name())
+
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+listen: localhost
+command_dir: ` + commandDir + `
+storage_dirr: /tmp
+include_jobs: [` + path.Base(jobsFile.Name()) + `]
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	errs := CheckConfig(cfg.Name())
+	expected := []string{
+		cfg.Name() + ":4: unknown key 'storage_dirr'",
+		jobsFile.Name() + ":6: unknown key 'sudoo' in www",
+		cfg.Name() + ":2: listen: address localhost: missing port in address",
+		jobsFile.Name() + ":9: job db: command: stat " + path.Join(commandDir, "missing.sh") + ": no such file or directory",
+		jobsFile.Name() + ":5: job www: run_at: '0 61 * * * *': End of range (61) above maximum (59): 61",
+		jobsFile.Name() + ":7: namespace www shared by jobs db, www backing up different hosts or commands",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("errors must be", expected, "not", errs)
+	}
+	for idx, err := range errs {
+		if err.Error() != expected[idx] {
+			t.Fatal("error must be", expected[idx], "not", err.Error())
+		}
+	}
+}
+
+func TestCheckConfig_LoadErrorsCollected(t *testing.T) {
+	commandDir, _ := ioutil.TempDir("", "test_commands")
+	defer os.RemoveAll(commandDir)
+	ioutil.WriteFile(path.Join(commandDir, "ok.sh"), []byte("true"), 0644)
+
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+listen: 127.0.0.1:9876
+command_dir: ` + commandDir + `
+blackouts:
+  - {name: x}
+templates:
+  nightly:
+    run_at: {minute: "61", hour: "*", day: "*", month: "*", weekday: "*"}
+jobs:
+  bad_args:
+    command: ok.sh
+    namespace: a
+    args: {bad-name: x}
+  bad_ssh:
+    command: ok.sh
+    namespace: b
+    strict_host_key_checking: maybe
+  www:
+    extends: nightly
+    command: ok.sh
+    namespace: www
+    after: [missing]
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	errs := CheckConfig(cfg.Name())
+	expected := []string{
+		cfg.Name() + ": blackout x: either from/to or schedule/duration must be defined",
+		cfg.Name() + ":10: job bad_args: invalid argument name 'bad-name'",
+		cfg.Name() + ":14: job bad_ssh: invalid strict_host_key_checking 'maybe', must be one of yes, no, ask, accept-new, off",
+		cfg.Name() + ": job www: after: unknown job missing",
+		cfg.Name() + ":8: job www: run_at: '0 61 * * * *': End of range (61) above maximum (59): 61",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("errors must be", expected, "not", errs)
+	}
+	for idx, err := range errs {
+		if err.Error() != expected[idx] {
+			t.Fatal("error must be", expected[idx], "not", err.Error())
+		}
+	}
+}
+
+func TestCheckConfig_Ok(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+listen: 127.0.0.1:9876
+status_listen: :9877
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	if errs := CheckConfig(cfg.Name()); len(errs) != 0 {
+		t.Fatal("errors must be empty, not", errs)
+	}
+}
@@ -0,0 +1,146 @@
+package bakapy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Downstream returns names of jobs which must be triggered after
+// job completion with given status. Jobs listing it in after are
+// triggered only on success. Order is stable.
+func (cfg *Config) Downstream(jobName string, success bool) []string {
+	jobConfig, exist := cfg.Jobs[jobName]
+	if !exist {
+		return nil
+	}
+	seen := map[string]bool{}
+	downstream := []string{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			downstream = append(downstream, name)
+		}
+	}
+
+	if success {
+		for _, name := range jobConfig.OnSuccess {
+			add(name)
+		}
+	} else {
+		for _, name := range jobConfig.OnFailure {
+			add(name)
+		}
+	}
+
+	if !success {
+		return downstream
+	}
+	var after []string
+	for name, downstreamConfig := range cfg.Jobs {
+		for _, upstream := range downstreamConfig.After {
+			if upstream == jobName {
+				after = append(after, name)
+			}
+		}
+	}
+	sort.Strings(after)
+	for _, name := range after {
+		add(name)
+	}
+	return downstream
+}
+
+// dependencyGraph returns all upstream -> downstream edges
+func (cfg *Config) dependencyGraph() map[string][]string {
+	graph := map[string][]string{}
+	for name, jobConfig := range cfg.Jobs {
+		graph[name] = append(graph[name], jobConfig.OnSuccess...)
+		graph[name] = append(graph[name], jobConfig.OnFailure...)
+		for _, upstream := range jobConfig.After {
+			graph[upstream] = append(graph[upstream], name)
+		}
+	}
+	for name := range graph {
+		sort.Strings(graph[name])
+	}
+	return graph
+}
+
+// CheckDependencies validates job references in after, on_success
+// and on_failure and detects dependency cycles.
+func (cfg *Config) CheckDependencies() error {
+	if errs := cfg.dependencyErrors(nil); len(errs) != 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// dependencyErrors returns all unknown job references and first found
+// dependency cycle. References to broken jobs, which failed to load,
+// are not reported.
+func (cfg *Config) dependencyErrors(broken map[string]bool) []error {
+	errs := []error{}
+	names := make([]string, 0, len(cfg.Jobs))
+	for name := range cfg.Jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		jobConfig := cfg.Jobs[name]
+		refs := map[string][]string{
+			"after":      jobConfig.After,
+			"on_success": jobConfig.OnSuccess,
+			"on_failure": jobConfig.OnFailure,
+		}
+		for _, field := range []string{"after", "on_success", "on_failure"} {
+			for _, ref := range refs[field] {
+				if _, exist := cfg.Jobs[ref]; !exist && !broken[ref] {
+					errs = append(errs, errors.New(fmt.Sprintf("job %s: %s: unknown job %s", name, field, ref)))
+				}
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		inProgress
+		done
+	)
+	graph := cfg.dependencyGraph()
+	state := map[string]int{}
+	var stack []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		state[name] = inProgress
+		stack = append(stack, name)
+		for _, next := range graph[name] {
+			switch state[next] {
+			case inProgress:
+				cycle := []string{next}
+				for i := len(stack) - 1; stack[i] != next; i-- {
+					cycle = append([]string{stack[i]}, cycle...)
+				}
+				cycle = append([]string{next}, cycle...)
+				return errors.New("job dependency cycle: " + strings.Join(cycle, " -> "))
+			case unvisited:
+				if err := visit(next); err != nil {
+					return err
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+		return nil
+	}
+	for _, name := range names {
+		if state[name] == unvisited {
+			if err := visit(name); err != nil {
+				return append(errs, err)
+			}
+		}
+	}
+	return errs
+}
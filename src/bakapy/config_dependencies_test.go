@@ -0,0 +1,91 @@
+package bakapy
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfig_Downstream(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Jobs["dump"] = &JobConfig{OnSuccess: []string{"files"}, OnFailure: []string{"alert"}}
+	cfg.Jobs["files"] = &JobConfig{}
+	cfg.Jobs["alert"] = &JobConfig{}
+	cfg.Jobs["verify"] = &JobConfig{After: []string{"dump"}}
+	cfg.Jobs["cleanup"] = &JobConfig{After: []string{"dump"}}
+
+	downstream := strings.Join(cfg.Downstream("dump", true), ",")
+	if downstream != "files,cleanup,verify" {
+		t.Fatal("wrong downstream on success:", downstream)
+	}
+	downstream = strings.Join(cfg.Downstream("dump", false), ",")
+	if downstream != "alert" {
+		t.Fatal("wrong downstream on failure:", downstream)
+	}
+	if len(cfg.Downstream("files", true)) != 0 {
+		t.Fatal("files must not have downstream jobs")
+	}
+}
+
+func TestConfig_CheckDependencies_UnknownJob(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Jobs["dump"] = &JobConfig{OnSuccess: []string{"DOES_NOT_EXIST"}}
+	err := cfg.CheckDependencies()
+	expectedErr := "job dump: on_success: unknown job DOES_NOT_EXIST"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+}
+
+func TestConfig_CheckDependencies_Cycle(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Jobs["a"] = &JobConfig{OnSuccess: []string{"b"}}
+	cfg.Jobs["b"] = &JobConfig{}
+	cfg.Jobs["c"] = &JobConfig{After: []string{"b"}, OnFailure: []string{"a"}}
+	err := cfg.CheckDependencies()
+	expectedErr := "job dependency cycle: a -> b -> c -> a"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+}
+
+func TestConfig_CheckDependencies_SelfCycle(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Jobs["a"] = &JobConfig{After: []string{"a"}}
+	err := cfg.CheckDependencies()
+	expectedErr := "job dependency cycle: a -> a"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+}
+
+func TestConfig_CheckDependencies_Ok(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Jobs["a"] = &JobConfig{OnSuccess: []string{"b", "c"}}
+	cfg.Jobs["b"] = &JobConfig{OnSuccess: []string{"c"}}
+	cfg.Jobs["c"] = &JobConfig{}
+	cfg.Jobs["d"] = &JobConfig{After: []string{"a", "c"}}
+	if err := cfg.CheckDependencies(); err != nil {
+		t.Fatal("Error:", err)
+	}
+}
+
+func TestParseConfig_DependencyCycle(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+jobs:
+    dump:
+      after: [verify]
+    verify:
+      after: [dump]
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	_, err := ParseConfig(cfg.Name())
+	expectedErr := "job dependency cycle: dump -> verify -> dump"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+}
@@ -0,0 +1,212 @@
+package bakapy
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"strings"
+)
+
+// rawJobConfig is job configuration as read from yaml, before
+// defaults and templates are applied.
+type rawJobConfig map[interface{}]interface{}
+
+// configLayer is one source of job configuration values. File and keys
+// locate layer values for error reporting.
+type configLayer struct {
+	source string
+	raw    rawJobConfig
+	file   string
+	keys   []string
+}
+
+// layerError is job configuration error caused by one of its layers
+type layerError struct {
+	jobName string
+	layer   configLayer
+	message string
+}
+
+func (e layerError) Error() string {
+	return "job " + e.jobName + ": " + e.message
+}
+
+func (layer configLayer) decode() (*JobConfig, error) {
+	jobConfig := &JobConfig{}
+	raw, err := yaml.Marshal(layer.raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(raw, jobConfig); err != nil {
+		return nil, err
+	}
+	return jobConfig, nil
+}
+
+// mergeRaw returns deep copy of base with override values applied.
+// Nested maps are merged recursively, other values are replaced.
+func mergeRaw(base, override rawJobConfig) rawJobConfig {
+	result := make(rawJobConfig, len(base)+len(override))
+	for key, value := range base {
+		result[key] = value
+	}
+	for key, value := range override {
+		overrideMap, isMap := asRawMap(value)
+		baseMap, baseIsMap := asRawMap(result[key])
+		if isMap && baseIsMap {
+			result[key] = mergeRaw(baseMap, overrideMap)
+			continue
+		}
+		result[key] = value
+	}
+	return result
+}
+
+// asRawMap handles yaml decoder reusing rawJobConfig type for nested maps
+func asRawMap(value interface{}) (rawJobConfig, bool) {
+	switch m := value.(type) {
+	case rawJobConfig:
+		return m, true
+	case map[interface{}]interface{}:
+		return rawJobConfig(m), true
+	}
+	return nil, false
+}
+
+func rawExtends(raw rawJobConfig) (string, error) {
+	value, exist := raw["extends"]
+	if !exist || value == nil {
+		return "", nil
+	}
+	name, ok := value.(string)
+	if !ok || name == "" {
+		return "", errors.New(fmt.Sprintf("invalid extends value '%v'", value))
+	}
+	return name, nil
+}
+
+// templateChain returns layers for template and all templates it extends,
+// most generic first.
+func (cfg *Config) templateChain(name, configPath string) ([]configLayer, error) {
+	chain := []configLayer{}
+	visited := []string{}
+	for name != "" {
+		for _, seen := range visited {
+			if seen == name {
+				return nil, errors.New("templates extends cycle: " + strings.Join(append(visited, name), " -> "))
+			}
+		}
+		visited = append(visited, name)
+		raw, exist := cfg.Templates[name]
+		if !exist {
+			return nil, errors.New(fmt.Sprintf("unknown template %s", name))
+		}
+		layer := configLayer{
+			source: fmt.Sprintf("template %s at %s", name, configPath),
+			raw:    raw,
+			file:   configPath,
+			keys:   []string{"templates", name},
+		}
+		chain = append([]configLayer{layer}, chain...)
+		parent, err := rawExtends(raw)
+		if err != nil {
+			return nil, errors.New(layer.source + ": " + err.Error())
+		}
+		name = parent
+	}
+	return chain, nil
+}
+
+// resolveJob applies defaults and templates to job and returns
+// sanitized effective job configuration. Errors are layerError.
+func (cfg *Config) resolveJob(jobName string, raw rawJobConfig, jobPath, configPath string) (*JobConfig, error) {
+	jobLayer := configLayer{source: jobPath, raw: raw, file: jobPath, keys: []string{jobName}}
+	if jobPath == configPath {
+		jobLayer.keys = []string{"jobs", jobName}
+	}
+	extends, err := rawExtends(raw)
+	if err != nil {
+		return nil, layerError{jobName, jobLayer, err.Error()}
+	}
+	layers := []configLayer{}
+	if len(cfg.Defaults) != 0 {
+		layers = append(layers, configLayer{
+			source: "defaults at " + configPath,
+			raw:    cfg.Defaults,
+			file:   configPath,
+			keys:   []string{"defaults"},
+		})
+	}
+	chain, err := cfg.templateChain(extends, configPath)
+	if err != nil {
+		return nil, layerError{jobName, jobLayer, err.Error()}
+	}
+	layers = append(layers, chain...)
+	layers = append(layers, jobLayer)
+
+	merged := rawJobConfig{}
+	for _, layer := range layers {
+		// report type errors against the file they came from
+		if _, err := layer.decode(); err != nil {
+			return nil, layerError{jobName, layer, layer.source + ": " + err.Error()}
+		}
+		merged = mergeRaw(merged, layer.raw)
+	}
+	delete(merged, "extends")
+
+	jobConfig, err := configLayer{raw: merged}.decode()
+	if err != nil {
+		return nil, layerError{jobName, jobLayer, jobPath + ": " + err.Error()}
+	}
+	jobConfig.Extends = extends
+	jobConfig.layers = layers
+	if jobConfig.Timezone == "" {
+		jobConfig.Timezone = cfg.Timezone
+	}
+
+	if err := jobConfig.Sanitize(); err != nil {
+		layer := blameLayer(layers, err)
+		if layer.source == jobPath {
+			return nil, layerError{jobName, layer, err.Error()}
+		}
+		return nil, layerError{jobName, layer, layer.source + ": " + err.Error()}
+	}
+	return jobConfig, nil
+}
+
+// blameLayer returns inherited layer which alone produces given
+// validation error, job layer if error comes from job itself or
+// from combination of layers.
+func blameLayer(layers []configLayer, err error) configLayer {
+	for idx := len(layers) - 2; idx >= 0; idx-- {
+		jobConfig, decodeErr := layers[idx].decode()
+		if decodeErr != nil {
+			continue
+		}
+		if layerErr := jobConfig.Sanitize(); layerErr != nil && layerErr.Error() == err.Error() {
+			return layers[idx]
+		}
+	}
+	return layers[len(layers)-1]
+}
+
+// keyLayer returns last layer setting given key, job layer if key
+// is not set by any of them.
+func (jobConfig *JobConfig) keyLayer(key string) (configLayer, bool) {
+	for idx := len(jobConfig.layers) - 1; idx >= 0; idx-- {
+		if _, exist := jobConfig.layers[idx].raw[key]; exist {
+			return jobConfig.layers[idx], true
+		}
+	}
+	if len(jobConfig.layers) == 0 {
+		return configLayer{}, false
+	}
+	return jobConfig.layers[len(jobConfig.layers)-1], true
+}
+
+// EffectiveFmt returns job configuration with defaults and templates applied
+func (jobConfig *JobConfig) EffectiveFmt() []byte {
+	masked := jobConfig.Masked()
+	s, _ := yaml.Marshal(&masked)
+	return s
+}
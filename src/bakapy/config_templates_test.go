@@ -0,0 +1,122 @@
+package bakapy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig_DefaultsAndTemplates(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+defaults:
+  port: 2222
+  max_age_days: 7
+  args: {compress: gzip, level: "1"}
+templates:
+  base:
+    host: db.example
+    args: {level: "5", user: root}
+  mysql:
+    extends: base
+    command: backup-mysql.sh
+jobs:
+    mysql:
+      extends: mysql
+      namespace: mysql
+      args: {user: backup}
+    plain:
+      namespace: plain
+      max_age_days: 0
+      max_age: 1h
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	config, err := ParseConfig(cfg.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := config.Jobs["mysql"]
+	if job.Host != "db.example" || job.Port != 2222 || job.Command != "backup-mysql.sh" {
+		t.Fatal("unexpected effective config", job.Host, job.Port, job.Command)
+	}
+	if job.Extends != "mysql" {
+		t.Fatal("job.Extends must be mysql not", job.Extends)
+	}
+	if job.MaxAge != 7*24*time.Hour {
+		t.Fatal("job.MaxAge must be 168h not", job.MaxAge)
+	}
+	expectedArgs := map[string]string{"compress": "gzip", "level": "5", "user": "backup"}
+	for argName, argValue := range expectedArgs {
+		if job.Args[argName] != argValue {
+			t.Fatal("argument", argName, "must be", argValue, "not", job.Args[argName])
+		}
+	}
+	plain := config.Jobs["plain"]
+	if plain.MaxAge != time.Hour || plain.Host != "" {
+		t.Fatal("unexpected plain job config", plain.MaxAge, plain.Host)
+	}
+	if !strings.Contains(string(job.EffectiveFmt()), "host: db.example") {
+		t.Fatal("effective config must contain host:", string(job.EffectiveFmt()))
+	}
+}
+
+func TestParseConfig_TemplateErrors(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	cases := map[string]string{
+		"job www: unknown template nope": `
+jobs:
+    www: {extends: nope}
+`,
+		"job www: templates extends cycle: a -> b -> a": `
+templates:
+  a: {extends: b}
+  b: {extends: a}
+jobs:
+    www: {extends: a}
+`,
+		"job www: template a at " + cfg.Name() + ": invalid strict_host_key_checking 'maybe', must be one of yes, no, ask, accept-new, off": `
+templates:
+  a: {strict_host_key_checking: maybe}
+jobs:
+    www: {extends: a}
+`,
+		"job www: defaults at " + cfg.Name() + ": invalid argument name 'bad-name'": `
+defaults:
+  args: {bad-name: x}
+jobs:
+    www: {}
+`,
+	}
+	for expectedErr, content := range cases {
+		ioutil.WriteFile(cfg.Name(), []byte(content), 0644)
+		_, err := ParseConfig(cfg.Name())
+		if err == nil || err.Error() != expectedErr {
+			t.Fatal("error must be", expectedErr, "not", err)
+		}
+	}
+}
+
+func TestParseConfig_TemplateTypeErrorInIncludedFile(t *testing.T) {
+	jobsFile, _ := ioutil.TempFile("", "test_jobs")
+	jobsFile.Write([]byte("www: {port: abc}\n"))
+	jobsFile.Close()
+	defer os.Remove(jobsFile.Name())
+
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte("include_jobs: [" + path.Base(jobsFile.Name()) + "]\n"))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	_, err := ParseConfig(cfg.Name())
+	if err == nil || !strings.HasPrefix(err.Error(), "job www: "+jobsFile.Name()+": ") {
+		t.Fatal("error must point to jobs file, not", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -238,3 +239,259 @@ func TestRunAtSpec_SchedulerString_WithSecond(t *testing.T) {
 		t.Fatal("Must be '4 3 44 * * *' not ", s)
 	}
 }
+
+func TestParseConfig_RunAtStrings(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+jobs:
+    line:
+      run_at: "30 2 * * *"
+    descriptor:
+      run_at: "@daily"
+    list:
+      run_at: ["0 0 3 * * *", "15 4 * * 1"]
+    fields:
+      run_at: {minute: "3", hour: "4", day: "*", month: "*", weekday: "*"}
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	config, err := ParseConfig(cfg.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"line":       {"0 30 2 * * *"},
+		"descriptor": {"@daily"},
+		"list":       {"0 0 3 * * *", "0 15 4 * * 1"},
+		"fields":     {"0 3 4 * * *"},
+	}
+	for jobName, specs := range expected {
+		schedules := config.Jobs[jobName].RunAt.Schedules()
+		if strings.Join(schedules, "|") != strings.Join(specs, "|") {
+			t.Fatal(jobName, "schedules must be", specs, "not", schedules)
+		}
+	}
+}
+
+func TestParseConfig_RunAtBadSpec(t *testing.T) {
+	cases := map[string]string{
+		"job www: run_at: expected 5 or 6 fields, found 3: '* * *'":                 `"* * *"`,
+		"job www: run_at: '0 0 25 * * *': End of range (25) above maximum (23): 25": `["0 25 * * *"]`,
+		"job www: run_at: '@sometimes': Unrecognized descriptor: @sometimes":        `"@sometimes"`,
+	}
+	for expectedErr, runAt := range cases {
+		cfg, _ := ioutil.TempFile("", "test_config")
+		cfg.Write([]byte("jobs:\n  www:\n    run_at: " + runAt + "\n"))
+		cfg.Close()
+		_, err := ParseConfig(cfg.Name())
+		os.Remove(cfg.Name())
+		if err == nil || err.Error() != expectedErr {
+			t.Fatal("error must be", expectedErr, "not", err)
+		}
+	}
+}
+
+func TestParseConfig_Timezone(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+timezone: Europe/Moscow
+jobs:
+    moscow: {}
+    tokyo:
+      timezone: Asia/Tokyo
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	config, err := ParseConfig(cfg.Name())
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	if config.Jobs["moscow"].Location().String() != "Europe/Moscow" {
+		t.Fatal("moscow job location must be Europe/Moscow not", config.Jobs["moscow"].Location())
+	}
+	if config.Jobs["tokyo"].Location().String() != "Asia/Tokyo" {
+		t.Fatal("tokyo job location must be Asia/Tokyo not", config.Jobs["tokyo"].Location())
+	}
+}
+
+func TestJobConfig_Sanitize_BadTimezone(t *testing.T) {
+	cfg := &JobConfig{Timezone: "Mars/Olympus"}
+	err := cfg.Sanitize()
+	expectedErr := "invalid timezone 'Mars/Olympus': unknown time zone Mars/Olympus"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal("error must be", expectedErr, "not", err)
+	}
+}
+
+func TestSSHOptions_Sanitize_BadStrictMode(t *testing.T) {
+	opts := &SSHOptions{StrictHostKeyChecking: "maybe"}
+	err := opts.Sanitize()
+	expectedErr := "invalid strict_host_key_checking 'maybe', must be one of yes, no, ask, accept-new, off"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+}
+
+func TestSSHOptions_Sanitize_BadOption(t *testing.T) {
+	opts := &SSHOptions{Options: []string{"Compression"}}
+	err := opts.Sanitize()
+	expectedErr := "invalid ssh option 'Compression', must be in form Key=Value"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+}
+
+func TestSSHOptions_Check_IdentityFileDoesNotExist(t *testing.T) {
+	opts := &SSHOptions{IdentityFile: "/DOES_NOT_EXIST/id_rsa"}
+	err := opts.Check()
+	expectedErr := "identity file: stat /DOES_NOT_EXIST/id_rsa: no such file or directory"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+}
+
+func TestParseConfig_SSHOptions(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+jobs:
+    wow:
+      host: db1.example
+      user: backup
+      identity_file: /etc/bakapy/id_rsa
+      jump_hosts: [gw.example]
+      connect_timeout: 10s
+      strict_host_key_checking: "yes"
+      ssh_options: [Compression=yes]
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	config, err := ParseConfig(cfg.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := config.Jobs["wow"].SSHOptions
+	if opts.User != "backup" {
+		t.Fatal("opts.User must be 'backup' not", opts.User)
+	}
+	if opts.IdentityFile != "/etc/bakapy/id_rsa" {
+		t.Fatal("opts.IdentityFile must be '/etc/bakapy/id_rsa' not", opts.IdentityFile)
+	}
+	if len(opts.JumpHosts) != 1 || opts.JumpHosts[0] != "gw.example" {
+		t.Fatal("wrong opts.JumpHosts", opts.JumpHosts)
+	}
+	if opts.ConnectTimeout != time.Second*10 {
+		t.Fatal("opts.ConnectTimeout must be 10s not", opts.ConnectTimeout)
+	}
+	if opts.StrictHostKeyChecking != "yes" {
+		t.Fatal("opts.StrictHostKeyChecking must be 'yes' not", opts.StrictHostKeyChecking)
+	}
+	if len(opts.Options) != 1 || opts.Options[0] != "Compression=yes" {
+		t.Fatal("wrong opts.Options", opts.Options)
+	}
+}
+
+func TestJobConfig_Masked(t *testing.T) {
+	jConfig := &JobConfig{
+		Args:       map[string]string{"mysql_pwd": "secret", "db": "main"},
+		SecretArgs: []string{"mysql_pwd"},
+	}
+	masked := jConfig.Masked()
+	if masked.Args["mysql_pwd"] != SECRET_MASK {
+		t.Fatal("secret arg must be masked, got", masked.Args["mysql_pwd"])
+	}
+	if masked.Args["db"] != "main" {
+		t.Fatal("db arg must be 'main' not", masked.Args["db"])
+	}
+	if jConfig.Args["mysql_pwd"] != "secret" {
+		t.Fatal("original config modified:", jConfig.Args["mysql_pwd"])
+	}
+}
+
+func TestJobConfig_Masked_MixedCase(t *testing.T) {
+	jConfig := &JobConfig{
+		Args:       map[string]string{"password": "secret"},
+		SecretArgs: []string{"Password"},
+	}
+	if err := jConfig.Sanitize(); err != nil {
+		t.Fatal("secret arg must be found ignoring case, got", err)
+	}
+	if masked := jConfig.Masked(); masked.Args["password"] != SECRET_MASK {
+		t.Fatal("secret arg must be masked ignoring case, got", masked.Args["password"])
+	}
+	executor := NewBashExecutor(jConfig.Args, "", 0, false)
+	executor.SecretArgs = jConfig.SecretArgs
+	script, _ := executor.GetArgsScript(true)
+	if strings.Contains(string(script), "secret") {
+		t.Fatal("secret arg must be masked in script, got", string(script))
+	}
+}
+
+func TestJobConfig_Copy(t *testing.T) {
+	jConfig := &JobConfig{
+		Args:      map[string]string{"db": "main"},
+		Steps:     []JobStep{{Name: "dump", Args: map[string]string{"table": "users"}}},
+		Blackouts: []BlackoutWindow{{Name: "release"}},
+		PreHooks:  []string{"true"},
+		PostHooks: []string{"true"},
+	}
+	dup := jConfig.Copy()
+	dup.Args["db"] = "other"
+	dup.Steps[0].Name = "other"
+	dup.Steps[0].Args["table"] = "other"
+	dup.Blackouts[0].Name = "other"
+	dup.PreHooks[0] = "false"
+	dup.PostHooks[0] = "false"
+
+	if jConfig.Args["db"] != "main" {
+		t.Fatal("original args modified:", jConfig.Args)
+	}
+	if jConfig.Steps[0].Name != "dump" || jConfig.Steps[0].Args["table"] != "users" {
+		t.Fatal("original steps modified:", jConfig.Steps)
+	}
+	if jConfig.Blackouts[0].Name != "release" {
+		t.Fatal("original blackouts modified:", jConfig.Blackouts)
+	}
+	if jConfig.PreHooks[0] != "true" || jConfig.PostHooks[0] != "true" {
+		t.Fatal("original hooks modified:", jConfig.PreHooks, jConfig.PostHooks)
+	}
+}
+
+func TestJobConfig_Sanitize_SecretArgNotDefined(t *testing.T) {
+	jConfig := &JobConfig{
+		Args:       map[string]string{"db": "main"},
+		SecretArgs: []string{"mysql_pwd"},
+	}
+	err := jConfig.Sanitize()
+	expectedErr := "secret argument 'mysql_pwd' not defined in args"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+}
+
+func TestJobConfig_Sanitize_BadArgName(t *testing.T) {
+	jConfig := &JobConfig{
+		Args: map[string]string{"mysql-pwd": "secret"},
+	}
+	err := jConfig.Sanitize()
+	expectedErr := "invalid argument name 'mysql-pwd'"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+}
+
+func TestConfig_PrettyFmt_SecretsMasked(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Jobs["wow"] = &JobConfig{
+		Args:       map[string]string{"mysql_pwd": "topsecret"},
+		SecretArgs: []string{"mysql_pwd"},
+	}
+	if strings.Contains(string(cfg.PrettyFmt()), "topsecret") {
+		t.Fatal("secret value found in PrettyFmt output")
+	}
+	if cfg.Jobs["wow"].Args["mysql_pwd"] != "topsecret" {
+		t.Fatal("original config modified")
+	}
+}
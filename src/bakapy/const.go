@@ -2,6 +2,7 @@ package bakapy
 
 import (
 	"text/template"
+	"time"
 )
 
 // Waiting for client authentication
@@ -23,6 +24,36 @@ const (
 
 const JOB_FINISH = "_@!_JOB_FINISH_!@_"
 
+// Default job output log caps and size of output excerpt saved in metadata
+const OUTPUT_LOG_HEAD_SIZE = 1024 * 1024
+const OUTPUT_LOG_TAIL_SIZE = 1024 * 1024
+const OUTPUT_EXCERPT_SIZE = 4096
+
+// Metadata index is compacted when it has more records than this
+// and more than METADATA_INDEX_COMPACT_RATIO records per live entry
+const METADATA_INDEX_COMPACT_MIN = 1000
+const METADATA_INDEX_COMPACT_RATIO = 4
+
+// Default time limits for secret_command and job hooks
+const SECRET_TIMEOUT = 30 * time.Second
+const HOOK_TIMEOUT = 10 * time.Minute
+
+// Gzipped output logs are flushed on write if this time passed since last flush
+const BLOB_FLUSH_INTERVAL = time.Second
+
+// Min interval between saves of running task metadata on command output,
+// received files are saved right away
+const PROGRESS_SAVE_INTERVAL = 5 * time.Second
+
+// Default time for running jobs to finish on scheduler shutdown
+const SHUTDOWN_GRACE = 5 * time.Minute
+
+// Exit code saved for commands which could not be started
+const RETCODE_NOT_STARTED = -1
+
+// Replaces secret values in logs and saved metadata
+const SECRET_MASK = "********"
+
 var MAIL_TEMPLATE_JOB_FAILED = template.Must(template.New("mail").Parse(`From: {{ .From }}
 To: {{.To}}
 Subject: {{.Subject}}
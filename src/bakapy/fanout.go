@@ -0,0 +1,196 @@
+package bakapy
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"github.com/op/go-logging"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JobChildResult struct {
+	JobName   string
+	Host      string
+	TaskId    TaskId
+	Success   bool
+	Message   string
+	TotalSize int64
+}
+
+// IsFanOut returns true if job runs one task per host
+func (jobConfig *JobConfig) IsFanOut() bool {
+	return len(jobConfig.Hosts) > 0 || jobConfig.Inventory != ""
+}
+
+// FanOutHosts returns hosts list of fan-out job
+func (cfg *Config) FanOutHosts(jobConfig *JobConfig) ([]string, error) {
+	hosts := jobConfig.Hosts
+	if jobConfig.Inventory != "" {
+		if len(jobConfig.Hosts) > 0 {
+			return nil, errors.New("both hosts and inventory defined")
+		}
+		group, exist := cfg.Inventory[jobConfig.Inventory]
+		if !exist {
+			return nil, errors.New(fmt.Sprintf("unknown inventory group %s", jobConfig.Inventory))
+		}
+		hosts = group
+	}
+	if jobConfig.Host != "" {
+		return nil, errors.New("both host and hosts/inventory defined")
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("empty hosts list")
+	}
+	seen := map[string]bool{}
+	for _, host := range hosts {
+		if host == "" || strings.ContainsAny(host, "/ ") {
+			return nil, errors.New(fmt.Sprintf("invalid host '%s'", host))
+		}
+		if seen[host] {
+			return nil, errors.New(fmt.Sprintf("duplicated host %s", host))
+		}
+		seen[host] = true
+	}
+	return hosts, nil
+}
+
+// expandFanOut adds one child job per host for each fan-out job.
+// Children named <job>@<host> and run only by their parent.
+func (cfg *Config) expandFanOut() error {
+	parents := []string{}
+	for jobName, jobConfig := range cfg.Jobs {
+		if jobConfig.IsFanOut() {
+			parents = append(parents, jobName)
+		}
+	}
+	sort.Strings(parents)
+
+	for _, jobName := range parents {
+		jobConfig := cfg.Jobs[jobName]
+		hosts, err := cfg.FanOutHosts(jobConfig)
+		if err != nil {
+			return errors.New("job " + jobName + ": " + err.Error())
+		}
+		if jobConfig.MaxParallel < 0 {
+			return errors.New("job " + jobName + ": max_parallel must not be negative")
+		}
+		jobConfig.children = nil
+		for _, host := range hosts {
+			childName := fmt.Sprintf("%s@%s", jobName, host)
+			if _, exist := cfg.Jobs[childName]; exist {
+				return errors.New(fmt.Sprintf("job %s: child job name %s already used", jobName, childName))
+			}
+			child := jobConfig.Copy()
+			child.Host = host
+			child.Hosts = nil
+			child.Inventory = ""
+			child.MaxParallel = 0
+			child.Namespace = path.Join(jobConfig.Namespace, host)
+			child.RunAt = RunAtSpec{}
+			child.After = nil
+			child.OnSuccess = nil
+			child.OnFailure = nil
+			child.FanOutParent = jobName
+			cfg.Jobs[childName] = &child
+			jobConfig.children = append(jobConfig.children, childName)
+		}
+	}
+	return nil
+}
+
+// RunFanOutJob runs child task for each host of fan-out job and saves
+// parent metadata aggregating children results.
+func RunFanOutJob(jobName string, jConfig *JobConfig, gConfig *Config, storage *Storage, trigger JobTrigger) *JobMetadata {
+	taskId := TaskId(uuid.NewUUID().String())
+	logger := logging.MustGetLogger(fmt.Sprintf("bakapy.job[%s][%s]", jobName, taskId))
+	metadata := &JobMetadata{
+		JobName:     jobName,
+		Namespace:   jConfig.Namespace,
+		TaskId:      taskId,
+		Pid:         os.Getpid(),
+		PidIdentity: processIdentity(os.Getpid()),
+		Command:     jConfig.Command,
+		Config:      jConfig.Masked(),
+		StartTime:   time.Now().In(jConfig.Location()),
+		Timezone:    jConfig.Location().String(),
+	}
+	metadata.ExpireTime = metadata.StartTime.Add(jConfig.MaxAge)
+	metadata.SetTrigger(trigger)
+	metadata.Status = JOB_STATUS_RUNNING
+	SaveJobMetadata(metadata, gConfig)
+	storage.Running.Add(jobName, taskId, jConfig, trigger)
+	defer storage.Running.Done(taskId)
+
+	parallel := jConfig.MaxParallel
+	if parallel == 0 {
+		parallel = len(jConfig.children)
+	}
+	logger.Info("starting %d child tasks, %d in parallel", len(jConfig.children), parallel)
+
+	results := make([]JobChildResult, len(jConfig.children))
+	semaphore := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	for idx, childName := range jConfig.children {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(idx int, childName string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			childConfig := gConfig.Jobs[childName]
+			childMeta := RunJob(childName, childConfig, gConfig, storage, JobTrigger{
+				Reason:       trigger.Reason,
+				ParentJob:    jobName,
+				ParentTaskId: taskId,
+			})
+			results[idx] = JobChildResult{
+				JobName:   childName,
+				Host:      childConfig.Host,
+				TaskId:    childMeta.TaskId,
+				Success:   childMeta.Success,
+				Message:   childMeta.Message,
+				TotalSize: childMeta.TotalSize,
+			}
+		}(idx, childName)
+	}
+	wg.Wait()
+
+	metadata.SetChildResults(results)
+	metadata.Status = JOB_STATUS_FINISHED
+	metadata.EndTime = time.Now().In(jConfig.Location())
+	metadata.DownstreamJobs = gConfig.Downstream(jobName, metadata.Success)
+	if !storage.Running.Finish(taskId, func() { SaveJobMetadata(metadata, gConfig) }) {
+		logger.Warning("task aborted by shutdown")
+		return metadata
+	}
+	if metadata.Success {
+		logger.Info("job '%s' finished", jobName)
+	} else {
+		logger.Critical("job '%s' failed: %s", jobName, metadata.Message)
+	}
+	return metadata
+}
+
+// SetChildResults aggregates children results in parent metadata
+func (metadata *JobMetadata) SetChildResults(results []JobChildResult) {
+	metadata.Children = results
+	metadata.TotalSize = 0
+	failed := []string{}
+	for _, child := range results {
+		metadata.TotalSize += child.TotalSize
+		if !child.Success {
+			failed = append(failed, child.Host)
+		}
+	}
+	metadata.Success = len(failed) == 0
+	if metadata.Success {
+		metadata.Message = "OK"
+		return
+	}
+	metadata.Message = fmt.Sprintf("%d of %d hosts failed: %s",
+		len(failed), len(results), strings.Join(failed, ", "))
+}
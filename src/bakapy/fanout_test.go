@@ -0,0 +1,125 @@
+package bakapy
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig_FanOutInventory(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+inventory:
+  web: [web1.example, web2.example]
+jobs:
+    www:
+      namespace: www
+      inventory: web
+      run_at: {minute: "0", hour: "2", day: "*", month: "*", weekday: "*"}
+      on_success: [report]
+    report:
+      namespace: report
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	config, err := ParseConfig(cfg.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Jobs) != 4 {
+		t.Fatal("config.Jobs length must be 4 not", len(config.Jobs))
+	}
+	child := config.Jobs["www@web2.example"]
+	if child == nil {
+		t.Fatal("child job www@web2.example not found")
+	}
+	if child.Host != "web2.example" {
+		t.Fatal("child.Host must be web2.example not", child.Host)
+	}
+	if child.Namespace != "www/web2.example" {
+		t.Fatal("child.Namespace must be www/web2.example not", child.Namespace)
+	}
+	if child.FanOutParent != "www" {
+		t.Fatal("child.FanOutParent must be www not", child.FanOutParent)
+	}
+	if !child.RunAt.IsEmpty() || len(child.OnSuccess) != 0 {
+		t.Fatal("child must not have schedule and dependencies")
+	}
+	if child.IsFanOut() {
+		t.Fatal("child must not be fan-out job")
+	}
+}
+
+func TestConfig_FanOutHosts_Errors(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Inventory = map[string][]string{"web": {"web1"}}
+	cases := map[string]*JobConfig{
+		"both hosts and inventory defined":      {Hosts: []string{"a"}, Inventory: "web"},
+		"unknown inventory group db":            {Inventory: "db"},
+		"both host and hosts/inventory defined": {Host: "a", Hosts: []string{"b"}},
+		"duplicated host a":                     {Hosts: []string{"a", "a"}},
+		"invalid host ''":                       {Hosts: []string{""}},
+	}
+	for expectedErr, jobConfig := range cases {
+		_, err := cfg.FanOutHosts(jobConfig)
+		if err == nil || err.Error() != expectedErr {
+			t.Fatal(err, "| != |", expectedErr)
+		}
+	}
+}
+
+func TestScheduler_RunJob_FanOut(t *testing.T) {
+	gConfig := newTestSchedulerConfig()
+	defer removeTestSchedulerConfig(gConfig)
+
+	gConfig.Jobs["www"] = &JobConfig{
+		Command:     "wow.cmd",
+		Namespace:   "www",
+		Hosts:       []string{"web1", "web2", "web3"},
+		MaxParallel: 2,
+		executor:    &TestOkExecutor{},
+	}
+	if err := gConfig.expandFanOut(); err != nil {
+		t.Fatal("Error:", err)
+	}
+	gConfig.Jobs["www@web2"].executor = &TestFailExecutor{}
+
+	scheduler := NewScheduler(gConfig, NewStorage(gConfig))
+	metadata := scheduler.RunJob("www", JobTrigger{Reason: RUN_REASON_MANUAL})
+
+	if metadata.Success {
+		t.Fatal("metadata.Success must be false")
+	}
+	if metadata.Message != "1 of 3 hosts failed: web2" {
+		t.Fatal("wrong metadata.Message", metadata.Message)
+	}
+	if len(metadata.Children) != 3 {
+		t.Fatal("must be 3 children, got", len(metadata.Children))
+	}
+
+	files, _ := ioutil.ReadDir(gConfig.MetadataDir)
+	if len(files) != 4 {
+		t.Fatal("must be 4 metadata files, got", len(files))
+	}
+	namespaces := []string{}
+	for _, f := range files {
+		m, err := LoadJobMetadata(gConfig.MetadataDir + "/" + f.Name())
+		if err != nil {
+			t.Fatal("cannot load metadata:", err)
+		}
+		if m.TaskId == metadata.TaskId {
+			continue
+		}
+		if m.ParentJob != "www" || m.ParentTaskId != metadata.TaskId {
+			t.Fatal("wrong child parent", m.ParentJob, m.ParentTaskId)
+		}
+		namespaces = append(namespaces, m.Namespace)
+	}
+	sort.Strings(namespaces)
+	if strings.Join(namespaces, ",") != "www/web1,www/web2,www/web3" {
+		t.Fatal("wrong child namespaces", namespaces)
+	}
+}
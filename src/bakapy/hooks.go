@@ -0,0 +1,111 @@
+package bakapy
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	HOOK_STAGE_PRE  = "pre"
+	HOOK_STAGE_POST = "post"
+)
+
+type HookMetadata struct {
+	Stage     string
+	Command   string
+	Success   bool
+	RetCode   int
+	Message   string
+	Output    Excerpt
+	Errput    Excerpt
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+// HookEnv returns environment variables describing task state for hooks
+func HookEnv(stage string, storageDir string, metadata *JobMetadata) []string {
+	status := "running"
+	if stage == HOOK_STAGE_POST {
+		if metadata.Success {
+			status = "success"
+		} else {
+			status = "failed"
+		}
+	}
+	files := make([]string, 0, len(metadata.Files))
+	for _, fileMeta := range metadata.Files {
+		files = append(files, fileMeta.Name)
+	}
+	return []string{
+		"BAKAPY_HOOK_STAGE=" + stage,
+		"BAKAPY_TASK_ID=" + string(metadata.TaskId),
+		"BAKAPY_JOB_NAME=" + metadata.JobName,
+		"BAKAPY_NAMESPACE=" + metadata.Namespace,
+		"BAKAPY_STORAGE_DIR=" + storageDir,
+		"BAKAPY_STATUS=" + status,
+		"BAKAPY_MESSAGE=" + metadata.Message,
+		"BAKAPY_FILES=" + strings.Join(files, "\n"),
+	}
+}
+
+// RunHook executes command locally with bash and captures its result.
+// Hook with all its children is killed after timeout.
+func RunHook(stage string, command string, env []string, timeout time.Duration) HookMetadata {
+	hook := HookMetadata{
+		Stage:     stage,
+		Command:   command,
+		StartTime: time.Now(),
+	}
+	output := NewTailBuffer(OUTPUT_EXCERPT_SIZE)
+	errput := NewTailBuffer(OUTPUT_EXCERPT_SIZE)
+
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = output
+	cmd.Stderr = errput
+	timedOut, err := runWithTimeout(cmd, timeout)
+
+	hook.EndTime = time.Now()
+	hook.Output = output.Bytes()
+	hook.Errput = errput.Bytes()
+	hook.RetCode = RETCODE_NOT_STARTED
+	if cmd.ProcessState != nil {
+		hook.RetCode = exitStatus(cmd.ProcessState)
+	}
+	if timedOut {
+		hook.Message = fmt.Sprintf("timed out after %s", timeout)
+		return hook
+	}
+	if err != nil {
+		hook.Message = err.Error()
+		return hook
+	}
+	hook.Success = true
+	hook.Message = "OK"
+	return hook
+}
+
+// runHooks runs hooks one by one until first failure. Returns false
+// if any hook failed.
+func (job *Job) runHooks(stage string, commands []string, metadata *JobMetadata) bool {
+	for _, command := range commands {
+		job.logger.Info("running %s hook '%s'", stage, command)
+		hook := RunHook(stage, command, HookEnv(stage, job.StorageDir, metadata), job.cfg.GetHookTimeout())
+		hook.StartTime = hook.StartTime.In(job.cfg.Location())
+		hook.EndTime = hook.EndTime.In(job.cfg.Location())
+		metadata.Hooks = append(metadata.Hooks, hook)
+		if hook.Success {
+			continue
+		}
+		job.logger.Warning("%s hook '%s' failed: %s", stage, command, hook.Message)
+		if stage == HOOK_STAGE_PRE {
+			metadata.Success = false
+			metadata.Message = fmt.Sprintf("pre hook '%s' failed: %s", command, hook.Message)
+		}
+		return false
+	}
+	return true
+}
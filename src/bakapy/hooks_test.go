@@ -0,0 +1,110 @@
+package bakapy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHook_Ok(t *testing.T) {
+	hook := RunHook(HOOK_STAGE_PRE, `echo -n "$BAKAPY_JOB_NAME"; echo -n oops >&2`, []string{"BAKAPY_JOB_NAME=wow"}, HOOK_TIMEOUT)
+	if !hook.Success {
+		t.Fatal("hook.Success must be true. Message", hook.Message)
+	}
+	if string(hook.Output) != "wow" {
+		t.Fatalf("hook.Output must be 'wow' not '%s'", hook.Output)
+	}
+	if string(hook.Errput) != "oops" {
+		t.Fatalf("hook.Errput must be 'oops' not '%s'", hook.Errput)
+	}
+}
+
+func TestRunHook_Failed(t *testing.T) {
+	hook := RunHook(HOOK_STAGE_POST, "exit 4", nil, HOOK_TIMEOUT)
+	if hook.Success {
+		t.Fatal("hook.Success must be false")
+	}
+	if hook.RetCode != 4 {
+		t.Fatal("hook.RetCode must be 4 not", hook.RetCode)
+	}
+	if hook.Message != "exit status 4" {
+		t.Fatal("hook.Message must be 'exit status 4' not", hook.Message)
+	}
+}
+
+func TestRunHook_Timeout(t *testing.T) {
+	started := time.Now()
+	hook := RunHook(HOOK_STAGE_PRE, "sleep 10; echo done", nil, 100*time.Millisecond)
+	if time.Since(started) > 5*time.Second {
+		t.Fatal("hook must be killed on timeout")
+	}
+	if hook.Success {
+		t.Fatal("hook.Success must be false")
+	}
+	if hook.Message != "timed out after 100ms" {
+		t.Fatal("hook.Message must be 'timed out after 100ms' not", hook.Message)
+	}
+}
+
+func TestHookEnv_Post(t *testing.T) {
+	metadata := &JobMetadata{
+		TaskId:    TaskId("task1"),
+		JobName:   "wow",
+		Namespace: "one",
+		Success:   true,
+		Files:     []JobMetadataFile{{Name: "a.tar"}, {Name: "b.tar"}},
+	}
+	env := strings.Join(HookEnv(HOOK_STAGE_POST, "/storage", metadata), "|")
+	expected := "BAKAPY_HOOK_STAGE=post|BAKAPY_TASK_ID=task1|BAKAPY_JOB_NAME=wow|BAKAPY_NAMESPACE=one|" +
+		"BAKAPY_STORAGE_DIR=/storage|BAKAPY_STATUS=success|BAKAPY_MESSAGE=|BAKAPY_FILES=a.tar\nb.tar"
+	if env != expected {
+		t.Fatal("wrong env:", env)
+	}
+}
+
+func TestJob_Run_PreHookFailedAbortsJob(t *testing.T) {
+	executor := &TestCountExecutor{}
+	cfg := &JobConfig{
+		Command:   "utils.go",
+		PreHooks:  []string{"exit 1", "echo must not run"},
+		PostHooks: []string{`test "$BAKAPY_STATUS" = failed`},
+	}
+	job := NewJob("test", cfg, "127.0.0.1:9999", ".", &TestJober{}, executor)
+	m := job.Run()
+
+	if m.Success {
+		t.Fatal("m.Success must be false")
+	}
+	if executor.calls != 0 {
+		t.Fatal("command must not be executed")
+	}
+	if m.Message != "pre hook 'exit 1' failed: exit status 1" {
+		t.Fatal("wrong m.Message", m.Message)
+	}
+	if len(m.Hooks) != 2 {
+		t.Fatal("must be 2 hooks in metadata, got", len(m.Hooks))
+	}
+	if m.Hooks[1].Stage != HOOK_STAGE_POST || !m.Hooks[1].Success {
+		t.Fatal("post hook must be run successfully, got", m.Hooks[1])
+	}
+}
+
+func TestJob_Run_PostHookGetsFiles(t *testing.T) {
+	cfg := &JobConfig{
+		Command:   "utils.go",
+		Namespace: "wow",
+		PostHooks: []string{`echo -n "$BAKAPY_STATUS $BAKAPY_FILES"`},
+	}
+	job := NewJob("test", cfg, "127.0.0.1:9999", ".", &TestJoberPushFile{}, &TestOkExecutor{})
+	m := job.Run()
+
+	if !m.Success {
+		t.Fatal("m.Success must be true. Message", m.Message)
+	}
+	if len(m.Hooks) != 1 {
+		t.Fatal("must be 1 hook in metadata, got", len(m.Hooks))
+	}
+	if string(m.Hooks[0].Output) != "success wow/wow.txt\nwow/hello.txt" {
+		t.Fatalf("wrong post hook output '%s'", m.Hooks[0].Output)
+	}
+}
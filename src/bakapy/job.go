@@ -5,9 +5,12 @@ import (
 	"code.google.com/p/go-uuid/uuid"
 	"fmt"
 	"github.com/op/go-logging"
+	"io"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,10 +34,16 @@ type Job struct {
 	TaskId      TaskId
 	StorageAddr string
 	CommandDir  string
+	StorageDir  string
+	LogDir      string
+	OutputLog   OutputLogConfig
 	storage     Jober
-	executor    Executer
-	cfg         *JobConfig
-	logger      *logging.Logger
+	// Called with metadata snapshot when task starts, on each received
+	// file and on command output at most once per PROGRESS_SAVE_INTERVAL
+	OnProgress func(metadata *JobMetadata)
+	executor   Executer
+	cfg        *JobConfig
+	logger     *logging.Logger
 }
 
 func NewJob(name string, cfg *JobConfig, StorageAddr string, commandDir string, jober Jober, executor Executer) *Job {
@@ -52,7 +61,12 @@ func NewJob(name string, cfg *JobConfig, StorageAddr string, commandDir string,
 	}
 }
 
-func (job *Job) getScript() ([]byte, error) {
+// now returns current time in job time zone
+func (job *Job) now() time.Time {
+	return time.Now().In(job.cfg.Location())
+}
+
+func (job *Job) getScript(command string) ([]byte, error) {
 	script := new(bytes.Buffer)
 	err := JOB_TEMPLATE.Execute(script, &JobTemplateContext{
 		Job:              job,
@@ -62,7 +76,7 @@ func (job *Job) getScript() ([]byte, error) {
 		return nil, err
 	}
 
-	scriptPath := path.Join(job.CommandDir, job.cfg.Command)
+	scriptPath := path.Join(job.CommandDir, command)
 	job.logger.Debug("reading command file %s", scriptPath)
 	fd, err := os.Open(scriptPath)
 	if err != nil {
@@ -77,73 +91,252 @@ func (job *Job) getScript() ([]byte, error) {
 	return script.Bytes(), nil
 }
 
+func (job *Job) openOutputLog(stream string, logPath *string) *CappedLogWriter {
+	if job.LogDir == "" {
+		return nil
+	}
+	writer, path, err := CreateOutputLog(job.LogDir, job.TaskId, stream, job.OutputLog)
+	if err != nil {
+		job.logger.Warning("cannot create %s log, only excerpt will be saved: %s", stream, err)
+		return nil
+	}
+	*logPath = path
+	return writer
+}
+
+// saveScript writes gzipped script near output logs, script is kept
+// in metadata if it cannot be written
+func (job *Job) saveScript(logPrefix string, script []byte, blobPath *string) {
+	if job.LogDir == "" {
+		return
+	}
+	scriptPath := path.Join(job.LogDir, fmt.Sprintf("%s.%sscript.gz", job.TaskId, logPrefix))
+	err := os.MkdirAll(job.LogDir, 0750)
+	if err == nil {
+		err = writeBlob(scriptPath, script)
+	}
+	if err != nil {
+		job.logger.Warning("cannot save script, it will be kept in metadata: %s", err)
+		return
+	}
+	*blobPath = scriptPath
+}
+
+func (job *Job) closeOutputLog(writer *CappedLogWriter) {
+	if writer == nil {
+		return
+	}
+	if err := writer.Close(); err != nil {
+		job.logger.Warning("cannot write output log: %s", err)
+	}
+}
+
+func teeOutputLog(excerpt *TailBuffer, log *CappedLogWriter) io.Writer {
+	if log == nil {
+		return excerpt
+	}
+	return io.MultiWriter(excerpt, log)
+}
+
+// progressWriter counts bytes written and reports progress after each write
+type progressWriter struct {
+	writer   io.Writer
+	written  *int64
+	progress func()
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	atomic.AddInt64(w.written, int64(n))
+	w.progress()
+	return n, err
+}
+
 func (job *Job) Run() *JobMetadata {
 	metadata := &JobMetadata{
-		JobName:   job.Name,
-		Gzip:      job.cfg.Gzip,
-		Namespace: job.cfg.Namespace,
-		Pid:       os.Getpid(),
-		Command:   job.cfg.Command,
-		Config:    *job.cfg,
-		StartTime: time.Now(),
-		TaskId:    job.TaskId,
-		Success:   false,
+		JobName:     job.Name,
+		Gzip:        job.cfg.Gzip,
+		Namespace:   job.cfg.Namespace,
+		Pid:         os.Getpid(),
+		PidIdentity: processIdentity(os.Getpid()),
+		Command:     job.cfg.Command,
+		Config:      job.cfg.Masked(),
+		StartTime:   job.now(),
+		Timezone:    job.cfg.Location().String(),
+		TaskId:      job.TaskId,
+		Success:     false,
+		Status:      JOB_STATUS_RUNNING,
 	}
 	metadata.ExpireTime = metadata.StartTime.Add(job.cfg.MaxAge)
 	job.logger.Info("starting up")
+	job.progress(metadata)
+
+	if job.runHooks(HOOK_STAGE_PRE, job.cfg.PreHooks, metadata) {
+		job.execute(metadata)
+	}
+	job.runHooks(HOOK_STAGE_POST, job.cfg.PostHooks, metadata)
+	metadata.Status = JOB_STATUS_FINISHED
+	return metadata
+}
+
+func (job *Job) progress(metadata *JobMetadata) {
+	if job.OnProgress != nil {
+		job.OnProgress(metadata)
+	}
+}
+
+// progressSnapshot returns copy of metadata including files of running step
+func progressSnapshot(metadata *JobMetadata, stepMeta *JobStepMetadata) *JobMetadata {
+	snapshot := *metadata
+	snapshot.Files = append(append([]JobMetadataFile{}, metadata.Files...), stepMeta.Files...)
+	snapshot.TotalSize = metadata.TotalSize + stepMeta.TotalSize
+	return &snapshot
+}
+
+func (job *Job) execute(metadata *JobMetadata) {
+	if len(job.cfg.Steps) == 0 {
+		stepMeta := &JobStepMetadata{Command: job.cfg.Command}
+		result := job.runStep(JobStep{Command: job.cfg.Command}, "", stepMeta, metadata)
+		if result != nil {
+			metadata.SetExecutionResult(result)
+		} else {
+			metadata.RetCode = stepMeta.RetCode
+		}
+		metadata.SetStepResult(stepMeta)
+		metadata.Success = stepMeta.Success
+		metadata.Message = stepMeta.Message
+		metadata.EndTime = stepMeta.EndTime
+		return
+	}
+
+	failedSteps := []string{}
+	for idx, step := range job.cfg.Steps {
+		stepMeta := &JobStepMetadata{Name: step.Name, Command: step.Command}
+		job.logger.Info("running step %s", step.Name)
+		result := job.runStep(step, fmt.Sprintf("step%d.", idx+1), stepMeta, metadata)
+		metadata.Steps = append(metadata.Steps, *stepMeta)
+		metadata.AddStepResult(stepMeta, result)
+		if stepMeta.Success {
+			continue
+		}
+		failedSteps = append(failedSteps, step.Name)
+		if !step.ContinueOnError {
+			metadata.Success = false
+			metadata.Message = fmt.Sprintf("step %s failed: %s", step.Name, stepMeta.Message)
+			metadata.EndTime = job.now()
+			return
+		}
+		job.logger.Warning("step %s failed, continuing", step.Name)
+	}
+	metadata.Success = true
+	metadata.Message = "OK"
+	if len(failedSteps) > 0 {
+		metadata.Message = fmt.Sprintf("OK, ignored failed steps: %s", strings.Join(failedSteps, ", "))
+	}
+	metadata.EndTime = job.now()
+}
 
-	script, err := job.getScript()
+// runStep executes single command within the task and waits all its
+// files. Log file names prefixed with logPrefix.
+func (job *Job) runStep(step JobStep, logPrefix string, stepMeta *JobStepMetadata, metadata *JobMetadata) *ExecutionResult {
+	stepMeta.StartTime = job.now()
+	stepMeta.RetCode = RETCODE_NOT_STARTED
+	script, err := job.getScript(step.Command)
 	if err != nil {
 		job.logger.Warning("cannot get job script: %s", err.Error())
-		metadata.Message = err.Error()
-		return metadata
+		stepMeta.Message = err.Error()
+		stepMeta.EndTime = job.now()
+		return nil
+	}
+	stepMeta.Script = script
+	job.saveScript(logPrefix, script, &stepMeta.ScriptBlob)
+
+	executor := job.executor
+	if argsExecutor, ok := executor.(ArgsExecuter); ok && len(step.Args) > 0 {
+		executor = argsExecutor.WithArgs(step.Args)
 	}
-	metadata.Script = script
 
 	fileAddChan := make(chan JobMetadataFile, 20)
+	filesDone := make(chan struct{})
 
 	job.storage.AddJob(&StorageCurrentJob{
 		Gzip:        job.cfg.Gzip,
 		TaskId:      job.TaskId,
+		JobName:     job.Name,
+		StartTime:   stepMeta.StartTime,
 		Namespace:   job.cfg.Namespace,
 		FileAddChan: fileAddChan,
 	})
 
+	// guards step files read by progress snapshots of output writers
+	progressLock := sync.Mutex{}
+	outputProgress := &throttle{interval: PROGRESS_SAVE_INTERVAL}
+	var outputSize, errputSize int64
+
 	go func() {
 		for fileMeta := range fileAddChan {
 			job.logger.Debug("adding new file metadata: %s", fileMeta.String())
-			metadata.Files = append(metadata.Files, fileMeta)
-			metadata.TotalSize += fileMeta.Size
+			progressLock.Lock()
+			stepMeta.Files = append(stepMeta.Files, fileMeta)
+			stepMeta.TotalSize += fileMeta.Size
+			job.progress(progressSnapshot(metadata, stepMeta))
+			progressLock.Unlock()
 		}
 		job.logger.Debug("filemeta updater stopped")
+		close(filesDone)
 	}()
 
-	output := new(bytes.Buffer)
-	errput := new(bytes.Buffer)
-	err = job.executor.Execute(script, output, errput)
+	onOutput := func() {
+		progressLock.Lock()
+		defer progressLock.Unlock()
+		if !outputProgress.Allow(time.Now()) {
+			return
+		}
+		snapshot := progressSnapshot(metadata, stepMeta)
+		snapshot.OutputSize += atomic.LoadInt64(&outputSize)
+		snapshot.ErrputSize += atomic.LoadInt64(&errputSize)
+		job.progress(snapshot)
+	}
+
+	output := NewTailBuffer(OUTPUT_EXCERPT_SIZE)
+	errput := NewTailBuffer(OUTPUT_EXCERPT_SIZE)
+	outputLog := job.openOutputLog(logPrefix+"output", &stepMeta.OutputLog)
+	errputLog := job.openOutputLog(logPrefix+"errput", &stepMeta.ErrputLog)
+
+	result, err := executor.Execute(script,
+		&progressWriter{teeOutputLog(output, outputLog), &outputSize, onOutput},
+		&progressWriter{teeOutputLog(errput, errputLog), &errputSize, onOutput})
+	if result != nil {
+		stepMeta.RetCode = result.ExitCode
+		stepMeta.Signal = result.Signal
+	}
 
 	job.storage.RemoveJob(job.TaskId)
 
+	job.closeOutputLog(outputLog)
+	job.closeOutputLog(errputLog)
+
 	job.logger.Debug("Command output: %s", output.String())
 	job.logger.Debug("Command errput: %s", errput.String())
 
-	metadata.Output = output.Bytes()
-	metadata.Errput = errput.Bytes()
+	stepMeta.Output = output.Bytes()
+	stepMeta.Errput = errput.Bytes()
+	stepMeta.OutputSize = output.Written()
+	stepMeta.ErrputSize = errput.Written()
+	stepMeta.EndTime = job.now()
 
 	if err != nil {
 		job.logger.Warning("command failed: %s", err)
-		metadata.Success = false
-		metadata.Message = err.Error()
-		metadata.EndTime = time.Now()
-		return metadata
+		stepMeta.Success = false
+		stepMeta.Message = err.Error()
+	} else {
+		stepMeta.Success = true
+		stepMeta.Message = "OK"
 	}
 
-	metadata.Success = true
-	metadata.Message = "OK"
-	metadata.EndTime = time.Now()
-
 	job.logger.Debug("waiting storage")
 	job.storage.WaitJob(job.TaskId)
 	close(fileAddChan)
-	return metadata
+	<-filesDone
+	return result
 }
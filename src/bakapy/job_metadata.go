@@ -1,10 +1,8 @@
 package bakapy
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io"
+	"github.com/op/go-logging"
 	"io/ioutil"
 	"os"
 	"path"
@@ -24,6 +22,34 @@ func (m *JobMetadataFile) String() string {
 		m.Name, m.Size, m.StartTime, m.EndTime)
 }
 
+type JobStepMetadata struct {
+	Name       string
+	Command    string
+	Success    bool
+	Message    string
+	RetCode    int
+	Signal     string
+	StartTime  time.Time
+	EndTime    time.Time
+	Files      []JobMetadataFile
+	TotalSize  int64
+	Script     []byte `json:",omitempty"` // inline only if ScriptBlob is not saved
+	ScriptBlob string
+	Output     Excerpt
+	Errput     Excerpt
+	OutputSize int64
+	ErrputSize int64
+	OutputLog  string
+	ErrputLog  string
+}
+
+func (step *JobStepMetadata) Duration() time.Duration {
+	if step.StartTime.IsZero() || step.EndTime.IsZero() || step.StartTime.After(step.EndTime) {
+		return time.Duration(0)
+	}
+	return step.EndTime.Sub(step.StartTime)
+}
+
 type MetadataSortByStartTime []JobMetadata
 
 func (slice MetadataSortByStartTime) Len() int {
@@ -38,27 +64,64 @@ func (slice MetadataSortByStartTime) Less(i, j int) bool {
 	return slice[i].StartTime.Unix() < slice[j].StartTime.Unix()
 }
 
+// Task status saved in metadata, empty in metadata of older versions
+// means finished.
+const (
+	JOB_STATUS_RUNNING     = "running"
+	JOB_STATUS_FINISHED    = "finished"
+	JOB_STATUS_SKIPPED     = "skipped"
+	JOB_STATUS_ABORTED     = "aborted"
+	JOB_STATUS_INTERRUPTED = "interrupted"
+)
+
 type JobMetadata struct {
-	JobName    string
-	Gzip       bool
-	Namespace  string
-	TaskId     TaskId
-	Command    string
-	Success    bool
-	Message    string
-	TotalSize  int64
-	StartTime  time.Time
-	EndTime    time.Time
-	ExpireTime time.Time
-	Files      []JobMetadataFile
-	Pid        int
-	RetCode    uint
-	Script     []byte
-	Output     []byte
-	Errput     []byte
-	Config     JobConfig
-	Corrupted  bool   `json:"-"`
-	Filepath   string `json:"-"`
+	SchemaVersion  int
+	Checksum       string // sha256 of metadata json with empty checksum
+	JobName        string
+	Gzip           bool
+	Namespace      string
+	TaskId         TaskId
+	Command        string
+	Success        bool
+	Status         string
+	Message        string
+	TotalSize      int64
+	StartTime      time.Time
+	EndTime        time.Time
+	ExpireTime     time.Time
+	Timezone       string
+	Files          []JobMetadataFile
+	Pid            int
+	PidIdentity    string // boot id and process start time, see processIdentity
+	RetCode        int
+	Signal         string
+	WallTime       time.Duration
+	UserTime       time.Duration
+	SystemTime     time.Duration
+	MaxRSS         int64   // kilobytes
+	Script         []byte  `json:",omitempty"` // inline only if ScriptBlob is not saved
+	ScriptBlob     string  // gzipped script, see LoadScript
+	Output         Excerpt // full output is in OutputLog
+	Errput         Excerpt // full errput is in ErrputLog
+	OutputSize     int64
+	ErrputSize     int64
+	OutputLog      string
+	ErrputLog      string
+	Steps          []JobStepMetadata
+	Hooks          []HookMetadata
+	RunReason      string
+	Skipped        string // reason if job was not started
+	Aborted        bool   // killed by scheduler shutdown
+	UpstreamJob    string
+	UpstreamTaskId TaskId
+	DownstreamJobs []string
+	ParentJob      string
+	ParentTaskId   TaskId
+	Children       []JobChildResult
+	Config         JobConfig
+	Corrupted      bool   `json:"-"`
+	Filepath       string `json:"-"`
+	SourceVersion  int    `json:"-"` // schema version of loaded file
 }
 
 func (metadata *JobMetadata) Duration() time.Duration {
@@ -78,36 +141,128 @@ func (metadata *JobMetadata) AvgSpeed() int64 {
 	return metadata.TotalSize / int64(metadata.Duration().Seconds())
 }
 
+func (metadata *JobMetadata) SetExecutionResult(result *ExecutionResult) {
+	metadata.RetCode = result.ExitCode
+	metadata.Signal = result.Signal
+	metadata.WallTime = result.WallTime
+	metadata.UserTime = result.UserTime
+	metadata.SystemTime = result.SystemTime
+	metadata.MaxRSS = result.MaxRSS
+}
+
+// SetStepResult copies result of single command job to metadata
+func (metadata *JobMetadata) SetStepResult(step *JobStepMetadata) {
+	metadata.Script = step.Script
+	metadata.ScriptBlob = step.ScriptBlob
+	metadata.Files = step.Files
+	metadata.TotalSize = step.TotalSize
+	metadata.Output = step.Output
+	metadata.Errput = step.Errput
+	metadata.OutputSize = step.OutputSize
+	metadata.ErrputSize = step.ErrputSize
+	metadata.OutputLog = step.OutputLog
+	metadata.ErrputLog = step.ErrputLog
+}
+
+// AddStepResult accumulates results of multi-step job in metadata.
+// Files and resource usage summarized, exit status and output
+// excerpts are taken from the last executed step.
+func (metadata *JobMetadata) AddStepResult(step *JobStepMetadata, result *ExecutionResult) {
+	metadata.Files = append(metadata.Files, step.Files...)
+	metadata.TotalSize += step.TotalSize
+	metadata.Output = step.Output
+	metadata.Errput = step.Errput
+	metadata.OutputSize = step.OutputSize
+	metadata.ErrputSize = step.ErrputSize
+	metadata.RetCode = step.RetCode
+	metadata.Signal = step.Signal
+	if result == nil {
+		return
+	}
+	metadata.WallTime += result.WallTime
+	metadata.UserTime += result.UserTime
+	metadata.SystemTime += result.SystemTime
+	if result.MaxRSS > metadata.MaxRSS {
+		metadata.MaxRSS = result.MaxRSS
+	}
+}
+
+// LogFiles returns paths of all output logs and scripts of the task
+func (metadata *JobMetadata) LogFiles() []string {
+	var logs []string
+	for _, logPath := range []string{metadata.OutputLog, metadata.ErrputLog, metadata.ScriptBlob} {
+		if logPath != "" {
+			logs = append(logs, logPath)
+		}
+	}
+	for _, step := range metadata.Steps {
+		for _, logPath := range []string{step.OutputLog, step.ErrputLog, step.ScriptBlob} {
+			if logPath != "" {
+				logs = append(logs, logPath)
+			}
+		}
+	}
+	return logs
+}
+
+func (metadata *JobMetadata) SetTrigger(trigger JobTrigger) {
+	metadata.RunReason = trigger.Reason
+	metadata.UpstreamJob = trigger.UpstreamJob
+	metadata.UpstreamTaskId = trigger.UpstreamTaskId
+	metadata.ParentJob = trigger.ParentJob
+	metadata.ParentTaskId = trigger.ParentTaskId
+}
+
+func (metadata *JobMetadata) CPUTime() time.Duration {
+	return metadata.UserTime + metadata.SystemTime
+}
+
+// Save writes metadata atomically: scripts are moved to gzipped files,
+// journal copy is written, then metadata file is replaced by fsynced temp
+// file and index is updated. Special files (like /dev/null) are written
+// directly. Metadata itself is not changed.
 func (metadata *JobMetadata) Save(saveTo string) error {
-	err := os.MkdirAll(path.Dir(saveTo), 0750)
+	saved := *metadata
+	// steps may be shared with running job by progress snapshot
+	saved.Steps = append([]JobStepMetadata(nil), metadata.Steps...)
+	if err := saved.storeBlobs(saveTo); err != nil {
+		logging.MustGetLogger("bakapy.metadata").Warning("cannot save script of %s, keeping it in metadata: %s", saveTo, err)
+	}
+	data, err := saved.encode()
 	if err != nil {
 		return err
 	}
-	file, err := os.Create(saveTo)
-	if err != nil {
+	journalDir := MetadataJournalDir(path.Dir(saveTo))
+	if err := os.MkdirAll(path.Dir(saveTo), 0750); err != nil {
 		return err
 	}
-	defer file.Close()
-	jsonData, err := json.Marshal(metadata)
-	if err != nil {
+	if err := os.MkdirAll(journalDir, 0750); err != nil {
 		return err
 	}
-	_, err = io.Copy(file, bytes.NewReader(jsonData))
-	if err != nil {
+	if err := writeFileAtomic(metadataJournalPath(saveTo), data); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(saveTo, data); err != nil {
 		return err
 	}
+	indexJobMetadata(saveTo, &saved)
 	return nil
 }
 
+// LoadJobMetadata reads metadata file. Unreadable or corrupted files are
+// repaired from journal if possible.
 func LoadJobMetadata(path string) (*JobMetadata, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	metadata := JobMetadata{}
-	err = json.Unmarshal(data, &metadata)
-	if err != nil {
+	metadata, err := decodeJobMetadata(data)
+	if err == nil {
+		return metadata, nil
+	}
+	repaired, repairErr := repairJobMetadata(path)
+	if repairErr != nil {
 		return nil, err
 	}
-	return &metadata, nil
+	return repaired, nil
 }
@@ -1,6 +1,9 @@
 package bakapy
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 	"time"
 )
@@ -81,8 +84,16 @@ func TestJobMetadataSaveTo_Ok(t *testing.T) {
 	meta := JobMetadata{
 		TotalSize: 102 * 1024 * 1024,
 	}
-	err := meta.Save("/dev/null")
+	dir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(MetadataJournalDir(dir))
+	defer os.Remove(MetadataIndexPath(dir))
+	err := meta.Save(path.Join(dir, "task"))
 	if err != nil {
 		t.Fatal("Cannot save metadata:", err)
 	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != "task" {
+		t.Fatal("metadata dir must contain only saved file, temp files must be renamed")
+	}
 }
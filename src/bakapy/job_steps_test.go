@@ -0,0 +1,157 @@
+package bakapy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type TestScriptExecutor struct {
+	args map[string]string
+}
+
+func (e *TestScriptExecutor) WithArgs(args map[string]string) Executer {
+	return &TestScriptExecutor{args: args}
+}
+
+func (e *TestScriptExecutor) Execute(script []byte, output io.Writer, errput io.Writer) (*ExecutionResult, error) {
+	output.Write([]byte(e.args["name"]))
+	if bytes.Contains(script, []byte("STEP_FAILS")) {
+		return &ExecutionResult{ExitCode: 2}, errors.New("exit status 2")
+	}
+	return &ExecutionResult{}, nil
+}
+
+func newTestStepsCommandDir() string {
+	commandDir, _ := ioutil.TempDir("", "")
+	ioutil.WriteFile(path.Join(commandDir, "ok.sh"), []byte("echo ok"), 0644)
+	ioutil.WriteFile(path.Join(commandDir, "fail.sh"), []byte("STEP_FAILS"), 0644)
+	return commandDir
+}
+
+func TestJob_Run_StepsOk(t *testing.T) {
+	commandDir := newTestStepsCommandDir()
+	defer os.RemoveAll(commandDir)
+
+	cfg := &JobConfig{
+		Namespace: "wow",
+		Steps: []JobStep{
+			{Name: "dump", Command: "ok.sh", Args: map[string]string{"name": "first"}},
+			{Name: "verify", Command: "fail.sh", Args: map[string]string{"name": "second"}, ContinueOnError: true},
+			{Name: "last", Command: "ok.sh", Args: map[string]string{"name": "third"}},
+		},
+	}
+	job := NewJob("test", cfg, "127.0.0.1:9999", commandDir, &TestJober{}, &TestScriptExecutor{})
+	m := job.Run()
+
+	if !m.Success {
+		t.Fatal("m.Success must be true. Message", m.Message)
+	}
+	if m.Message != "OK, ignored failed steps: verify" {
+		t.Fatal("wrong m.Message", m.Message)
+	}
+	if len(m.Steps) != 3 {
+		t.Fatal("must be 3 steps, got", len(m.Steps))
+	}
+	if string(m.Steps[0].Output) != "first" || string(m.Steps[2].Output) != "third" {
+		t.Fatal("step args not passed to executor")
+	}
+	if m.Steps[1].Success || m.Steps[1].RetCode != 2 {
+		t.Fatal("verify step must be failed with code 2, got", m.Steps[1].Success, m.Steps[1].RetCode)
+	}
+	if m.Steps[0].StartTime.IsZero() || m.Steps[0].EndTime.IsZero() {
+		t.Fatal("step timing not set")
+	}
+	if m.RetCode != 0 {
+		t.Fatal("m.RetCode must be taken from last step, got", m.RetCode)
+	}
+}
+
+func TestJob_Run_StepFailedStopsJob(t *testing.T) {
+	commandDir := newTestStepsCommandDir()
+	defer os.RemoveAll(commandDir)
+
+	cfg := &JobConfig{
+		Steps: []JobStep{
+			{Name: "dump", Command: "fail.sh"},
+			{Name: "verify", Command: "ok.sh"},
+		},
+	}
+	job := NewJob("test", cfg, "127.0.0.1:9999", commandDir, &TestJober{}, &TestScriptExecutor{})
+	m := job.Run()
+
+	if m.Success {
+		t.Fatal("m.Success must be false")
+	}
+	if m.Message != "step dump failed: exit status 2" {
+		t.Fatal("wrong m.Message", m.Message)
+	}
+	if len(m.Steps) != 1 {
+		t.Fatal("must be 1 step, got", len(m.Steps))
+	}
+	if m.RetCode != 2 {
+		t.Fatal("m.RetCode must be 2 not", m.RetCode)
+	}
+}
+
+func TestJob_Run_StepFilesRecorded(t *testing.T) {
+	commandDir := newTestStepsCommandDir()
+	defer os.RemoveAll(commandDir)
+
+	cfg := &JobConfig{
+		Namespace: "wow",
+		Steps: []JobStep{
+			{Name: "one", Command: "ok.sh"},
+			{Name: "two", Command: "ok.sh"},
+		},
+	}
+	job := NewJob("test", cfg, "127.0.0.1:9999", commandDir, &TestJoberPushFile{}, &TestOkExecutor{})
+	m := job.Run()
+
+	if len(m.Steps[0].Files) != 2 || len(m.Steps[1].Files) != 2 {
+		t.Fatal("each step must have 2 files, got", len(m.Steps[0].Files), len(m.Steps[1].Files))
+	}
+	if len(m.Files) != 4 {
+		t.Fatal("m.Files length must be 4 not", len(m.Files))
+	}
+	if m.TotalSize != 2*(1234+12345) {
+		t.Fatal("wrong m.TotalSize", m.TotalSize)
+	}
+}
+
+func TestJobConfig_Sanitize_Steps(t *testing.T) {
+	cfg := &JobConfig{Steps: []JobStep{{Command: "ok.sh"}, {Name: "two", Command: "ok.sh"}}}
+	if err := cfg.Sanitize(); err != nil {
+		t.Fatal("Error:", err)
+	}
+	if cfg.Steps[0].Name != "step1" {
+		t.Fatal("default step name must be step1 not", cfg.Steps[0].Name)
+	}
+
+	cfg = &JobConfig{Command: "wow.sh", Steps: []JobStep{{Command: "ok.sh"}}}
+	err := cfg.Sanitize()
+	if err == nil || err.Error() != "both command and steps defined" {
+		t.Fatal("wrong error", err)
+	}
+
+	cfg = &JobConfig{Steps: []JobStep{{Name: "one"}}}
+	err = cfg.Sanitize()
+	if err == nil || err.Error() != "step 1: command is not defined" {
+		t.Fatal("wrong error", err)
+	}
+}
+
+func TestBashExecutor_WithArgs(t *testing.T) {
+	executor := NewBashExecutor(map[string]string{"a": "1", "b": "2"}, "", 22, false)
+	stepExecutor := executor.WithArgs(map[string]string{"b": "3"}).(*BashExecutor)
+	if stepExecutor.Args["a"] != "1" || stepExecutor.Args["b"] != "3" {
+		t.Fatal("wrong merged args", stepExecutor.Args)
+	}
+	if executor.Args["b"] != "2" {
+		t.Fatal("original executor args modified")
+	}
+}
@@ -45,14 +45,54 @@ func (j *TestJoberPushFile) WaitJob(taskId TaskId) {
 
 type TestOkExecutor struct{}
 
-func (e *TestOkExecutor) Execute(script []byte, output io.Writer, errput io.Writer) error {
-	return nil
+func (e *TestOkExecutor) Execute(script []byte, output io.Writer, errput io.Writer) (*ExecutionResult, error) {
+	return &ExecutionResult{}, nil
+}
+
+type TestCountExecutor struct {
+	calls int
+}
+
+func (e *TestCountExecutor) Execute(script []byte, output io.Writer, errput io.Writer) (*ExecutionResult, error) {
+	e.calls++
+	return &ExecutionResult{}, nil
+}
+
+type TestOutputExecutor struct{}
+
+func (e *TestOutputExecutor) Execute(script []byte, output io.Writer, errput io.Writer) (*ExecutionResult, error) {
+	output.Write([]byte("hello world"))
+	errput.Write([]byte("oops"))
+	return &ExecutionResult{}, nil
 }
 
 type TestFailExecutor struct{}
 
-func (e *TestFailExecutor) Execute(script []byte, output io.Writer, errput io.Writer) error {
-	return errors.New("Oops")
+func (e *TestFailExecutor) Execute(script []byte, output io.Writer, errput io.Writer) (*ExecutionResult, error) {
+	return &ExecutionResult{ExitCode: 3, WallTime: time.Second, MaxRSS: 1024}, errors.New("Oops")
+}
+
+func TestJob_Run_NotStartedRetCode(t *testing.T) {
+	executor := NewBashExecutor(map[string]string{"pwd": "${cmd:mysql/root}"}, "", 22, false)
+	jober := &TestJober{}
+
+	cfg := &JobConfig{Command: "utils.go"}
+	job := NewJob(
+		"test_not_started", cfg, "127.0.0.1:9999",
+		".", jober, executor,
+	)
+
+	m := job.Run()
+
+	if m.Success {
+		t.Fatal("m.Success must be false")
+	}
+	if m.RetCode != RETCODE_NOT_STARTED {
+		t.Fatal("m.RetCode must be -1 not", m.RetCode)
+	}
+	if m.Message != "argument pwd: secret_command is not configured: ${cmd:mysql/root}" {
+		t.Fatal("unexpected m.Message:", m.Message)
+	}
 }
 
 func TestJob_Run_MetadataFieldSetted(t *testing.T) {
@@ -72,6 +112,26 @@ func TestJob_Run_MetadataFieldSetted(t *testing.T) {
 	}
 }
 
+func TestJob_Run_MetadataInJobTimezone(t *testing.T) {
+	cfg := &JobConfig{Command: "utils.go", Timezone: "Asia/Tokyo"}
+	if err := cfg.Sanitize(); err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	job := NewJob(
+		"test", cfg, "127.0.0.1:9999",
+		".", &TestJober{}, &TestOkExecutor{},
+	)
+
+	m := job.Run()
+
+	if m.Timezone != "Asia/Tokyo" {
+		t.Fatal("m.Timezone must be Asia/Tokyo not", m.Timezone)
+	}
+	if m.StartTime.Location().String() != "Asia/Tokyo" || m.EndTime.Location().String() != "Asia/Tokyo" {
+		t.Fatal("metadata times must be in Asia/Tokyo, not", m.StartTime, m.EndTime)
+	}
+}
+
 func TestJob_Run_ExecutionOkMetadataSetted(t *testing.T) {
 	now := time.Now()
 	executor := &TestOkExecutor{}
@@ -147,6 +207,15 @@ func TestJob_Run_ExecutionFailedMetadataSetted(t *testing.T) {
 	if m.Message != "Oops" {
 		t.Fatalf("m.Message must be 'Oops' not '%s'", m.Message)
 	}
+	if m.RetCode != 3 {
+		t.Fatal("m.RetCode must be 3 not", m.RetCode)
+	}
+	if m.WallTime != time.Second {
+		t.Fatal("m.WallTime must be 1s not", m.WallTime)
+	}
+	if m.MaxRSS != 1024 {
+		t.Fatal("m.MaxRSS must be 1024 not", m.MaxRSS)
+	}
 	if m.JobName != "test_fail" {
 		t.Fatal("m.JobName must be 'test_fail' not", m.JobName)
 	}
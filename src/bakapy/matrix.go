@@ -0,0 +1,158 @@
+package bakapy
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// MatrixCombinations returns all combinations of matrix values,
+// keys are iterated in sorted order.
+func MatrixCombinations(matrix map[string][]string) []map[string]string {
+	keys := make([]string, 0, len(matrix))
+	for key := range matrix {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	combinations := []map[string]string{{}}
+	for _, key := range keys {
+		next := []map[string]string{}
+		for _, combination := range combinations {
+			for _, value := range matrix[key] {
+				extended := make(map[string]string, len(combination)+1)
+				for k, v := range combination {
+					extended[k] = v
+				}
+				extended[key] = value
+				next = append(next, extended)
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
+
+// matrixValues returns values joined in sorted keys order
+func matrixValues(combination map[string]string) []string {
+	keys := make([]string, 0, len(combination))
+	for key := range combination {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, combination[key])
+	}
+	return values
+}
+
+func (jobConfig *JobConfig) checkMatrix() error {
+	if len(jobConfig.Matrix) == 0 {
+		return errors.New("empty matrix")
+	}
+	for key, values := range jobConfig.Matrix {
+		if !ARG_NAME_RE.MatchString(key) {
+			return errors.New(fmt.Sprintf("matrix: invalid argument name '%s'", key))
+		}
+		if _, exist := jobConfig.Args[key]; exist {
+			return errors.New(fmt.Sprintf("matrix: argument %s already defined in args", key))
+		}
+		if len(values) == 0 {
+			return errors.New(fmt.Sprintf("matrix: no values for %s", key))
+		}
+		seen := map[string]bool{}
+		for _, value := range values {
+			if value == "" || value == "." || value == ".." || strings.ContainsAny(value, "/,[]@ \t") {
+				return errors.New(fmt.Sprintf("matrix: invalid %s value '%s'", key, value))
+			}
+			if seen[value] {
+				return errors.New(fmt.Sprintf("matrix: duplicated %s value %s", key, value))
+			}
+			seen[value] = true
+		}
+	}
+	return nil
+}
+
+// MatrixSubJobs returns sorted names of sub-jobs of matrix job
+func (cfg *Config) MatrixSubJobs(parent string) []string {
+	subNames := []string{}
+	for jobName, jobConfig := range cfg.Jobs {
+		if jobConfig.MatrixParent == parent {
+			subNames = append(subNames, jobName)
+		}
+	}
+	sort.Strings(subNames)
+	return subNames
+}
+
+// expandMatrix replaces each matrix job by sub-jobs named
+// <job>[value1,value2...], one per combination of matrix values.
+// References to matrix job in dependencies replaced by all its sub-jobs,
+// scheduler triggers downstream jobs once all sub-jobs finished.
+func (cfg *Config) expandMatrix() error {
+	parents := []string{}
+	for jobName, jobConfig := range cfg.Jobs {
+		if jobConfig.Matrix != nil {
+			parents = append(parents, jobName)
+		}
+	}
+	sort.Strings(parents)
+
+	expanded := map[string][]string{}
+	for _, jobName := range parents {
+		jobConfig := cfg.Jobs[jobName]
+		if err := jobConfig.checkMatrix(); err != nil {
+			return errors.New("job " + jobName + ": " + err.Error())
+		}
+		delete(cfg.Jobs, jobName)
+		for _, combination := range MatrixCombinations(jobConfig.Matrix) {
+			values := matrixValues(combination)
+			subName := fmt.Sprintf("%s[%s]", jobName, strings.Join(values, ","))
+			if _, exist := cfg.Jobs[subName]; exist {
+				return errors.New(fmt.Sprintf("job %s: sub-job name %s already used", jobName, subName))
+			}
+			sub := jobConfig.Copy()
+			sub.Matrix = nil
+			sub.MatrixParent = jobName
+			sub.MatrixValues = combination
+			sub.Namespace = path.Join(append([]string{jobConfig.Namespace}, values...)...)
+			sub.Args = make(map[string]string, len(jobConfig.Args)+len(combination))
+			for argName, argValue := range jobConfig.Args {
+				sub.Args[argName] = argValue
+			}
+			for key, value := range combination {
+				sub.Args[key] = value
+			}
+			cfg.Jobs[subName] = &sub
+			expanded[jobName] = append(expanded[jobName], subName)
+		}
+	}
+
+	if len(expanded) == 0 {
+		return nil
+	}
+	replace := func(refs []string) []string {
+		if refs == nil {
+			return nil
+		}
+		result := []string{}
+		for _, ref := range refs {
+			if subNames, exist := expanded[ref]; exist {
+				result = append(result, subNames...)
+			} else {
+				result = append(result, ref)
+			}
+		}
+		return result
+	}
+	for _, jobConfig := range cfg.Jobs {
+		jobConfig.After = replace(jobConfig.After)
+		jobConfig.OnSuccess = replace(jobConfig.OnSuccess)
+		jobConfig.OnFailure = replace(jobConfig.OnFailure)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package bakapy
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestMatrixCombinations(t *testing.T) {
+	combinations := MatrixCombinations(map[string][]string{
+		"db":   {"main", "stats"},
+		"kind": {"full", "inc"},
+	})
+	if len(combinations) != 4 {
+		t.Fatal("combinations length must be 4 not", len(combinations))
+	}
+	if combinations[1]["db"] != "main" || combinations[1]["kind"] != "inc" {
+		t.Fatal("unexpected second combination", combinations[1])
+	}
+}
+
+func TestParseConfig_Matrix(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+jobs:
+    mysql:
+      namespace: mysql
+      command: backup-mysql-databases.sh
+      args: {user: root}
+      matrix:
+        database: [main, stats]
+      run_at: {minute: "0", hour: "2", day: "*", month: "*", weekday: "*"}
+    report:
+      namespace: report
+      after: [mysql]
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	config, err := ParseConfig(cfg.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Jobs) != 3 {
+		t.Fatal("config.Jobs length must be 3 not", len(config.Jobs))
+	}
+	sub := config.Jobs["mysql[stats]"]
+	if sub == nil {
+		t.Fatal("sub-job mysql[stats] not found")
+	}
+	if sub.Namespace != "mysql/stats" {
+		t.Fatal("sub.Namespace must be mysql/stats not", sub.Namespace)
+	}
+	if sub.Args["database"] != "stats" || sub.Args["user"] != "root" {
+		t.Fatal("unexpected sub-job args", sub.Args)
+	}
+	if sub.MatrixParent != "mysql" {
+		t.Fatal("sub.MatrixParent must be mysql not", sub.MatrixParent)
+	}
+	if sub.RunAt.IsEmpty() {
+		t.Fatal("sub-job must keep schedule")
+	}
+	if config.Jobs["mysql[main]"].Args["database"] != "main" {
+		t.Fatal("args must not be shared between sub-jobs")
+	}
+	after := config.Jobs["report"].After
+	sort.Strings(after)
+	if len(after) != 2 || after[0] != "mysql[main]" || after[1] != "mysql[stats]" {
+		t.Fatal("report must depend on all sub-jobs, not", after)
+	}
+}
+
+func TestParseConfig_MatrixErrors(t *testing.T) {
+	cases := map[string]string{
+		"job mysql: matrix: argument database already defined in args": `
+jobs:
+    mysql:
+      args: {database: main}
+      matrix: {database: [main]}
+`,
+		"job mysql: matrix: invalid database value 'a/b'": `
+jobs:
+    mysql:
+      matrix: {database: [a/b]}
+`,
+		"job mysql: matrix: no values for database": `
+jobs:
+    mysql:
+      matrix: {database: []}
+`,
+	}
+	for expectedErr, content := range cases {
+		cfg, _ := ioutil.TempFile("", "test_config")
+		cfg.Write([]byte(content))
+		cfg.Close()
+		_, err := ParseConfig(cfg.Name())
+		os.Remove(cfg.Name())
+		if err == nil || err.Error() != expectedErr {
+			t.Fatal("error must be", expectedErr, "not", err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package bakapy
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Excerpt is small part of task output saved in metadata. It is encoded
+// as json string, invalid utf-8 sequences are replaced.
+type Excerpt []byte
+
+func (e Excerpt) String() string {
+	return string(e)
+}
+
+func (e Excerpt) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(e))
+}
+
+func (e *Excerpt) UnmarshalJSON(data []byte) error {
+	var s *string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == nil {
+		*e = nil
+		return nil
+	}
+	*e = Excerpt(*s)
+	return nil
+}
+
+// metadataLogDir returns directory for output logs and scripts of tasks
+// from metadata dir
+func metadataLogDir(dir string) string {
+	return path.Clean(dir) + "_logs"
+}
+
+// gzipFile compresses data written to file and closes both. Compressed
+// data is flushed to file periodically, so log of running or crashed
+// task can be read up to last flush.
+type gzipFile struct {
+	*gzip.Writer
+	file      *os.File
+	lastFlush time.Time
+}
+
+func (f *gzipFile) Write(p []byte) (int, error) {
+	n, err := f.Writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if now := time.Now(); now.Sub(f.lastFlush) >= BLOB_FLUSH_INTERVAL {
+		f.lastFlush = now
+		err = f.Writer.Flush()
+	}
+	return n, err
+}
+
+func (f *gzipFile) Close() error {
+	if err := f.Writer.Close(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+// createBlob creates gzipped file for task data
+func createBlob(blobPath string) (io.WriteCloser, error) {
+	file, err := os.Create(blobPath)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipFile{Writer: gzip.NewWriter(file), file: file, lastFlush: time.Now()}, nil
+}
+
+func writeBlob(blobPath string, data []byte) error {
+	blob, err := createBlob(blobPath)
+	if err != nil {
+		return err
+	}
+	if _, err := blob.Write(data); err != nil {
+		blob.Close()
+		return err
+	}
+	return blob.Close()
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	file *os.File
+}
+
+// Read returns data of not finished gzip file up to last flush
+func (r *gzipReadCloser) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
+
+// OpenTaskLog opens output log or script of task, gzipped files (.gz)
+// are decompressed
+func OpenTaskLog(logPath string) (io.ReadCloser, error) {
+	file, err := os.Open(logPath)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(logPath, ".gz") {
+		return file, nil
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: reader, file: file}, nil
+}
+
+func readTaskLog(logPath string) ([]byte, error) {
+	reader, err := OpenTaskLog(logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// LoadScript returns task script, reading it from blob if needed
+func (metadata *JobMetadata) LoadScript() ([]byte, error) {
+	if metadata.Script != nil || metadata.ScriptBlob == "" {
+		return metadata.Script, nil
+	}
+	return readTaskLog(metadata.ScriptBlob)
+}
+
+// LoadScript returns step script, reading it from blob if needed
+func (step *JobStepMetadata) LoadScript() ([]byte, error) {
+	if step.Script != nil || step.ScriptBlob == "" {
+		return step.Script, nil
+	}
+	return readTaskLog(step.ScriptBlob)
+}
+
+// storeScriptBlob moves inline script to blob, script already stored
+// in blob is only dropped from metadata
+func storeScriptBlob(script *[]byte, scriptBlob *string, blobPath string) error {
+	if *scriptBlob == "" && len(*script) > 0 {
+		if err := os.MkdirAll(path.Dir(blobPath), 0750); err != nil {
+			return err
+		}
+		if err := writeBlob(blobPath, *script); err != nil {
+			return err
+		}
+		*scriptBlob = blobPath
+	}
+	if *scriptBlob != "" {
+		*script = nil
+	}
+	return nil
+}
+
+// storeOutputBlob moves output longer than excerpt without output log,
+// like full output of old metadata versions, to blob. Only last
+// OUTPUT_EXCERPT_SIZE bytes are kept in metadata.
+func storeOutputBlob(output *Excerpt, outputLog *string, blobPath string) error {
+	if *outputLog != "" || int64(len(*output)) <= OUTPUT_EXCERPT_SIZE {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(blobPath), 0750); err != nil {
+		return err
+	}
+	if err := writeBlob(blobPath, *output); err != nil {
+		return err
+	}
+	*outputLog = blobPath
+	*output = append(Excerpt(nil), (*output)[int64(len(*output))-OUTPUT_EXCERPT_SIZE:]...)
+	return nil
+}
+
+// storeBlobs moves scripts and full outputs of metadata saved to saveTo
+// out of metadata to gzipped files in log dir
+func (metadata *JobMetadata) storeBlobs(saveTo string) error {
+	dir, name := path.Split(saveTo)
+	logDir := metadataLogDir(dir)
+	blobPath := path.Join(logDir, name+".script.gz")
+	if err := storeScriptBlob(&metadata.Script, &metadata.ScriptBlob, blobPath); err != nil {
+		return err
+	}
+	if err := storeOutputBlob(&metadata.Output, &metadata.OutputLog, path.Join(logDir, name+".output.gz")); err != nil {
+		return err
+	}
+	if err := storeOutputBlob(&metadata.Errput, &metadata.ErrputLog, path.Join(logDir, name+".errput.gz")); err != nil {
+		return err
+	}
+	for idx := range metadata.Steps {
+		step := &metadata.Steps[idx]
+		prefix := path.Join(logDir, fmt.Sprintf("%s.step%d.", name, idx+1))
+		if err := storeScriptBlob(&step.Script, &step.ScriptBlob, prefix+"script.gz"); err != nil {
+			return err
+		}
+		if err := storeOutputBlob(&step.Output, &step.OutputLog, prefix+"output.gz"); err != nil {
+			return err
+		}
+		if err := storeOutputBlob(&step.Errput, &step.ErrputLog, prefix+"errput.gz"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
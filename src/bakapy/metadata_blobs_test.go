@@ -0,0 +1,129 @@
+package bakapy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExcerpt_JSON(t *testing.T) {
+	data, _ := json.Marshal(struct{ Output Excerpt }{Excerpt("hello\n")})
+	if string(data) != `{"Output":"hello\n"}` {
+		t.Fatal("excerpt must be encoded as string, not", string(data))
+	}
+	var decoded struct{ Output Excerpt }
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.Output.String() != "hello\n" {
+		t.Fatal("wrong decoded excerpt", decoded.Output, err)
+	}
+}
+
+func TestJobMetadataSave_ScriptBlobs(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	defer os.RemoveAll(metadataLogDir(dir))
+	metaPath := dir + "/task"
+
+	metadata := testMetadata()
+	metadata.Script = []byte("echo hello")
+	metadata.Steps = []JobStepMetadata{{Name: "one", Script: []byte("echo one")}}
+	if err := metadata.Save(metaPath); err != nil {
+		t.Fatal("save failed:", err)
+	}
+	data, _ := ioutil.ReadFile(metaPath)
+	if strings.Contains(string(data), `"Script":`) {
+		t.Fatal("scripts must not be saved in metadata", string(data))
+	}
+	if !strings.Contains(string(data), `"Output":"some output"`) {
+		t.Fatal("output excerpt must be saved as string", string(data))
+	}
+
+	loaded, err := LoadJobMetadata(metaPath)
+	if err != nil {
+		t.Fatal("load failed:", err)
+	}
+	if loaded.ScriptBlob != path.Join(metadataLogDir(dir), "task.script.gz") {
+		t.Fatal("wrong script blob", loaded.ScriptBlob)
+	}
+	if script, err := loaded.LoadScript(); err != nil || string(script) != "echo hello" {
+		t.Fatal("wrong loaded script", string(script), err)
+	}
+	if script, err := loaded.Steps[0].LoadScript(); err != nil || string(script) != "echo one" {
+		t.Fatal("wrong loaded step script", string(script), err)
+	}
+	if logs := loaded.LogFiles(); len(logs) != 2 {
+		t.Fatal("script blobs must be listed in log files, got", logs)
+	}
+}
+
+func TestJobMetadataSave_SharedStepsNotChanged(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	defer os.RemoveAll(metadataLogDir(dir))
+
+	metadata := testMetadata()
+	metadata.Steps = []JobStepMetadata{{Name: "one", Script: []byte("echo one"), ScriptBlob: "/somewhere"}}
+	snapshot := *metadata
+	snapshot.Save(dir + "/task")
+	if string(metadata.Steps[0].Script) != "echo one" {
+		t.Fatal("saving snapshot must not change steps of metadata")
+	}
+}
+
+func TestJobMetadataSave_MetadataNotChanged(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	defer os.RemoveAll(metadataLogDir(dir))
+
+	metadata := testMetadata()
+	metadata.Script = []byte("echo hello")
+	if err := metadata.Save(dir + "/task"); err != nil {
+		t.Fatal("save failed:", err)
+	}
+	if string(metadata.Script) != "echo hello" || metadata.ScriptBlob != "" || metadata.Checksum != "" {
+		t.Fatal("saved metadata must not be changed", string(metadata.Script), metadata.ScriptBlob, metadata.Checksum)
+	}
+}
+
+func TestCreateBlob_FlushedBeforeClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobPath := path.Join(dir, "task.output.gz")
+
+	blob, err := createBlob(blobPath)
+	if err != nil {
+		t.Fatal("cannot create blob:", err)
+	}
+	defer blob.Close()
+	blob.(*gzipFile).lastFlush = time.Time{}
+	blob.Write([]byte("hello\n"))
+
+	data, err := readTaskLog(blobPath)
+	if err != nil || string(data) != "hello\n" {
+		t.Fatal("flushed data of not closed blob must be readable, got", string(data), err)
+	}
+}
+
+func TestDecodeJobMetadata_V1(t *testing.T) {
+	v1 := `{"SchemaVersion":1,"JobName":"db","Output":"aGVsbG8=","Script":"ZWNobw==",` +
+		`"Steps":[{"Name":"one","Errput":"b29wcw=="}],"Hooks":[{"Stage":"pre","Output":"d293"}]}`
+	metadata, err := decodeJobMetadata([]byte(v1))
+	if err != nil {
+		t.Fatal("v1 metadata must be decoded, got", err)
+	}
+	if metadata.SourceVersion != 1 {
+		t.Fatal("source version must be 1 not", metadata.SourceVersion)
+	}
+	if string(metadata.Output) != "hello" || string(metadata.Steps[0].Errput) != "oops" || string(metadata.Hooks[0].Output) != "wow" {
+		t.Fatal("output excerpts must be decoded", metadata.Output, metadata.Steps[0].Errput, metadata.Hooks[0].Output)
+	}
+	if string(metadata.Script) != "echo" {
+		t.Fatal("inline script must be kept until save, got", string(metadata.Script))
+	}
+}
@@ -0,0 +1,200 @@
+package bakapy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// MetadataJournalDir returns directory with last written copy of each
+// metadata file in dir, used to repair corrupted files.
+func MetadataJournalDir(dir string) string {
+	return path.Clean(dir) + "_journal"
+}
+
+func metadataJournalPath(metaPath string) string {
+	dir, name := path.Split(metaPath)
+	return path.Join(MetadataJournalDir(dir), name)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// isTempFile reports if file is temp file of writeFileAtomic. They are
+// skipped when metadata directory is listed.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// writeFileAtomic writes data to dot-prefixed temp file next to target,
+// syncs it, renames to target and syncs target directory.
+func writeFileAtomic(target string, data []byte) error {
+	tmp, err := ioutil.TempFile(path.Dir(target), "."+path.Base(target)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0640); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return err
+	}
+	return syncDir(path.Dir(target))
+}
+
+// decodeRawMetadata parses metadata json as map, numbers are kept as is
+func decodeRawMetadata(data []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, errors.New("metadata is not an object")
+	}
+	return raw, nil
+}
+
+// metadataChecksum returns hash of metadata json without checksum field.
+// Json is encoded from map with sorted keys, so checksum does not depend
+// on struct fields order and files of older versions can be verified.
+func metadataChecksum(raw map[string]interface{}) (string, error) {
+	saved, ok := raw["Checksum"]
+	delete(raw, "Checksum")
+	data, err := json.Marshal(raw)
+	if ok {
+		raw["Checksum"] = saved
+	}
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// legacyMetadataChecksum returns checksum of first version 1 files: hash
+// of struct encoded json with empty checksum field. Struct changed since,
+// so it is computed on saved json with checksum value cleared.
+func legacyMetadataChecksum(data []byte, checksum string) string {
+	quoted, _ := json.Marshal(checksum)
+	cleared := bytes.Replace(data, append([]byte(`"Checksum":`), quoted...), []byte(`"Checksum":""`), 1)
+	sum := sha256.Sum256(cleared)
+	return hex.EncodeToString(sum[:])
+}
+
+// encode returns metadata json with schema version and checksum set
+func (metadata *JobMetadata) encode() ([]byte, error) {
+	metadata.SchemaVersion = METADATA_SCHEMA_VERSION
+	metadata.Checksum = ""
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := decodeRawMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := metadataChecksum(raw)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Checksum = sum
+	return json.Marshal(metadata)
+}
+
+// decodeJobMetadata parses metadata of any supported schema version,
+// verifies its checksum if present and upgrades it to current version
+func decodeJobMetadata(data []byte) (*JobMetadata, error) {
+	raw, err := decodeRawMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	version, err := rawMetadataVersion(raw)
+	if err != nil {
+		return nil, err
+	}
+	if version > METADATA_SCHEMA_VERSION {
+		return nil, errors.New(fmt.Sprintf("unsupported metadata schema version %d", version))
+	}
+	if checksum, _ := raw["Checksum"].(string); checksum != "" {
+		sum, err := metadataChecksum(raw)
+		if err != nil {
+			return nil, err
+		}
+		if sum != checksum && !(version == 1 && legacyMetadataChecksum(data, checksum) == checksum) {
+			return nil, errors.New("metadata checksum mismatch")
+		}
+	}
+	if version < METADATA_SCHEMA_VERSION {
+		if err := upgradeRawMetadata(raw, version); err != nil {
+			return nil, err
+		}
+		data, err = json.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	metadata := JobMetadata{}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, err
+	}
+	metadata.SourceVersion = version
+	return &metadata, nil
+}
+
+// repairJobMetadata restores metadata file from its journal copy
+func repairJobMetadata(metaPath string) (*JobMetadata, error) {
+	journalPath := metadataJournalPath(metaPath)
+	data, err := ioutil.ReadFile(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := decodeJobMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(metaPath, data); err != nil {
+		return nil, err
+	}
+	logging.MustGetLogger("bakapy.metadata").Warning("metadata file %s repaired from journal", metaPath)
+	return metadata, nil
+}
+
+// RemoveJobMetadata removes metadata file, its journal copy and index entry
+func RemoveJobMetadata(metaPath string) error {
+	if err := os.Remove(metadataJournalPath(metaPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(metaPath); err != nil {
+		return err
+	}
+	unindexJobMetadata(metaPath)
+	return nil
+}
@@ -0,0 +1,168 @@
+package bakapy
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func testMetadataDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("cannot create temp dir:", err)
+	}
+	return dir, func() {
+		os.RemoveAll(dir)
+		os.RemoveAll(MetadataJournalDir(dir))
+		os.Remove(MetadataIndexPath(dir))
+		os.RemoveAll(metadataLogDir(dir))
+	}
+}
+
+func testMetadata() *JobMetadata {
+	loc, _ := time.LoadLocation("Asia/Tokyo")
+	return &JobMetadata{
+		TaskId:    "c2a9b6e4-0c2e-4a5b-9a1e-1b2d3c4e5f60",
+		JobName:   "test",
+		Success:   true,
+		StartTime: time.Date(2015, 3, 1, 10, 0, 0, 0, loc),
+		EndTime:   time.Date(2015, 3, 1, 10, 5, 0, 0, loc),
+		Output:    []byte("some output"),
+		Files:     []JobMetadataFile{{Name: "a.tar", Size: 10}},
+	}
+}
+
+func TestJobMetadataSave_Atomic(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	metaPath := dir + "/task"
+
+	if err := testMetadata().Save(metaPath); err != nil {
+		t.Fatal("save failed:", err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatal("metadata dir must contain only metadata file, not", files)
+	}
+	journal, _ := ioutil.ReadDir(MetadataJournalDir(dir))
+	if len(journal) != 1 || journal[0].Name() != "task" {
+		t.Fatal("journal must contain only copy of metadata, not", journal)
+	}
+
+	loaded, err := LoadJobMetadata(metaPath)
+	if err != nil {
+		t.Fatal("load failed:", err)
+	}
+	if loaded.SchemaVersion != METADATA_SCHEMA_VERSION {
+		t.Fatal("schema version must be", METADATA_SCHEMA_VERSION, "not", loaded.SchemaVersion)
+	}
+	if loaded.Checksum == "" {
+		t.Fatal("checksum must be saved")
+	}
+	if string(loaded.Output) != "some output" || len(loaded.Files) != 1 {
+		t.Fatal("wrong loaded metadata", loaded)
+	}
+}
+
+func TestJobMetadataSave_MissingDir(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	metaPath := dir + "/not/created/task"
+
+	if err := testMetadata().Save(metaPath); err != nil {
+		t.Fatal("save to missing dir failed:", err)
+	}
+	if _, err := LoadJobMetadata(metaPath); err != nil {
+		t.Fatal("load failed:", err)
+	}
+}
+
+func TestLoadJobMetadata_RepairFromJournal(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	metaPath := dir + "/task"
+
+	if err := testMetadata().Save(metaPath); err != nil {
+		t.Fatal("save failed:", err)
+	}
+	data, _ := ioutil.ReadFile(metaPath)
+	ioutil.WriteFile(metaPath, data[:len(data)/2], 0640)
+
+	loaded, err := LoadJobMetadata(metaPath)
+	if err != nil {
+		t.Fatal("truncated metadata must be repaired, got", err)
+	}
+	if loaded.JobName != "test" {
+		t.Fatal("wrong repaired metadata", loaded)
+	}
+	repaired, _ := ioutil.ReadFile(metaPath)
+	if string(repaired) != string(data) {
+		t.Fatal("metadata file must be restored from journal")
+	}
+}
+
+func TestLoadJobMetadata_ChecksumMismatch(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	metaPath := dir + "/task"
+
+	if err := testMetadata().Save(metaPath); err != nil {
+		t.Fatal("save failed:", err)
+	}
+	os.Remove(metadataJournalPath(metaPath))
+	data, _ := ioutil.ReadFile(metaPath)
+	data = []byte(string(data[:len(data)-1]) + `,"JobName":"other"}`)
+	ioutil.WriteFile(metaPath, data, 0640)
+
+	_, err := LoadJobMetadata(metaPath)
+	expectedErr := "metadata checksum mismatch"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal("error must be", expectedErr, "not", err)
+	}
+}
+
+func TestLoadJobMetadata_NoChecksum(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	metaPath := dir + "/task"
+
+	ioutil.WriteFile(metaPath, []byte(`{"JobName":"legacy","Success":true}`), 0640)
+	loaded, err := LoadJobMetadata(metaPath)
+	if err != nil {
+		t.Fatal("metadata without checksum must be loaded, got", err)
+	}
+	if loaded.JobName != "legacy" || loaded.SourceVersion != 0 || loaded.SchemaVersion != METADATA_SCHEMA_VERSION {
+		t.Fatal("wrong loaded metadata", loaded)
+	}
+}
+
+func TestLoadJobMetadata_UnsupportedVersion(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	metaPath := dir + "/task"
+
+	ioutil.WriteFile(metaPath, []byte(`{"SchemaVersion":100}`), 0640)
+	_, err := LoadJobMetadata(metaPath)
+	expectedErr := "unsupported metadata schema version 100"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal("error must be", expectedErr, "not", err)
+	}
+}
+
+func TestRemoveJobMetadata(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	metaPath := dir + "/task"
+
+	testMetadata().Save(metaPath)
+	if err := RemoveJobMetadata(metaPath); err != nil {
+		t.Fatal("remove failed:", err)
+	}
+	if _, err := os.Stat(metaPath); !os.IsNotExist(err) {
+		t.Fatal("metadata file must be removed")
+	}
+	if _, err := os.Stat(metadataJournalPath(metaPath)); !os.IsNotExist(err) {
+		t.Fatal("journal copy must be removed")
+	}
+}
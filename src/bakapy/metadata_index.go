@@ -0,0 +1,459 @@
+package bakapy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MetadataIndexEntry is indexed part of task metadata
+type MetadataIndexEntry struct {
+	File       string    // metadata file name in metadata dir
+	ModTime    time.Time // metadata file modification time
+	Size       int64     // metadata file size
+	TaskId     TaskId
+	JobName    string
+	Namespace  string
+	Status     string
+	Success    bool
+	StartTime  time.Time
+	EndTime    time.Time
+	ExpireTime time.Time
+	TotalSize  int64
+	Files      []JobMetadataFile
+}
+
+type MetadataIndexByStartTime []MetadataIndexEntry
+
+func (slice MetadataIndexByStartTime) Len() int {
+	return len(slice)
+}
+
+func (slice MetadataIndexByStartTime) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+func (slice MetadataIndexByStartTime) Less(i, j int) bool {
+	return slice[i].StartTime.Before(slice[j].StartTime)
+}
+
+type metadataIndexRecord struct {
+	Delete bool `json:",omitempty"`
+	Entry  MetadataIndexEntry
+}
+
+// MetadataQuery filters index entries, empty fields match everything
+type MetadataQuery struct {
+	JobName   string
+	Namespace string
+	Status    string
+	Failed    bool // only finished unsuccessful tasks
+	Since     time.Time
+	Until     time.Time
+	Limit     int // latest tasks only
+}
+
+func (q MetadataQuery) Match(entry *MetadataIndexEntry) bool {
+	if q.JobName != "" && entry.JobName != q.JobName {
+		return false
+	}
+	if q.Namespace != "" && entry.Namespace != q.Namespace {
+		return false
+	}
+	if q.Status != "" && entry.Status != q.Status {
+		return false
+	}
+	if q.Failed && (entry.Success || entry.Status != JOB_STATUS_FINISHED) {
+		return false
+	}
+	if !q.Since.IsZero() && entry.StartTime.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !entry.StartTime.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// ParseMetadataQuery reads query from url parameters job, namespace,
+// status, failed, since, until (RFC3339) and limit
+func ParseMetadataQuery(values url.Values) (MetadataQuery, error) {
+	q := MetadataQuery{
+		JobName:   values.Get("job"),
+		Namespace: values.Get("namespace"),
+		Status:    values.Get("status"),
+	}
+	if failed := values.Get("failed"); failed != "" {
+		v, err := strconv.ParseBool(failed)
+		if err != nil {
+			return q, errors.New(fmt.Sprintf("invalid failed value '%s'", failed))
+		}
+		q.Failed = v
+	}
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		raw := values.Get(param.name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return q, errors.New(fmt.Sprintf("invalid %s value '%s'", param.name, raw))
+		}
+		*param.value = t
+	}
+	if limit := values.Get("limit"); limit != "" {
+		v, err := strconv.Atoi(limit)
+		if err != nil || v < 0 {
+			return q, errors.New(fmt.Sprintf("invalid limit value '%s'", limit))
+		}
+		q.Limit = v
+	}
+	return q, nil
+}
+
+// MetadataIndexPath returns index file path for metadata dir
+func MetadataIndexPath(dir string) string {
+	return path.Clean(dir) + "_index"
+}
+
+func newMetadataIndexEntry(file string, info os.FileInfo, metadata *JobMetadata) MetadataIndexEntry {
+	status := metadata.Status
+	if status == "" {
+		status = JOB_STATUS_FINISHED
+	}
+	return MetadataIndexEntry{
+		File:       file,
+		ModTime:    info.ModTime(),
+		Size:       info.Size(),
+		TaskId:     metadata.TaskId,
+		JobName:    metadata.JobName,
+		Namespace:  metadata.Namespace,
+		Status:     status,
+		Success:    metadata.Success,
+		StartTime:  metadata.StartTime,
+		EndTime:    metadata.EndTime,
+		ExpireTime: metadata.ExpireTime,
+		TotalSize:  metadata.TotalSize,
+		Files:      metadata.Files,
+	}
+}
+
+func encodeMetadataIndexRecords(records []metadataIndexRecord) ([]byte, error) {
+	buf := bytes.Buffer{}
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// appendMetadataIndex adds records to index of metadata dir. Records
+// are written with single append, so several processes may update index.
+// Missing index is not created, it is built from all files on open.
+func appendMetadataIndex(dir string, records ...metadataIndexRecord) error {
+	data, err := encodeMetadataIndexRecords(records)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(MetadataIndexPath(dir), os.O_WRONLY|os.O_APPEND, 0640)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// indexJobMetadata records saved metadata file in index
+func indexJobMetadata(metaPath string, metadata *JobMetadata) {
+	info, err := os.Stat(metaPath)
+	if err == nil {
+		dir, file := path.Split(metaPath)
+		err = appendMetadataIndex(dir, metadataIndexRecord{Entry: newMetadataIndexEntry(file, info, metadata)})
+	}
+	if err != nil {
+		logging.MustGetLogger("bakapy.metadata").Warning("cannot update metadata index for %s: %s", metaPath, err)
+	}
+}
+
+// unindexJobMetadata records removed metadata file in index
+func unindexJobMetadata(metaPath string) {
+	dir, file := path.Split(metaPath)
+	record := metadataIndexRecord{Delete: true, Entry: MetadataIndexEntry{File: file}}
+	if err := appendMetadataIndex(dir, record); err != nil {
+		logging.MustGetLogger("bakapy.metadata").Warning("cannot update metadata index for %s: %s", metaPath, err)
+	}
+}
+
+// MetadataIndex is index of metadata dir kept in append-only file
+// alongside it. Index is rebuilt from metadata files if missing or
+// corrupted and compacted when it has too many superseded records.
+type MetadataIndex struct {
+	dir     string
+	path    string
+	entries map[string]*MetadataIndexEntry
+	info    os.FileInfo
+	offset  int64
+	// number of records read from file
+	records    int
+	compactMin int
+	lock       sync.Mutex
+	logger     *logging.Logger
+}
+
+func OpenMetadataIndex(dir string) (*MetadataIndex, error) {
+	idx := &MetadataIndex{
+		dir:        dir,
+		path:       MetadataIndexPath(dir),
+		entries:    make(map[string]*MetadataIndexEntry),
+		compactMin: METADATA_INDEX_COMPACT_MIN,
+		logger:     logging.MustGetLogger("bakapy.metadata"),
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if err := idx.refresh(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (idx *MetadataIndex) reset() {
+	idx.entries = make(map[string]*MetadataIndexEntry)
+	idx.info = nil
+	idx.offset = 0
+	idx.records = 0
+}
+
+// refresh reads records appended since last refresh, index is rebuilt
+// if its file is missing, replaced or corrupted and compacted if needed
+func (idx *MetadataIndex) refresh() error {
+	f, err := os.Open(idx.path)
+	if os.IsNotExist(err) {
+		idx.logger.Info("metadata index %s not found, rebuilding", idx.path)
+		_, err := idx.rebuild()
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if idx.info == nil || !os.SameFile(idx.info, info) || info.Size() < idx.offset {
+		idx.reset()
+	}
+	idx.info = info
+	if _, err := f.Seek(idx.offset, os.SEEK_SET); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// incomplete record is read on next refresh
+			if len(line) == 0 && idx.records > idx.compactMin &&
+				idx.records > METADATA_INDEX_COMPACT_RATIO*len(idx.entries) {
+				if err := idx.compact(); err != nil {
+					idx.logger.Warning("cannot compact metadata index %s: %s", idx.path, err)
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		record := metadataIndexRecord{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			idx.logger.Warning("metadata index %s corrupted at offset %d, rebuilding: %s", idx.path, idx.offset, err)
+			_, err := idx.rebuild()
+			return err
+		}
+		idx.apply(record)
+		idx.offset += int64(len(line))
+		idx.records++
+	}
+}
+
+// compact replaces index file by live entries only. Records appended by
+// other processes meanwhile may be lost, Sync restores them.
+func (idx *MetadataIndex) compact() error {
+	records := make([]metadataIndexRecord, 0, len(idx.entries))
+	for _, entry := range idx.entries {
+		records = append(records, metadataIndexRecord{Entry: *entry})
+	}
+	idx.logger.Info("compacting metadata index %s: %d records, %d entries", idx.path, idx.records, len(records))
+	return idx.write(records)
+}
+
+// write replaces index file by given records
+func (idx *MetadataIndex) write(records []metadataIndexRecord) error {
+	data, err := encodeMetadataIndexRecords(records)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(idx.path, data); err != nil {
+		return err
+	}
+	info, err := os.Stat(idx.path)
+	if err != nil {
+		return err
+	}
+	idx.info = info
+	idx.offset = int64(len(data))
+	idx.records = len(records)
+	return nil
+}
+
+func (idx *MetadataIndex) apply(record metadataIndexRecord) {
+	if record.Delete {
+		delete(idx.entries, record.Entry.File)
+		return
+	}
+	entry := record.Entry
+	idx.entries[entry.File] = &entry
+}
+
+// rebuild reads all metadata files and replaces index file. Names of
+// files which cannot be loaded are returned.
+func (idx *MetadataIndex) rebuild() ([]string, error) {
+	idx.reset()
+	files, err := ioutil.ReadDir(idx.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	corrupted := []string{}
+	records := []metadataIndexRecord{}
+	for _, f := range files {
+		if f.IsDir() || isTempFile(f.Name()) {
+			continue
+		}
+		metadata, err := LoadJobMetadata(path.Join(idx.dir, f.Name()))
+		if err != nil {
+			corrupted = append(corrupted, f.Name())
+			continue
+		}
+		entry := newMetadataIndexEntry(f.Name(), f, metadata)
+		idx.entries[entry.File] = &entry
+		records = append(records, metadataIndexRecord{Entry: entry})
+	}
+	return corrupted, idx.write(records)
+}
+
+// Rebuild recreates index from metadata files, paths of files which
+// cannot be loaded are returned
+func (idx *MetadataIndex) Rebuild() ([]string, error) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	corrupted, err := idx.rebuild()
+	return idx.paths(corrupted), err
+}
+
+// Sync updates index with metadata files written bypassing it. Only
+// files with changed size or modification time are loaded. Paths of
+// files which cannot be loaded are returned.
+func (idx *MetadataIndex) Sync() ([]string, error) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if err := idx.refresh(); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(idx.dir)
+	if err != nil {
+		return nil, err
+	}
+	corrupted := []string{}
+	records := []metadataIndexRecord{}
+	present := make(map[string]bool, len(files))
+	for _, f := range files {
+		if f.IsDir() || isTempFile(f.Name()) {
+			continue
+		}
+		present[f.Name()] = true
+		entry, ok := idx.entries[f.Name()]
+		if ok && entry.ModTime.Equal(f.ModTime()) && entry.Size == f.Size() {
+			continue
+		}
+		metadata, err := LoadJobMetadata(path.Join(idx.dir, f.Name()))
+		if err != nil {
+			corrupted = append(corrupted, f.Name())
+			if ok {
+				records = append(records, metadataIndexRecord{Delete: true, Entry: MetadataIndexEntry{File: f.Name()}})
+			}
+			continue
+		}
+		records = append(records, metadataIndexRecord{Entry: newMetadataIndexEntry(f.Name(), f, metadata)})
+	}
+	for file := range idx.entries {
+		if !present[file] {
+			records = append(records, metadataIndexRecord{Delete: true, Entry: MetadataIndexEntry{File: file}})
+		}
+	}
+	if len(records) > 0 {
+		if err := appendMetadataIndex(idx.dir, records...); err != nil {
+			return idx.paths(corrupted), err
+		}
+		if err := idx.refresh(); err != nil {
+			return idx.paths(corrupted), err
+		}
+	}
+	return idx.paths(corrupted), nil
+}
+
+func (idx *MetadataIndex) paths(files []string) []string {
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = idx.Path(file)
+	}
+	return paths
+}
+
+// Path returns full path of indexed metadata file
+func (idx *MetadataIndex) Path(file string) string {
+	return path.Join(idx.dir, file)
+}
+
+// Query returns matching entries sorted by start time
+func (idx *MetadataIndex) Query(q MetadataQuery) ([]MetadataIndexEntry, error) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if err := idx.refresh(); err != nil {
+		return nil, err
+	}
+	result := []MetadataIndexEntry{}
+	for _, entry := range idx.entries {
+		if q.Match(entry) {
+			result = append(result, *entry)
+		}
+	}
+	sort.Sort(MetadataIndexByStartTime(result))
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+	return result, nil
+}
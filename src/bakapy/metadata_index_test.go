@@ -0,0 +1,247 @@
+package bakapy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func saveIndexTestMetadata(dir, file, jobName string, success bool, start time.Time) {
+	(&JobMetadata{
+		TaskId:    TaskId(file),
+		JobName:   jobName,
+		Namespace: jobName,
+		Status:    JOB_STATUS_FINISHED,
+		Success:   success,
+		StartTime: start,
+		EndTime:   start.Add(time.Minute),
+		TotalSize: 10,
+		Files:     []JobMetadataFile{{Name: file + ".tar", Size: 10}},
+	}).Save(dir + "/" + file)
+}
+
+func TestMetadataIndex_BuiltFromFiles(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	start := time.Date(2015, 3, 1, 10, 0, 0, 0, time.UTC)
+	saveIndexTestMetadata(dir, "task1", "db", true, start)
+	saveIndexTestMetadata(dir, "task2", "db", false, start.Add(time.Hour))
+	saveIndexTestMetadata(dir, "task3", "www", true, start.Add(2*time.Hour))
+
+	index, err := OpenMetadataIndex(dir)
+	if err != nil {
+		t.Fatal("cannot open index:", err)
+	}
+	entries, _ := index.Query(MetadataQuery{})
+	if len(entries) != 3 || entries[0].TaskId != "task1" || entries[2].TaskId != "task3" {
+		t.Fatal("index must contain all tasks sorted by start time, not", entries)
+	}
+	if entries[0].Namespace != "db" || entries[0].TotalSize != 10 || len(entries[0].Files) != 1 {
+		t.Fatal("wrong indexed entry", entries[0])
+	}
+	if _, err := os.Stat(MetadataIndexPath(dir)); err != nil {
+		t.Fatal("index file must be created:", err)
+	}
+}
+
+func TestMetadataIndex_FollowsSaveAndRemove(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	start := time.Date(2015, 3, 1, 10, 0, 0, 0, time.UTC)
+	saveIndexTestMetadata(dir, "task1", "db", true, start)
+
+	index, err := OpenMetadataIndex(dir)
+	if err != nil {
+		t.Fatal("cannot open index:", err)
+	}
+	saveIndexTestMetadata(dir, "task2", "db", true, start.Add(time.Hour))
+	RemoveJobMetadata(dir + "/task1")
+
+	// other reader sees changes made after it was opened
+	entries, _ := index.Query(MetadataQuery{})
+	if len(entries) != 1 || entries[0].TaskId != "task2" {
+		t.Fatal("index must contain only task2, not", entries)
+	}
+}
+
+func TestMetadataIndex_Query(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	start := time.Date(2015, 3, 1, 10, 0, 0, 0, time.UTC)
+	saveIndexTestMetadata(dir, "task1", "db", true, start)
+	saveIndexTestMetadata(dir, "task2", "db", false, start.Add(time.Hour))
+	saveIndexTestMetadata(dir, "task3", "db", true, start.Add(2*time.Hour))
+	saveIndexTestMetadata(dir, "task4", "www", true, start.Add(3*time.Hour))
+	index, _ := OpenMetadataIndex(dir)
+
+	cases := []struct {
+		query    MetadataQuery
+		expected []TaskId
+	}{
+		{MetadataQuery{JobName: "www"}, []TaskId{"task4"}},
+		{MetadataQuery{Namespace: "db", Limit: 2}, []TaskId{"task2", "task3"}},
+		{MetadataQuery{Failed: true}, []TaskId{"task2"}},
+		{MetadataQuery{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)}, []TaskId{"task2", "task3"}},
+		{MetadataQuery{Status: JOB_STATUS_RUNNING}, []TaskId{}},
+	}
+	for _, c := range cases {
+		entries, err := index.Query(c.query)
+		if err != nil {
+			t.Fatal("query failed:", err)
+		}
+		ids := []TaskId{}
+		for _, entry := range entries {
+			ids = append(ids, entry.TaskId)
+		}
+		if len(ids) != len(c.expected) {
+			t.Fatal("query", c.query, "must return", c.expected, "not", ids)
+		}
+		for i := range ids {
+			if ids[i] != c.expected[i] {
+				t.Fatal("query", c.query, "must return", c.expected, "not", ids)
+			}
+		}
+	}
+}
+
+func TestMetadataIndex_Sync(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	start := time.Date(2015, 3, 1, 10, 0, 0, 0, time.UTC)
+	saveIndexTestMetadata(dir, "task1", "db", true, start)
+	saveIndexTestMetadata(dir, "task2", "db", true, start)
+	index, _ := OpenMetadataIndex(dir)
+
+	// changes bypassing index
+	data, _ := ioutil.ReadFile(dir + "/task1")
+	ioutil.WriteFile(dir+"/task3", data, 0640)
+	os.Remove(dir + "/task2")
+	ioutil.WriteFile(dir+"/broken", []byte("{,wow"), 0640)
+
+	corrupted, err := index.Sync()
+	if err != nil {
+		t.Fatal("sync failed:", err)
+	}
+	if len(corrupted) != 1 || corrupted[0] != dir+"/broken" {
+		t.Fatal("corrupted files must be", dir+"/broken", "not", corrupted)
+	}
+	entries, _ := index.Query(MetadataQuery{})
+	files := map[string]bool{}
+	for _, entry := range entries {
+		files[entry.File] = true
+	}
+	if len(files) != 2 || !files["task1"] || !files["task3"] {
+		t.Fatal("index must contain task1 and task3, not", files)
+	}
+}
+
+func TestMetadataIndex_RebuiltWhenCorrupted(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	start := time.Date(2015, 3, 1, 10, 0, 0, 0, time.UTC)
+	saveIndexTestMetadata(dir, "task1", "db", true, start)
+	index, _ := OpenMetadataIndex(dir)
+	saveIndexTestMetadata(dir, "task2", "db", true, start)
+
+	f, _ := os.OpenFile(MetadataIndexPath(dir), os.O_WRONLY|os.O_APPEND, 0640)
+	f.Write([]byte("garbage\n"))
+	f.Close()
+
+	for _, idx := range []*MetadataIndex{index, nil} {
+		if idx == nil {
+			idx, _ = OpenMetadataIndex(dir)
+		}
+		entries, err := idx.Query(MetadataQuery{})
+		if err != nil {
+			t.Fatal("corrupted index must be rebuilt, got", err)
+		}
+		if len(entries) != 2 {
+			t.Fatal("rebuilt index must contain 2 tasks, not", entries)
+		}
+	}
+}
+
+func TestMetadataIndex_Compacted(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	index, err := OpenMetadataIndex(dir)
+	if err != nil {
+		t.Fatal("cannot open index:", err)
+	}
+	index.compactMin = 10
+
+	// progress snapshots of running task saved again and again
+	metadata := testMetadata()
+	metadata.Status = JOB_STATUS_RUNNING
+	for i := 0; i < 100; i++ {
+		metadata.Files = append(metadata.Files, JobMetadataFile{Name: "file", Size: 1})
+		metadata.Save(dir + "/task")
+		if i%7 == 0 {
+			index.Query(MetadataQuery{})
+		}
+	}
+	entries, _ := index.Query(MetadataQuery{})
+	if len(entries) != 1 || len(entries[0].Files) != 101 {
+		t.Fatal("index must have last snapshot of task, got", entries)
+	}
+	data, _ := ioutil.ReadFile(MetadataIndexPath(dir))
+	if lines := strings.Count(string(data), "\n"); lines > index.compactMin {
+		t.Fatal("index must be compacted, got records:", lines)
+	}
+}
+
+func TestParseMetadataQuery(t *testing.T) {
+	values, _ := url.ParseQuery("job=db&status=finished&failed=true&since=2015-03-01T10:00:00Z&limit=5")
+	q, err := ParseMetadataQuery(values)
+	if err != nil {
+		t.Fatal("parse failed:", err)
+	}
+	if q.JobName != "db" || q.Status != JOB_STATUS_FINISHED || !q.Failed || q.Limit != 5 {
+		t.Fatal("wrong query", q)
+	}
+	if !q.Since.Equal(time.Date(2015, 3, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Fatal("wrong since", q.Since)
+	}
+
+	values, _ = url.ParseQuery("limit=-1")
+	_, err = ParseMetadataQuery(values)
+	expectedErr := "invalid limit value '-1'"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal("error must be", expectedErr, "not", err)
+	}
+}
+
+func TestStatusServer_Tasks(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	start := time.Date(2015, 3, 1, 10, 0, 0, 0, time.UTC)
+	saveIndexTestMetadata(dir, "task1", "db", true, start)
+	saveIndexTestMetadata(dir, "task2", "www", true, start)
+	cfg := NewConfig()
+	cfg.MetadataDir = dir
+	server := NewStatusServer(cfg, NewStorage(cfg))
+
+	req, _ := http.NewRequest("GET", "/tasks?job=www", nil)
+	resp := httptest.NewRecorder()
+	server.ServeHTTP(resp, req)
+	var entries []MetadataIndexEntry
+	if err := json.Unmarshal(resp.Body.Bytes(), &entries); err != nil {
+		t.Fatal("cannot decode response:", err, resp.Body.String())
+	}
+	if len(entries) != 1 || entries[0].TaskId != "task2" {
+		t.Fatal("wrong response", resp.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/tasks?since=yesterday", nil)
+	resp = httptest.NewRecorder()
+	server.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatal("invalid query must be rejected, got", resp.Code)
+	}
+}
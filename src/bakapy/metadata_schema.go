@@ -0,0 +1,171 @@
+package bakapy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+)
+
+// Version of metadata file format, files without version are version 0
+const METADATA_SCHEMA_VERSION = 2
+
+// metadataUpgrades convert raw metadata of version N to version N+1
+var metadataUpgrades = map[int]func(raw map[string]interface{}) error{
+	0: upgradeMetadataV0,
+	1: upgradeMetadataV1,
+}
+
+// upgradeMetadataV0 fills fields added before schema was versioned.
+// Status was not saved by old versions, output was saved in full.
+func upgradeMetadataV0(raw map[string]interface{}) error {
+	if status, _ := raw["Status"].(string); status == "" {
+		raw["Status"] = JOB_STATUS_FINISHED
+		if skipped, _ := raw["Skipped"].(string); skipped != "" {
+			raw["Status"] = JOB_STATUS_SKIPPED
+		}
+	}
+	for field, sizeField := range map[string]string{"Output": "OutputSize", "Errput": "ErrputSize"} {
+		encoded, _ := raw[field].(string)
+		if encoded == "" || !rawNumberIsZero(raw[sizeField]) {
+			continue
+		}
+		output, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid %s: %s", field, err))
+		}
+		raw[sizeField] = len(output)
+	}
+	return nil
+}
+
+// upgradeMetadataV1 converts base64 encoded output excerpts of task,
+// steps and hooks to strings. Scripts and full outputs are moved to
+// blobs on next save, so migration leaves only excerpts in metadata.
+func upgradeMetadataV1(raw map[string]interface{}) error {
+	objects := []interface{}{raw}
+	for _, list := range []string{"Steps", "Hooks"} {
+		items, _ := raw[list].([]interface{})
+		objects = append(objects, items...)
+	}
+	for _, object := range objects {
+		fields, ok := object.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, field := range []string{"Output", "Errput"} {
+			encoded, ok := fields[field].(string)
+			if !ok {
+				continue
+			}
+			output, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return errors.New(fmt.Sprintf("invalid %s: %s", field, err))
+			}
+			fields[field] = string(output)
+		}
+	}
+	return nil
+}
+
+func rawNumberIsZero(value interface{}) bool {
+	number, ok := value.(json.Number)
+	if !ok {
+		return true
+	}
+	v, err := number.Int64()
+	return err == nil && v == 0
+}
+
+func rawMetadataVersion(raw map[string]interface{}) (int, error) {
+	value, ok := raw["SchemaVersion"]
+	if !ok {
+		return 0, nil
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("invalid metadata schema version %v", value))
+	}
+	version, err := strconv.Atoi(number.String())
+	if err != nil || version < 0 {
+		return 0, errors.New(fmt.Sprintf("invalid metadata schema version %s", number))
+	}
+	return version, nil
+}
+
+// upgradeRawMetadata converts raw metadata from version to current one.
+// Checksum of old version is dropped, it is recalculated on save.
+func upgradeRawMetadata(raw map[string]interface{}, version int) error {
+	for v := version; v < METADATA_SCHEMA_VERSION; v++ {
+		upgrade, ok := metadataUpgrades[v]
+		if !ok {
+			return errors.New(fmt.Sprintf("no decoder for metadata schema version %d", v))
+		}
+		if err := upgrade(raw); err != nil {
+			return errors.New(fmt.Sprintf("cannot upgrade metadata schema version %d: %s", v, err))
+		}
+	}
+	raw["SchemaVersion"] = METADATA_SCHEMA_VERSION
+	delete(raw, "Checksum")
+	return nil
+}
+
+// MetadataMigration is result of migrating one metadata file
+type MetadataMigration struct {
+	Path        string
+	FromVersion int
+	Error       error
+}
+
+// MetadataMigrationReport lists metadata files by migration result
+type MetadataMigrationReport struct {
+	UpToDate []MetadataMigration
+	Migrated []MetadataMigration
+	Failed   []MetadataMigration
+}
+
+// MigrateMetadataDir rewrites metadata files of older schema versions
+// with current version. Nothing is written if dryRun is set, report
+// contains files which would be migrated.
+func MigrateMetadataDir(dir string, dryRun bool) (*MetadataMigrationReport, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &MetadataMigrationReport{}
+	for _, f := range files {
+		if f.IsDir() || isTempFile(f.Name()) {
+			continue
+		}
+		migration := MetadataMigration{Path: path.Join(dir, f.Name())}
+		data, err := ioutil.ReadFile(migration.Path)
+		if err != nil {
+			migration.Error = err
+			report.Failed = append(report.Failed, migration)
+			continue
+		}
+		metadata, err := decodeJobMetadata(data)
+		if err != nil {
+			migration.Error = err
+			report.Failed = append(report.Failed, migration)
+			continue
+		}
+		migration.FromVersion = metadata.SourceVersion
+		if metadata.SourceVersion == METADATA_SCHEMA_VERSION {
+			report.UpToDate = append(report.UpToDate, migration)
+			continue
+		}
+		if !dryRun {
+			if err := metadata.Save(migration.Path); err != nil {
+				migration.Error = err
+				report.Failed = append(report.Failed, migration)
+				continue
+			}
+		}
+		report.Migrated = append(report.Migrated, migration)
+	}
+	return report, nil
+}
@@ -0,0 +1,145 @@
+package bakapy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// metadata saved before schema was versioned
+var legacyMetadata = `{"JobName":"db","Namespace":"db","TaskId":"task1","Success":true,` +
+	`"RetCode":0,"Output":"aGVsbG8=","Errput":"","Config":{"RunAt":{"Second":"0","Minute":"30","Hour":"4",` +
+	`"Day":"*","Month":"*","Weekday":"*"}}}`
+
+func TestDecodeJobMetadata_V0(t *testing.T) {
+	metadata, err := decodeJobMetadata([]byte(legacyMetadata))
+	if err != nil {
+		t.Fatal("legacy metadata must be decoded, got", err)
+	}
+	if metadata.SourceVersion != 0 || metadata.SchemaVersion != METADATA_SCHEMA_VERSION {
+		t.Fatal("wrong versions", metadata.SourceVersion, metadata.SchemaVersion)
+	}
+	if metadata.Status != JOB_STATUS_FINISHED {
+		t.Fatal("status must be finished, not", metadata.Status)
+	}
+	if metadata.OutputSize != 5 || metadata.ErrputSize != 0 {
+		t.Fatal("output sizes must be set from saved output, not", metadata.OutputSize, metadata.ErrputSize)
+	}
+	if metadata.Config.RunAt.Hour != "4" {
+		t.Fatal("config must be decoded, not", metadata.Config.RunAt)
+	}
+}
+
+func TestDecodeJobMetadata_V0Skipped(t *testing.T) {
+	metadata, err := decodeJobMetadata([]byte(`{"JobName":"db","Skipped":"blackout nightly"}`))
+	if err != nil {
+		t.Fatal("legacy metadata must be decoded, got", err)
+	}
+	if metadata.Status != JOB_STATUS_SKIPPED {
+		t.Fatal("status must be skipped, not", metadata.Status)
+	}
+}
+
+func TestDecodeJobMetadata_V1StructChecksum(t *testing.T) {
+	// version 1 files were checksummed over struct encoded json
+	data := `{"JobName":"db","TaskId":"task1","Success":true,"Output":"aGVsbG8=","SchemaVersion":1,"Checksum":""}`
+	sum := sha256.Sum256([]byte(data))
+	data = strings.Replace(data, `"Checksum":""`, `"Checksum":"`+hex.EncodeToString(sum[:])+`"`, 1)
+
+	metadata, err := decodeJobMetadata([]byte(data))
+	if err != nil {
+		t.Fatal("version 1 metadata must be decoded, got", err)
+	}
+	if metadata.SourceVersion != 1 || metadata.Output.String() != "hello" {
+		t.Fatal("wrong decoded metadata", metadata.SourceVersion, metadata.Output)
+	}
+
+	tampered := strings.Replace(data, `"Success":true`, `"Success":false`, 1)
+	if _, err := decodeJobMetadata([]byte(tampered)); err == nil || err.Error() != "metadata checksum mismatch" {
+		t.Fatal("tampered version 1 metadata must fail checksum, got", err)
+	}
+}
+
+func TestMigrateMetadataDir_FullOutputMovedToBlob(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	output := strings.Repeat("0123456789", 1000)
+	data := `{"JobName":"db","TaskId":"task1","Success":true,"Output":"` +
+		base64.StdEncoding.EncodeToString([]byte(output)) + `","Errput":"b29wcw=="}`
+	ioutil.WriteFile(dir+"/task1", []byte(data), 0640)
+
+	report, err := MigrateMetadataDir(dir, false)
+	if err != nil || len(report.Migrated) != 1 {
+		t.Fatal("migration failed:", err, report)
+	}
+	metadata, err := LoadJobMetadata(dir + "/task1")
+	if err != nil {
+		t.Fatal("cannot load migrated metadata:", err)
+	}
+	if int64(len(metadata.Output)) != OUTPUT_EXCERPT_SIZE || metadata.Output.String() != output[len(output)-OUTPUT_EXCERPT_SIZE:] {
+		t.Fatal("only output tail must be kept in metadata, got", len(metadata.Output))
+	}
+	if metadata.OutputSize != int64(len(output)) {
+		t.Fatal("output size must be", len(output), "not", metadata.OutputSize)
+	}
+	if metadata.OutputLog != metadataLogDir(dir)+"/task1.output.gz" {
+		t.Fatal("wrong output log", metadata.OutputLog)
+	}
+	saved, err := readTaskLog(metadata.OutputLog)
+	if err != nil || string(saved) != output {
+		t.Fatal("full output must be saved in output log", err, len(saved))
+	}
+	if metadata.Errput.String() != "oops" || metadata.ErrputLog != "" {
+		t.Fatal("short errput must be kept in metadata", metadata.Errput, metadata.ErrputLog)
+	}
+}
+
+func TestDecodeJobMetadata_InvalidVersion(t *testing.T) {
+	_, err := decodeJobMetadata([]byte(`{"SchemaVersion":"one"}`))
+	expectedErr := "invalid metadata schema version one"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal("error must be", expectedErr, "not", err)
+	}
+}
+
+func TestMigrateMetadataDir(t *testing.T) {
+	dir, cleanup := testMetadataDir(t)
+	defer cleanup()
+	ioutil.WriteFile(dir+"/task1", []byte(legacyMetadata), 0640)
+	testMetadata().Save(dir + "/task2")
+	ioutil.WriteFile(dir+"/broken", []byte("{,wow"), 0640)
+
+	report, err := MigrateMetadataDir(dir, true)
+	if err != nil {
+		t.Fatal("dry run failed:", err)
+	}
+	if len(report.Migrated) != 1 || report.Migrated[0].Path != dir+"/task1" || report.Migrated[0].FromVersion != 0 {
+		t.Fatal("task1 must be reported for migration, got", report.Migrated)
+	}
+	if len(report.UpToDate) != 1 || len(report.Failed) != 1 || report.Failed[0].Path != dir+"/broken" {
+		t.Fatal("wrong report", report.UpToDate, report.Failed)
+	}
+	if data, _ := ioutil.ReadFile(dir + "/task1"); string(data) != legacyMetadata {
+		t.Fatal("dry run must not change files")
+	}
+
+	report, err = MigrateMetadataDir(dir, false)
+	if err != nil || len(report.Migrated) != 1 {
+		t.Fatal("migration failed:", err, report)
+	}
+	metadata, err := LoadJobMetadata(dir + "/task1")
+	if err != nil {
+		t.Fatal("cannot load migrated metadata:", err)
+	}
+	if metadata.SourceVersion != METADATA_SCHEMA_VERSION || metadata.Checksum == "" || metadata.OutputSize != 5 {
+		t.Fatal("metadata must be saved with current version", metadata.SourceVersion, metadata.Checksum, metadata.OutputSize)
+	}
+
+	report, _ = MigrateMetadataDir(dir, false)
+	if len(report.Migrated) != 0 || len(report.UpToDate) != 2 {
+		t.Fatal("migrated files must be up to date, got", report.Migrated, report.UpToDate)
+	}
+}
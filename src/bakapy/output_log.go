@@ -0,0 +1,162 @@
+package bakapy
+
+import (
+	"fmt"
+	"github.com/op/go-logging"
+	"io"
+	"os"
+	"path"
+)
+
+// TailBuffer keeps only last Size bytes written to it. Data is stored
+// in a ring which is linearized only on read.
+type TailBuffer struct {
+	Size    int64
+	data    []byte
+	start   int
+	written int64
+}
+
+func NewTailBuffer(size int64) *TailBuffer {
+	return &TailBuffer{Size: size}
+}
+
+func (b *TailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	b.written += int64(n)
+	if b.Size <= 0 {
+		return n, nil
+	}
+	if int64(len(p)) >= b.Size {
+		b.data = append(b.data[:0], p[int64(len(p))-b.Size:]...)
+		b.start = 0
+		return n, nil
+	}
+	if free := int(b.Size) - len(b.data); free > 0 {
+		if free > len(p) {
+			free = len(p)
+		}
+		b.data = append(b.data, p[:free]...)
+		p = p[free:]
+	}
+	if len(p) > 0 {
+		copied := copy(b.data[b.start:], p)
+		copy(b.data, p[copied:])
+		b.start = (b.start + len(p)) % len(b.data)
+	}
+	return n, nil
+}
+
+func (b *TailBuffer) Bytes() []byte {
+	if b.start == 0 {
+		return b.data
+	}
+	data := make([]byte, 0, len(b.data))
+	data = append(data, b.data[b.start:]...)
+	return append(data, b.data[:b.start]...)
+}
+
+func (b *TailBuffer) String() string {
+	return string(b.Bytes())
+}
+
+// Written returns total number of bytes written, including discarded
+func (b *TailBuffer) Written() int64 {
+	return b.written
+}
+
+// Truncated returns true if some written bytes were discarded
+func (b *TailBuffer) Truncated() bool {
+	return b.written > int64(len(b.data))
+}
+
+// CappedLogWriter streams first HeadSize bytes directly to the file
+// and keeps last TailSize bytes in memory until Close. Everything
+// between head and tail is skipped and replaced by a marker. File
+// write errors are logged once and further output is dropped, so
+// broken log does not interrupt the command.
+type CappedLogWriter struct {
+	HeadSize int64
+	file     io.WriteCloser
+	tail     *TailBuffer
+	written  int64
+	err      error
+}
+
+func NewCappedLogWriter(file io.WriteCloser, headSize int64, tailSize int64) *CappedLogWriter {
+	return &CappedLogWriter{
+		HeadSize: headSize,
+		file:     file,
+		tail:     NewTailBuffer(tailSize),
+	}
+}
+
+func (w *CappedLogWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if headLeft := w.HeadSize - w.written; headLeft > 0 {
+		head := p
+		if int64(len(head)) > headLeft {
+			head = head[:headLeft]
+		}
+		if w.err == nil {
+			if _, err := w.file.Write(head); err != nil {
+				w.fail(err)
+			}
+		}
+		w.written += int64(len(head))
+		p = p[len(head):]
+	}
+	if len(p) > 0 {
+		w.tail.Write(p)
+	}
+	return n, nil
+}
+
+func (w *CappedLogWriter) fail(err error) {
+	w.err = err
+	logging.MustGetLogger("bakapy.job").Warning("cannot write output log, only excerpt will be saved: %s", err)
+}
+
+// Err returns first file write error
+func (w *CappedLogWriter) Err() error {
+	return w.err
+}
+
+// Close writes collected tail to the file and closes it. Tail is not
+// written if log already failed.
+func (w *CappedLogWriter) Close() error {
+	if w.err != nil {
+		w.file.Close()
+		return nil
+	}
+	if w.tail.Truncated() {
+		skipped := w.tail.Written() - int64(len(w.tail.Bytes()))
+		if _, err := fmt.Fprintf(w.file, "\n[... %d bytes skipped ...]\n", skipped); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	if _, err := w.file.Write(w.tail.Bytes()); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// Written returns total number of bytes written, including skipped
+func (w *CappedLogWriter) Written() int64 {
+	return w.written + w.tail.Written()
+}
+
+func CreateOutputLog(logDir string, taskId TaskId, stream string, cfg OutputLogConfig) (*CappedLogWriter, string, error) {
+	err := os.MkdirAll(logDir, 0750)
+	if err != nil {
+		return nil, "", err
+	}
+	logPath := path.Join(logDir, fmt.Sprintf("%s.%s.gz", taskId, stream))
+	file, err := createBlob(logPath)
+	if err != nil {
+		return nil, "", err
+	}
+	return NewCappedLogWriter(file, cfg.GetHeadSize(), cfg.GetTailSize()), logPath, nil
+}
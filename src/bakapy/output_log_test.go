@@ -0,0 +1,191 @@
+package bakapy
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type nopWriteCloser struct {
+	data   []byte
+	closed bool
+}
+
+func (w *nopWriteCloser) Write(p []byte) (int, error) {
+	w.data = append(w.data, p...)
+	return len(p), nil
+}
+
+func (w *nopWriteCloser) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestTailBuffer_KeepsLastBytes(t *testing.T) {
+	buf := NewTailBuffer(5)
+	buf.Write([]byte("abc"))
+	buf.Write([]byte("defg"))
+	if buf.String() != "cdefg" {
+		t.Fatal("buffer must contain 'cdefg' not", buf.String())
+	}
+	if buf.Written() != 7 {
+		t.Fatal("written must be 7 not", buf.Written())
+	}
+	if !buf.Truncated() {
+		t.Fatal("buffer must be truncated")
+	}
+	buf.Write([]byte("0123456789"))
+	if buf.String() != "56789" {
+		t.Fatal("buffer must contain '56789' not", buf.String())
+	}
+}
+
+func TestTailBuffer_Wraparound(t *testing.T) {
+	buf := NewTailBuffer(5)
+	for _, chunk := range []string{"ab", "cd", "ef", "g", "hij", "k"} {
+		buf.Write([]byte(chunk))
+	}
+	if buf.String() != "ghijk" {
+		t.Fatal("buffer must contain 'ghijk' not", buf.String())
+	}
+	buf.Write([]byte("lmnop"))
+	if buf.String() != "lmnop" {
+		t.Fatal("buffer must contain 'lmnop' not", buf.String())
+	}
+	buf.Write([]byte("q"))
+	if string(buf.Bytes()) != "mnopq" {
+		t.Fatal("buffer must contain 'mnopq' not", string(buf.Bytes()))
+	}
+}
+
+func TestTailBuffer_NotTruncated(t *testing.T) {
+	buf := NewTailBuffer(5)
+	buf.Write([]byte("abc"))
+	if buf.String() != "abc" {
+		t.Fatal("buffer must contain 'abc' not", buf.String())
+	}
+	if buf.Truncated() {
+		t.Fatal("buffer must not be truncated")
+	}
+}
+
+func TestCappedLogWriter_Small(t *testing.T) {
+	file := &nopWriteCloser{}
+	w := NewCappedLogWriter(file, 10, 10)
+	w.Write([]byte("hello"))
+	w.Write([]byte(" world"))
+	if err := w.Close(); err != nil {
+		t.Fatal("Error:", err)
+	}
+	if string(file.data) != "hello world" {
+		t.Fatalf("log must be 'hello world' not '%s'", file.data)
+	}
+	if !file.closed {
+		t.Fatal("file must be closed")
+	}
+	if w.Written() != 11 {
+		t.Fatal("written must be 11 not", w.Written())
+	}
+}
+
+func TestCappedLogWriter_HeadAndTail(t *testing.T) {
+	file := &nopWriteCloser{}
+	w := NewCappedLogWriter(file, 4, 3)
+	w.Write([]byte("0123456"))
+	w.Write([]byte("789"))
+	if string(file.data) != "0123" {
+		t.Fatalf("head must be streamed before close, got '%s'", file.data)
+	}
+	w.Close()
+	expected := "0123\n[... 3 bytes skipped ...]\n789"
+	if string(file.data) != expected {
+		t.Fatalf("log must be '%s' not '%s'", expected, file.data)
+	}
+	if w.Written() != 10 {
+		t.Fatal("written must be 10 not", w.Written())
+	}
+}
+
+type failingWriteCloser struct {
+	writes int
+}
+
+func (w *failingWriteCloser) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, errors.New("no space left on device")
+}
+
+func (w *failingWriteCloser) Close() error {
+	return nil
+}
+
+func TestCappedLogWriter_FileErrorDoesNotFailOutput(t *testing.T) {
+	file := &failingWriteCloser{}
+	log := NewCappedLogWriter(file, 10, 10)
+	excerpt := NewTailBuffer(100)
+	out := teeOutputLog(excerpt, log)
+	for _, chunk := range []string{"hello ", "world"} {
+		if _, err := out.Write([]byte(chunk)); err != nil {
+			t.Fatal("log write error must not be returned, got", err)
+		}
+	}
+	if excerpt.String() != "hello world" {
+		t.Fatal("excerpt must be kept, got", excerpt.String())
+	}
+	if log.Err() == nil || file.writes != 1 {
+		t.Fatal("log must stop writing after first error", log.Err(), file.writes)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal("close must not report already logged error, got", err)
+	}
+}
+
+func TestJob_Run_OutputLogCreated(t *testing.T) {
+	logDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(logDir)
+
+	cfg := &JobConfig{Command: "utils.go"}
+	job := NewJob(
+		"test", cfg, "127.0.0.1:9999",
+		".", &TestJober{}, &TestOutputExecutor{},
+	)
+	job.LogDir = logDir
+	job.OutputLog = OutputLogConfig{HeadSize: 3, TailSize: 3}
+
+	m := job.Run()
+	if !m.Success {
+		t.Fatal("m.Success must be true. Message", m.Message)
+	}
+	if m.OutputLog != path.Join(logDir, string(job.TaskId)+".output.gz") {
+		t.Fatal("wrong m.OutputLog", m.OutputLog)
+	}
+	content, err := readTaskLog(m.OutputLog)
+	if err != nil {
+		t.Fatal("cannot read output log:", err)
+	}
+	if string(content) != "hel\n[... 5 bytes skipped ...]\nrld" {
+		t.Fatalf("wrong output log content '%s'", content)
+	}
+	if string(m.Output) != "hello world" {
+		t.Fatalf("m.Output must be 'hello world' not '%s'", m.Output)
+	}
+	if m.OutputSize != 11 {
+		t.Fatal("m.OutputSize must be 11 not", m.OutputSize)
+	}
+	content, err = readTaskLog(m.ErrputLog)
+	if err != nil {
+		t.Fatal("cannot read errput log:", err)
+	}
+	if string(content) != "oops" {
+		t.Fatalf("wrong errput log content '%s'", content)
+	}
+	if m.ScriptBlob != path.Join(logDir, string(job.TaskId)+".script.gz") || m.Script == nil {
+		t.Fatal("wrong m.ScriptBlob", m.ScriptBlob)
+	}
+	script, err := readTaskLog(m.ScriptBlob)
+	if err != nil || string(script) != string(m.Script) {
+		t.Fatal("script blob must contain job script, got", err)
+	}
+}
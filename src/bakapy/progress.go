@@ -0,0 +1,144 @@
+package bakapy
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type TransferProgress struct {
+	Filename   string
+	RemoteAddr string
+	StartTime  time.Time
+	Bytes      int64
+	Throughput int64 // bytes per second
+}
+
+type TaskProgress struct {
+	TaskId    TaskId
+	JobName   string
+	Namespace string
+	StartTime time.Time
+	Bytes     int64
+	Transfers []TransferProgress
+}
+
+type TaskProgressSortByStartTime []TaskProgress
+
+func (slice TaskProgressSortByStartTime) Len() int {
+	return len(slice)
+}
+
+func (slice TaskProgressSortByStartTime) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+func (slice TaskProgressSortByStartTime) Less(i, j int) bool {
+	return slice[i].StartTime.Before(slice[j].StartTime)
+}
+
+// ProgressTransfer counts bytes of single file being received.
+// It must be finished after file received.
+type ProgressTransfer struct {
+	taskId     TaskId
+	filename   string
+	remoteAddr string
+	startTime  time.Time
+	bytes      int64
+	registry   *ProgressRegistry
+}
+
+func (t *ProgressTransfer) Write(p []byte) (int, error) {
+	atomic.AddInt64(&t.bytes, int64(len(p)))
+	return len(p), nil
+}
+
+func (t *ProgressTransfer) Finish() {
+	t.registry.finishTransfer(t)
+}
+
+func (t *ProgressTransfer) progress(now time.Time) TransferProgress {
+	p := TransferProgress{
+		Filename:   t.filename,
+		RemoteAddr: t.remoteAddr,
+		StartTime:  t.startTime,
+		Bytes:      atomic.LoadInt64(&t.bytes),
+	}
+	if seconds := now.Sub(t.startTime).Seconds(); seconds >= 1 {
+		p.Throughput = int64(float64(p.Bytes) / seconds)
+	}
+	return p
+}
+
+// ProgressRegistry keeps live state of files being received by storage
+type ProgressRegistry struct {
+	mu        sync.Mutex
+	transfers map[*ProgressTransfer]bool
+}
+
+func NewProgressRegistry() *ProgressRegistry {
+	return &ProgressRegistry{
+		transfers: make(map[*ProgressTransfer]bool),
+	}
+}
+
+func (r *ProgressRegistry) StartTransfer(taskId TaskId, filename string, remoteAddr string) *ProgressTransfer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := &ProgressTransfer{
+		taskId:     taskId,
+		filename:   filename,
+		remoteAddr: remoteAddr,
+		startTime:  time.Now(),
+		registry:   r,
+	}
+	r.transfers[t] = true
+	return t
+}
+
+func (r *ProgressRegistry) finishTransfer(t *ProgressTransfer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.transfers, t)
+}
+
+// Transfers returns active transfers grouped by task id
+func (r *ProgressRegistry) Transfers() map[TaskId][]TransferProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	result := make(map[TaskId][]TransferProgress)
+	for t := range r.transfers {
+		result[t.taskId] = append(result[t.taskId], t.progress(now))
+	}
+	return result
+}
+
+// TaskProgress returns running tasks with their active transfers
+func (stor *Storage) TaskProgress() []TaskProgress {
+	transfers := stor.Progress.Transfers()
+	tasks := []TaskProgress{}
+	for _, job := range stor.Jobs() {
+		tasks = append(tasks, TaskProgress{
+			TaskId:    job.TaskId,
+			JobName:   job.JobName,
+			Namespace: job.Namespace,
+			StartTime: job.StartTime,
+		})
+	}
+	// Task may be already removed from storage but still sending files
+	for taskId := range transfers {
+		if _, exist := stor.GetJob(taskId); !exist {
+			tasks = append(tasks, TaskProgress{TaskId: taskId})
+		}
+	}
+	for idx := range tasks {
+		tasks[idx].Transfers = transfers[tasks[idx].TaskId]
+		for _, t := range tasks[idx].Transfers {
+			tasks[idx].Bytes += t.Bytes
+		}
+	}
+	sort.Sort(TaskProgressSortByStartTime(tasks))
+	return tasks
+}
@@ -0,0 +1,129 @@
+package bakapy
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/op/go-logging"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type progressCheckWriter struct {
+	registry  *ProgressRegistry
+	transfers map[TaskId][]TransferProgress
+}
+
+func (w *progressCheckWriter) Write(p []byte) (int, error) {
+	w.transfers = w.registry.Transfers()
+	return len(p), nil
+}
+
+func TestProgressRegistry_Transfers(t *testing.T) {
+	registry := NewProgressRegistry()
+	transfer := registry.StartTransfer(TaskId("task1"), "wow.txt", "1.1.1.1:1234")
+	transfer.Write([]byte("hello"))
+	transfer.Write([]byte("world"))
+
+	transfers := registry.Transfers()
+	if len(transfers[TaskId("task1")]) != 1 {
+		t.Fatal("must be 1 transfer for task1, got", transfers)
+	}
+	p := transfers[TaskId("task1")][0]
+	if p.Filename != "wow.txt" {
+		t.Fatal("p.Filename must be 'wow.txt' not", p.Filename)
+	}
+	if p.RemoteAddr != "1.1.1.1:1234" {
+		t.Fatal("p.RemoteAddr must be '1.1.1.1:1234' not", p.RemoteAddr)
+	}
+	if p.Bytes != 10 {
+		t.Fatal("p.Bytes must be 10 not", p.Bytes)
+	}
+
+	transfer.Finish()
+	if len(registry.Transfers()) != 0 {
+		t.Fatal("transfer must be removed after finish")
+	}
+}
+
+func TestProgressTransfer_Throughput(t *testing.T) {
+	transfer := &ProgressTransfer{startTime: time.Now().Add(-time.Second * 4), bytes: 400}
+	p := transfer.progress(transfer.startTime.Add(time.Second * 4))
+	if p.Throughput != 100 {
+		t.Fatal("p.Throughput must be 100 not", p.Throughput)
+	}
+}
+
+func TestStorageConn_ReadContent_ProgressPublished(t *testing.T) {
+	taskId := "a70cb394-c22d-4fe7-a5cc-bc0a5e19a24c"
+	reader := &DummyReader{data: []byte(taskId + "0007wow.txthello")}
+	conn := NewStorageConn(reader, logging.MustGetLogger("connection.test"))
+	conn.Progress = NewProgressRegistry()
+	conn.ReadTaskId()
+	conn.ReadFilename()
+
+	output := &progressCheckWriter{registry: conn.Progress}
+	_, err := conn.ReadContent(output)
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	transfers := output.transfers[TaskId(taskId)]
+	if len(transfers) != 1 || transfers[0].Filename != "wow.txt" {
+		t.Fatal("transfer must be published while reading, got", output.transfers)
+	}
+	if len(conn.Progress.Transfers()) != 0 {
+		t.Fatal("transfer must be removed after content read")
+	}
+}
+
+func TestStorage_TaskProgress(t *testing.T) {
+	storage := NewStorage(NewConfig())
+	storage.AddJob(&StorageCurrentJob{
+		TaskId:    TaskId("task1"),
+		JobName:   "wow",
+		Namespace: "one",
+		StartTime: time.Now(),
+	})
+	transfer := storage.Progress.StartTransfer(TaskId("task1"), "wow.txt", "1.1.1.1:1234")
+	transfer.Write([]byte("hello"))
+	storage.Progress.StartTransfer(TaskId("task2"), "late.txt", "1.1.1.1:1235")
+
+	tasks := storage.TaskProgress()
+	if len(tasks) != 2 {
+		t.Fatal("must be 2 tasks, got", tasks)
+	}
+	// task2 has no start time and sorted first
+	if tasks[0].TaskId != TaskId("task2") || len(tasks[0].Transfers) != 1 {
+		t.Fatal("wrong task2 progress", tasks[0])
+	}
+	if tasks[1].JobName != "wow" || tasks[1].Bytes != 5 {
+		t.Fatal("wrong task1 progress", tasks[1])
+	}
+}
+
+func TestStatusServer_Progress(t *testing.T) {
+	storage := NewStorage(NewConfig())
+	storage.AddJob(&StorageCurrentJob{TaskId: TaskId("task1"), JobName: "wow"})
+	server := NewStatusServer(NewConfig(), storage)
+
+	req, _ := http.NewRequest("GET", "/progress", nil)
+	resp := httptest.NewRecorder()
+	server.ServeHTTP(resp, req)
+
+	var tasks []TaskProgress
+	if err := json.NewDecoder(bytes.NewReader(resp.Body.Bytes())).Decode(&tasks); err != nil {
+		t.Fatal("cannot decode response:", err, resp.Body.String())
+	}
+	if len(tasks) != 1 || tasks[0].JobName != "wow" {
+		t.Fatal("wrong response", resp.Body.String())
+	}
+}
+
+func TestStatusServer_Start_ListenError(t *testing.T) {
+	cfg := NewConfig()
+	cfg.StatusListen = "256.0.0.1:1"
+	if err := NewStatusServer(cfg, NewStorage(cfg)).Start(); err == nil {
+		t.Fatal("listen error must be returned")
+	}
+}
@@ -0,0 +1,92 @@
+package bakapy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// processIdentity returns boot id and start time of process, which
+// together with pid identify it across pid reuse and reboots. Empty
+// if /proc is not available.
+func processIdentity(pid int) string {
+	bootId, err := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return ""
+	}
+	// command name in parentheses may contain spaces, start time is
+	// 22nd field, 20th after it
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	if len(fields) < 20 {
+		return ""
+	}
+	return strings.TrimSpace(string(bootId)) + "/" + fields[19]
+}
+
+// processAlive reports whether process with pid and identity saved by
+// processIdentity exists. Current process has no tasks before recovery,
+// so its pid is left from previous run. Empty identity (metadata saved
+// by older versions) is not checked.
+func processAlive(pid int, identity string) bool {
+	if pid <= 0 || pid == os.Getpid() {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	if err != nil && err != syscall.EPERM {
+		return false
+	}
+	return identity == "" || processIdentity(pid) == identity
+}
+
+// markInterrupted marks running task metadata as interrupted, task is
+// considered ended at last metadata or file update
+func (metadata *JobMetadata) markInterrupted(lastUpdate time.Time) {
+	metadata.Status = JOB_STATUS_INTERRUPTED
+	metadata.Success = false
+	metadata.Message = fmt.Sprintf("interrupted: process %d stopped while task was running", metadata.Pid)
+	metadata.EndTime = lastUpdate.In(metadata.StartTime.Location())
+	for _, fileMeta := range metadata.Files {
+		if fileMeta.EndTime.After(metadata.EndTime) {
+			metadata.EndTime = fileMeta.EndTime
+		}
+	}
+}
+
+// RecoverInterruptedTasks marks tasks left with running status by stopped
+// scheduler as interrupted. File lists are kept, so retention removes
+// received files. Tasks of alive processes (like bakapy-run-job) are skipped.
+func RecoverInterruptedTasks(gConfig *Config) ([]*JobMetadata, error) {
+	files, err := ioutil.ReadDir(gConfig.MetadataDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	recovered := []*JobMetadata{}
+	for _, f := range files {
+		if f.IsDir() || isTempFile(f.Name()) {
+			continue
+		}
+		metaPath := path.Join(gConfig.MetadataDir, f.Name())
+		metadata, err := LoadJobMetadata(metaPath)
+		if err != nil || metadata.Status != JOB_STATUS_RUNNING || processAlive(metadata.Pid, metadata.PidIdentity) {
+			continue
+		}
+		metadata.markInterrupted(f.ModTime())
+		if err := metadata.Save(metaPath); err != nil {
+			return recovered, err
+		}
+		metadata.Filepath = metaPath
+		recovered = append(recovered, metadata)
+	}
+	return recovered, nil
+}
@@ -0,0 +1,148 @@
+package bakapy
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestJob_Run_ProgressSaved(t *testing.T) {
+	cfg := &JobConfig{Command: "utils.go", Namespace: "wow"}
+	job := NewJob(
+		"test", cfg, "127.0.0.1:9999",
+		".", &TestJoberPushFile{}, &TestOkExecutor{},
+	)
+	snapshots := []JobMetadata{}
+	job.OnProgress = func(m *JobMetadata) {
+		snapshots = append(snapshots, *m)
+	}
+
+	m := job.Run()
+
+	if len(snapshots) != 3 {
+		t.Fatal("progress must be reported at start and for 2 files, got", len(snapshots))
+	}
+	if snapshots[0].Status != JOB_STATUS_RUNNING || len(snapshots[0].Files) != 0 {
+		t.Fatal("first snapshot must be running without files")
+	}
+	if len(snapshots[2].Files) != 2 || snapshots[2].TotalSize != 1234+12345 {
+		t.Fatal("last snapshot must have 2 files, got", snapshots[2].Files)
+	}
+	if m.Status != JOB_STATUS_FINISHED {
+		t.Fatal("m.Status must be finished not", m.Status)
+	}
+}
+
+func TestJob_Run_OutputProgressThrottled(t *testing.T) {
+	cfg := &JobConfig{Command: "utils.go", Namespace: "wow"}
+	job := NewJob(
+		"test", cfg, "127.0.0.1:9999",
+		".", &TestJober{}, &TestOutputExecutor{},
+	)
+	snapshots := []JobMetadata{}
+	job.OnProgress = func(m *JobMetadata) {
+		snapshots = append(snapshots, *m)
+	}
+
+	job.Run()
+
+	if len(snapshots) != 2 {
+		t.Fatal("progress must be reported at start and once for output, got", len(snapshots))
+	}
+	if snapshots[1].OutputSize != int64(len("hello world")) {
+		t.Fatal("output snapshot must have output size 11, got", snapshots[1].OutputSize)
+	}
+}
+
+func TestRunJob_RunningMetadataSaved(t *testing.T) {
+	gConfig := newTestSchedulerConfig()
+	defer removeTestSchedulerConfig(gConfig)
+	executor := &TestBlockExecutor{release: make(chan struct{})}
+	jConfig := &JobConfig{Command: "wow.cmd", executor: executor}
+	storage := NewStorage(gConfig)
+
+	done := make(chan *JobMetadata)
+	go func() {
+		done <- RunJob("slow", jConfig, gConfig, storage, JobTrigger{Reason: RUN_REASON_MANUAL})
+	}()
+	for len(storage.Running.Tasks()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	taskId := storage.Running.Tasks()[0].TaskId
+	metaPath := path.Join(gConfig.MetadataDir, string(taskId))
+	var saved *JobMetadata
+	for i := 0; i < 100; i++ {
+		if saved, _ = LoadJobMetadata(metaPath); saved != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if saved == nil || saved.Status != JOB_STATUS_RUNNING || saved.RunReason != RUN_REASON_MANUAL {
+		t.Fatal("running task metadata must be saved at start, got", saved)
+	}
+
+	close(executor.release)
+	metadata := <-done
+	saved, _ = LoadJobMetadata(metaPath)
+	if saved.Status != JOB_STATUS_FINISHED || saved.TaskId != metadata.TaskId {
+		t.Fatal("finished metadata must replace running one, got", saved.Status)
+	}
+}
+
+func TestRecoverInterruptedTasks(t *testing.T) {
+	gConfig := newTestSchedulerConfig()
+	defer removeTestSchedulerConfig(gConfig)
+
+	files := []JobMetadataFile{{Name: "wow/1.txt", Size: 10, EndTime: time.Now().Add(time.Hour)}}
+	interrupted := &JobMetadata{JobName: "www", TaskId: "task1", Status: JOB_STATUS_RUNNING, Pid: os.Getpid(), Files: files}
+	finished := &JobMetadata{JobName: "www", TaskId: "task2", Status: JOB_STATUS_FINISHED, Success: true}
+	interrupted.Save(path.Join(gConfig.MetadataDir, "task1"))
+	finished.Save(path.Join(gConfig.MetadataDir, "task2"))
+
+	recovered, err := RecoverInterruptedTasks(gConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered) != 1 || recovered[0].TaskId != "task1" {
+		t.Fatal("only task1 must be recovered, got", recovered)
+	}
+	saved, _ := LoadJobMetadata(path.Join(gConfig.MetadataDir, "task1"))
+	if saved.Status != JOB_STATUS_INTERRUPTED || saved.Success || len(saved.Files) != 1 {
+		t.Fatal("wrong recovered metadata", saved.Status, saved.Success, saved.Files)
+	}
+	if !saved.EndTime.Equal(files[0].EndTime) {
+		t.Fatal("end time must be taken from last file, not", saved.EndTime)
+	}
+
+	os.RemoveAll(gConfig.MetadataDir)
+	os.RemoveAll(MetadataJournalDir(gConfig.MetadataDir))
+	if recovered, err := RecoverInterruptedTasks(gConfig); err != nil || len(recovered) != 0 {
+		t.Fatal("missing metadata dir must not be an error", recovered, err)
+	}
+}
+
+func TestProcessAlive_Identity(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	pid := cmd.Process.Pid
+
+	identity := processIdentity(pid)
+	if identity == "" {
+		t.Skip("process identity is not available")
+	}
+	if !processAlive(pid, identity) {
+		t.Fatal("process with same identity must be alive")
+	}
+	if !processAlive(pid, "") {
+		t.Fatal("process without saved identity must be alive")
+	}
+	if processAlive(pid, "other-boot/1") {
+		t.Fatal("process with reused pid must not be alive")
+	}
+}
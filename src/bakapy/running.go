@@ -0,0 +1,199 @@
+package bakapy
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RunningTask is task started but not finished yet
+type RunningTask struct {
+	JobName   string
+	TaskId    TaskId
+	StartTime time.Time
+	Trigger   JobTrigger
+	config    *JobConfig
+	// leader of running command process group, 0 if none
+	pid      int
+	aborted  bool
+	finished bool
+}
+
+// RunningTasks tracks tasks in progress for graceful shutdown
+type RunningTasks struct {
+	tasks  map[TaskId]*RunningTask
+	closed bool
+	lock   sync.Mutex
+	wg     sync.WaitGroup
+}
+
+func NewRunningTasks() *RunningTasks {
+	return &RunningTasks{tasks: map[TaskId]*RunningTask{}}
+}
+
+func (r *RunningTasks) Add(jobName string, taskId TaskId, jobConfig *JobConfig, trigger JobTrigger) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.wg.Add(1)
+	r.tasks[taskId] = &RunningTask{
+		JobName:   jobName,
+		TaskId:    taskId,
+		StartTime: time.Now().In(jobConfig.Location()),
+		Trigger:   trigger,
+		config:    jobConfig,
+	}
+}
+
+// Hold registers job about to be started, so Wait waits for it too.
+// Returns false after Close, job must not be started then. Successful
+// Hold must be paired with Release.
+func (r *RunningTasks) Hold() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return false
+	}
+	r.wg.Add(1)
+	return true
+}
+
+func (r *RunningTasks) Release() {
+	r.wg.Done()
+}
+
+// Close forbids new Hold calls, jobs held before are still waited for
+func (r *RunningTasks) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+}
+
+func (r *RunningTasks) Done(taskId TaskId) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, exist := r.tasks[taskId]; !exist {
+		return
+	}
+	delete(r.tasks, taskId)
+	r.wg.Done()
+}
+
+// SetPid records process group of command started by task, it is
+// killed by Abort. Zero pid means command exited.
+func (r *RunningTasks) SetPid(taskId TaskId, pid int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if task, exist := r.tasks[taskId]; exist {
+		task.pid = pid
+	}
+}
+
+// Progress calls save while task is neither finished nor aborted
+func (r *RunningTasks) Progress(taskId TaskId, save func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if task, exist := r.tasks[taskId]; exist && (task.aborted || task.finished) {
+		return
+	}
+	save()
+}
+
+// Finish calls save with final task metadata unless task was aborted.
+// Finish and Abort are serialized, only one of them saves metadata.
+// Returns false if task was aborted.
+func (r *RunningTasks) Finish(taskId TaskId, save func()) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	task, exist := r.tasks[taskId]
+	if exist {
+		if task.aborted {
+			return false
+		}
+		task.finished = true
+	}
+	save()
+	return true
+}
+
+// Abort kills command of not finished task and calls save with its
+// aborted metadata. Returns false if task finished already.
+func (r *RunningTasks) Abort(taskId TaskId, save func()) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	task, exist := r.tasks[taskId]
+	if !exist || task.finished {
+		return false
+	}
+	task.aborted = true
+	if task.pid > 0 {
+		syscall.Kill(-task.pid, syscall.SIGKILL)
+	}
+	save()
+	return true
+}
+
+// Tasks returns running tasks sorted by start time
+func (r *RunningTasks) Tasks() []RunningTask {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	tasks := make([]RunningTask, 0, len(r.tasks))
+	for _, task := range r.tasks {
+		tasks = append(tasks, *task)
+	}
+	sort.Sort(RunningTaskSortByStartTime(tasks))
+	return tasks
+}
+
+type RunningTaskSortByStartTime []RunningTask
+
+func (slice RunningTaskSortByStartTime) Len() int {
+	return len(slice)
+}
+
+func (slice RunningTaskSortByStartTime) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+func (slice RunningTaskSortByStartTime) Less(i, j int) bool {
+	return slice[i].StartTime.Before(slice[j].StartTime)
+}
+
+// Wait waits for all running tasks up to timeout.
+// Returns true if all tasks finished.
+func (r *RunningTasks) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// AbortedMetadata returns metadata for task killed before finish
+func (task *RunningTask) AbortedMetadata(reason string) *JobMetadata {
+	metadata := &JobMetadata{
+		JobName:   task.JobName,
+		Namespace: task.config.Namespace,
+		TaskId:    task.TaskId,
+		Pid:       os.Getpid(),
+		Command:   task.config.Command,
+		Config:    task.config.Masked(),
+		StartTime: task.StartTime,
+		EndTime:   time.Now().In(task.config.Location()),
+		Timezone:  task.config.Location().String(),
+		Aborted:   true,
+		Status:    JOB_STATUS_ABORTED,
+		Message:   fmt.Sprintf("aborted: %s", reason),
+	}
+	metadata.ExpireTime = metadata.StartTime.Add(task.config.MaxAge)
+	metadata.SetTrigger(task.Trigger)
+	return metadata
+}
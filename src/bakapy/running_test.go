@@ -0,0 +1,123 @@
+package bakapy
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+type TestBlockExecutor struct {
+	release chan struct{}
+}
+
+func (e *TestBlockExecutor) Execute(script []byte, output io.Writer, errput io.Writer) (*ExecutionResult, error) {
+	<-e.release
+	return &ExecutionResult{}, nil
+}
+
+func TestRunningTasks_Wait(t *testing.T) {
+	running := NewRunningTasks()
+	running.Add("www", TaskId("task1"), &JobConfig{}, JobTrigger{})
+	if running.Wait(10 * time.Millisecond) {
+		t.Fatal("wait must time out while task is running")
+	}
+	running.Done(TaskId("task1"))
+	running.Done(TaskId("task1"))
+	if !running.Wait(time.Second) {
+		t.Fatal("wait must succeed after task is done")
+	}
+}
+
+func TestRunningTasks_HoldAfterClose(t *testing.T) {
+	running := NewRunningTasks()
+	if !running.Hold() {
+		t.Fatal("hold must succeed before close")
+	}
+	running.Close()
+	if running.Hold() {
+		t.Fatal("hold must fail after close")
+	}
+	if running.Wait(10 * time.Millisecond) {
+		t.Fatal("wait must time out while held job is running")
+	}
+	running.Release()
+	if !running.Wait(time.Second) {
+		t.Fatal("wait must succeed after held job released")
+	}
+}
+
+func TestScheduler_Shutdown_AbortsRunningTasks(t *testing.T) {
+	gConfig := newTestSchedulerConfig()
+	defer removeTestSchedulerConfig(gConfig)
+	executor := &TestBlockExecutor{release: make(chan struct{})}
+	gConfig.Jobs["slow"] = &JobConfig{Command: "wow.cmd", Namespace: "slow", executor: executor}
+
+	scheduler := NewScheduler(gConfig, NewStorage(gConfig))
+	done := make(chan struct{})
+	go func() {
+		scheduler.RunJob("slow", JobTrigger{Reason: RUN_REASON_SCHEDULE})
+		close(done)
+	}()
+	// job saves metadata after release, let it finish before dirs removed
+	defer func() {
+		close(executor.release)
+		<-done
+	}()
+	for len(scheduler.storage.Running.Tasks()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	task := scheduler.storage.Running.Tasks()[0]
+
+	aborted := scheduler.Shutdown(50 * time.Millisecond)
+	if aborted != 1 {
+		t.Fatal("aborted tasks count must be 1 not", aborted)
+	}
+	metadata, err := LoadJobMetadata(gConfig.MetadataDir + "/" + string(task.TaskId))
+	if err != nil {
+		t.Fatal("cannot load aborted task metadata:", err)
+	}
+	if !metadata.Aborted || metadata.Success || metadata.JobName != "slow" {
+		t.Fatal("wrong aborted metadata", metadata.Aborted, metadata.Success, metadata.JobName)
+	}
+	if scheduler.RunJob("slow", JobTrigger{Reason: RUN_REASON_MANUAL}) != nil {
+		t.Fatal("jobs must not be started after shutdown")
+	}
+}
+
+func TestScheduler_Shutdown_KillsRunningCommand(t *testing.T) {
+	gConfig := newTestSchedulerConfig()
+	defer removeTestSchedulerConfig(gConfig)
+	ioutil.WriteFile(gConfig.CommandDir+"/sleep.cmd", []byte("sleep 30\n"), 0644)
+	gConfig.Jobs["slow"] = &JobConfig{Command: "sleep.cmd", Namespace: "slow"}
+
+	scheduler := NewScheduler(gConfig, NewStorage(gConfig))
+	done := make(chan *JobMetadata)
+	go func() {
+		done <- scheduler.RunJob("slow", JobTrigger{Reason: RUN_REASON_SCHEDULE})
+	}()
+	for {
+		tasks := scheduler.storage.Running.Tasks()
+		if len(tasks) != 0 && tasks[0].pid != 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	task := scheduler.storage.Running.Tasks()[0]
+
+	if aborted := scheduler.Shutdown(50 * time.Millisecond); aborted != 1 {
+		t.Fatal("aborted tasks count must be 1 not", aborted)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command must be killed on shutdown")
+	}
+	metadata, err := LoadJobMetadata(gConfig.MetadataDir + "/" + string(task.TaskId))
+	if err != nil {
+		t.Fatal("cannot load aborted task metadata:", err)
+	}
+	if metadata.Status != JOB_STATUS_ABORTED {
+		t.Fatal("aborted metadata must not be overwritten by finished job, status", metadata.Status)
+	}
+}
@@ -0,0 +1,150 @@
+package bakapy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/robfig/cron"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Value ranges of scheduler fields used for hashed values,
+// day of month limited to 28 to exist in every month.
+var SCHEDULE_FIELD_RANGES = [6][2]int{{0, 59}, {0, 59}, {0, 23}, {1, 28}, {1, 12}, {0, 6}}
+
+var HASHED_FIELD_RE = regexp.MustCompile(`^H(\((\d+)-(\d+)\))?(/(\d+))?$`)
+
+// hashedValue returns stable pseudo-random number for seed
+func hashedValue(seed string, field int) int {
+	h := fnv.New32a()
+	h.Write([]byte(fmt.Sprintf("%s/%d", seed, field)))
+	return int(h.Sum32() & 0x7fffffff)
+}
+
+// resolveHashedField replaces H expressions in one scheduler field.
+// Supported forms are H, H(min-max), H/step and H(min-max)/step.
+func resolveHashedField(value string, field int, seed string) (string, error) {
+	if !strings.Contains(value, "H") {
+		return value, nil
+	}
+	parts := strings.Split(value, ",")
+	for idx, part := range parts {
+		if !strings.HasPrefix(part, "H") {
+			continue
+		}
+		match := HASHED_FIELD_RE.FindStringSubmatch(part)
+		if match == nil {
+			return "", errors.New(fmt.Sprintf("invalid hashed value '%s'", part))
+		}
+		low, high := SCHEDULE_FIELD_RANGES[field][0], SCHEDULE_FIELD_RANGES[field][1]
+		if match[1] != "" {
+			low, _ = strconv.Atoi(match[2])
+			high, _ = strconv.Atoi(match[3])
+			if low > high || low < SCHEDULE_FIELD_RANGES[field][0] || high > SCHEDULE_FIELD_RANGES[field][1] {
+				return "", errors.New(fmt.Sprintf("invalid hashed range '%s'", part))
+			}
+		}
+		hash := hashedValue(seed, field)
+		if match[4] == "" {
+			parts[idx] = strconv.Itoa(low + hash%(high-low+1))
+			continue
+		}
+		step, _ := strconv.Atoi(match[5])
+		if step == 0 {
+			return "", errors.New(fmt.Sprintf("invalid hashed step '%s'", part))
+		}
+		parts[idx] = fmt.Sprintf("%d-%d/%d", low+hash%step, high, step)
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// ResolveHashes replaces H values with numbers derived from seed (job name),
+// so jobs with the same schedule start at different but stable times.
+func (r *RunAtSpec) ResolveHashes(seed string) error {
+	if len(r.Specs) == 0 {
+		fields := []*string{&r.Second, &r.Minute, &r.Hour, &r.Day, &r.Month, &r.Weekday}
+		for idx, value := range fields {
+			resolved, err := resolveHashedField(*value, idx, seed)
+			if err != nil {
+				return errors.New("run_at: " + err.Error())
+			}
+			*value = resolved
+		}
+		return nil
+	}
+	// specs may be shared with other matrix sub-jobs
+	specs := make([]string, len(r.Specs))
+	for specIdx, spec := range r.Specs {
+		if strings.HasPrefix(spec, "@") {
+			specs[specIdx] = spec
+			continue
+		}
+		fields := strings.Fields(spec)
+		for idx := range fields {
+			resolved, err := resolveHashedField(fields[idx], idx, seed)
+			if err != nil {
+				return errors.New(fmt.Sprintf("run_at: '%s': %s", spec, err))
+			}
+			fields[idx] = resolved
+		}
+		specs[specIdx] = strings.Join(fields, " ")
+	}
+	r.Specs = specs
+	return nil
+}
+
+type NextRun struct {
+	JobName  string
+	Spec     string
+	Location *time.Location
+	Jitter   time.Duration
+	Time     time.Time
+}
+
+type NextRunSortByTime []NextRun
+
+func (slice NextRunSortByTime) Len() int {
+	return len(slice)
+}
+
+func (slice NextRunSortByTime) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+func (slice NextRunSortByTime) Less(i, j int) bool {
+	if slice[i].Time.Equal(slice[j].Time) {
+		return slice[i].JobName < slice[j].JobName
+	}
+	return slice[i].Time.Before(slice[j].Time)
+}
+
+// NextRuns returns next run time of every schedule of enabled jobs
+// sorted by time.
+func (cfg *Config) NextRuns(now time.Time) []NextRun {
+	runs := []NextRun{}
+	for jobName, jobConfig := range cfg.Jobs {
+		if jobConfig.Disabled || jobConfig.FanOutParent != "" {
+			continue
+		}
+		for _, spec := range jobConfig.RunAt.Schedules() {
+			schedule, err := cron.Parse(spec)
+			if err != nil {
+				continue
+			}
+			location := jobConfig.Location()
+			runs = append(runs, NextRun{
+				JobName:  jobName,
+				Spec:     spec,
+				Location: location,
+				Jitter:   jobConfig.Jitter,
+				Time:     ZonedSchedule{schedule, location}.Next(now),
+			})
+		}
+	}
+	sort.Sort(NextRunSortByTime(runs))
+	return runs
+}
@@ -0,0 +1,112 @@
+package bakapy
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveHashedField(t *testing.T) {
+	value, err := resolveHashedField("H", 1, "www")
+	if err != nil {
+		t.Fatal(err)
+	}
+	minute, _ := strconv.Atoi(value)
+	if minute < 0 || minute > 59 {
+		t.Fatal("minute must be in 0-59 range, not", value)
+	}
+	again, _ := resolveHashedField("H", 1, "www")
+	if again != value {
+		t.Fatal("hashed value must be stable,", value, "!=", again)
+	}
+
+	value, _ = resolveHashedField("H(1-5)", 2, "www")
+	hour, _ := strconv.Atoi(value)
+	if hour < 1 || hour > 5 {
+		t.Fatal("hour must be in 1-5 range, not", value)
+	}
+
+	value, _ = resolveHashedField("H/15", 1, "www")
+	if !strings.HasSuffix(value, "-59/15") {
+		t.Fatal("H/15 must be resolved to offset-59/15, not", value)
+	}
+}
+
+func TestResolveHashedField_Errors(t *testing.T) {
+	cases := map[string]string{
+		"H(5-1)":  "invalid hashed range 'H(5-1)'",
+		"H(0-99)": "invalid hashed range 'H(0-99)'",
+		"H/0":     "invalid hashed step 'H/0'",
+		"Hx":      "invalid hashed value 'Hx'",
+	}
+	for value, expectedErr := range cases {
+		_, err := resolveHashedField(value, 1, "www")
+		if err == nil || err.Error() != expectedErr {
+			t.Fatal("error must be", expectedErr, "not", err)
+		}
+	}
+}
+
+func TestParseConfig_HashedRunAt(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+jobs:
+    www:
+      run_at: "H H(1-4) * * *"
+      jitter: 10m
+    db:
+      run_at: {minute: H, hour: "2", day: "*", month: "*", weekday: "*"}
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	config, err := ParseConfig(cfg.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for jobName, jobConfig := range config.Jobs {
+		for _, spec := range jobConfig.RunAt.Schedules() {
+			if strings.Contains(spec, "H") {
+				t.Fatal(jobName, "schedule must not contain H:", spec)
+			}
+		}
+	}
+	if config.Jobs["www"].Jitter != 10*time.Minute {
+		t.Fatal("www jitter must be 10m not", config.Jobs["www"].Jitter)
+	}
+}
+
+func TestJobConfig_Sanitize_NegativeJitter(t *testing.T) {
+	cfg := &JobConfig{Jitter: -time.Second}
+	err := cfg.Sanitize()
+	expectedErr := "negative jitter '-1s'"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal("error must be", expectedErr, "not", err)
+	}
+}
+
+func TestConfig_NextRuns(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Jobs["late"] = &JobConfig{RunAt: RunAtSpec{Specs: []string{"0 0 5 * * *"}}}
+	cfg.Jobs["early"] = &JobConfig{RunAt: RunAtSpec{Specs: []string{"0 0 3 * * *", "0 0 6 * * *"}}}
+	cfg.Jobs["disabled"] = &JobConfig{Disabled: true, RunAt: RunAtSpec{Specs: []string{"0 0 1 * * *"}}}
+	cfg.Jobs["manual"] = &JobConfig{}
+
+	now := time.Date(2026, 10, 19, 0, 0, 0, 0, time.Local)
+	runs := cfg.NextRuns(now)
+	if len(runs) != 3 {
+		t.Fatal("runs length must be 3 not", len(runs))
+	}
+	expected := []struct {
+		job  string
+		hour int
+	}{{"early", 3}, {"late", 5}, {"early", 6}}
+	for idx, run := range runs {
+		if run.JobName != expected[idx].job || run.Time.Hour() != expected[idx].hour {
+			t.Fatal("run", idx, "must be", expected[idx], "not", run.JobName, run.Time)
+		}
+	}
+}
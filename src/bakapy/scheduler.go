@@ -0,0 +1,567 @@
+package bakapy
+
+import (
+	"fmt"
+	"github.com/op/go-logging"
+	"github.com/robfig/cron"
+	"math/rand"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	RUN_REASON_SCHEDULE   = "schedule"
+	RUN_REASON_DEPENDENCY = "dependency"
+	RUN_REASON_MANUAL     = "manual"
+	RUN_REASON_DEFERRED   = "deferred"
+	RUN_REASON_CATCH_UP   = "catch-up"
+)
+
+// JobTrigger describes why job was started
+type JobTrigger struct {
+	Reason         string
+	UpstreamJob    string
+	UpstreamTaskId TaskId
+	ParentJob      string
+	ParentTaskId   TaskId
+}
+
+type Scheduler struct {
+	config  *Config
+	storage *Storage
+	logger  *logging.Logger
+	state   *SchedulerState
+	started bool
+	// cron of each scheduled job, Reload replaces only crons of changed jobs
+	crons map[string]*cron.Cron
+	// protects config, crons and started
+	lock sync.RWMutex
+	// timers of jobs waiting for blackout window end
+	deferred     map[string]*time.Timer
+	deferredLock sync.Mutex
+	// finished sub-jobs of matrix runs waiting for other sub-jobs
+	matrixRuns map[string]map[string]*JobMetadata
+	matrixLock sync.Mutex
+}
+
+func NewScheduler(config *Config, storage *Storage) *Scheduler {
+	s := &Scheduler{
+		config:     config,
+		storage:    storage,
+		crons:      map[string]*cron.Cron{},
+		logger:     logging.MustGetLogger("bakapy.scheduler"),
+		deferred:   map[string]*time.Timer{},
+		matrixRuns: map[string]map[string]*JobMetadata{},
+	}
+	state, err := LoadSchedulerState(config.SchedulerStatePath())
+	if err != nil {
+		s.logger.Warning("cannot load scheduler state, missed runs will not be caught up: %s", err)
+	}
+	s.state = state
+	return s
+}
+
+// Config returns currently active configuration
+func (s *Scheduler) Config() *Config {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.config
+}
+
+// scheduledJobs returns names of jobs registered in cron
+func (s *Scheduler) scheduledJobs() []string {
+	jobNames := []string{}
+	for jobName, jobConfig := range s.Config().Jobs {
+		if jobConfig.FanOutParent != "" || jobConfig.Disabled || jobConfig.RunAt.IsEmpty() {
+			continue
+		}
+		jobNames = append(jobNames, jobName)
+	}
+	sort.Strings(jobNames)
+	return jobNames
+}
+
+func (s *Scheduler) markRun(jobName string, t time.Time) {
+	if err := s.state.SetLastRun(jobName, t); err != nil {
+		s.logger.Warning("cannot save scheduler state: %s", err)
+	}
+}
+
+// MissedJobs returns jobs which had scheduled run between last
+// recorded run and now within catch-up window. Jobs never run before
+// get now as last run time.
+func (s *Scheduler) MissedJobs(now time.Time) []string {
+	missed := []string{}
+	config := s.Config()
+	for _, jobName := range s.scheduledJobs() {
+		jobConfig := config.Jobs[jobName]
+		window := config.CatchUpWindow(jobConfig)
+		if window == 0 {
+			continue
+		}
+		lastRun, exist := s.state.Get(jobName)
+		if !exist {
+			s.markRun(jobName, now)
+			continue
+		}
+		for _, runSpec := range jobConfig.RunAt.Schedules() {
+			schedule, err := cron.Parse(runSpec)
+			if err != nil {
+				continue
+			}
+			zoned := ZonedSchedule{schedule, jobConfig.Location()}
+			// latest slot between last run and now, older ones are not needed
+			from := lastRun
+			if windowStart := now.Add(-window - time.Second); from.Before(windowStart) {
+				from = windowStart
+			}
+			var slot time.Time
+			for next := zoned.Next(from); !next.After(now); next = zoned.Next(next) {
+				slot = next
+			}
+			if !slot.IsZero() && !slot.Before(now.Add(-window)) {
+				s.logger.Warning("job %s missed run at %s, last run at %s", jobName, slot, lastRun)
+				missed = append(missed, jobName)
+				break
+			}
+		}
+	}
+	return missed
+}
+
+// AddJobs registers all enabled jobs having run_at in cron
+func (s *Scheduler) AddJobs() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for jobName, jobConfig := range s.config.Jobs {
+		s.scheduleJob(jobName, jobConfig)
+	}
+}
+
+// scheduleJob replaces cron of job with new one built from its config.
+// Cron is started if scheduler is started. Must be called with lock held.
+func (s *Scheduler) scheduleJob(jobName string, jobConfig *JobConfig) {
+	if oldCron, exist := s.crons[jobName]; exist {
+		if s.started {
+			oldCron.Stop()
+		}
+		delete(s.crons, jobName)
+	}
+	if jobConfig == nil || jobConfig.FanOutParent != "" {
+		return
+	}
+	if jobConfig.Disabled {
+		s.logger.Warning("job %s disabled, skipping", jobName)
+		return
+	}
+	if jobConfig.RunAt.IsEmpty() {
+		s.logger.Info("job %s has no run_at, it will be run by dependencies only", jobName)
+		return
+	}
+	jobCron := cron.New()
+	location := jobConfig.Location()
+	jitter := jobConfig.Jitter
+	for _, runSpec := range jobConfig.RunAt.Schedules() {
+		s.logger.Info("adding job %s{%s} in %s to scheduler", jobName, runSpec, location)
+		schedule, err := cron.Parse(runSpec)
+		if err != nil {
+			s.logger.Error("cannot add job %s to scheduler: %s", jobName, err)
+			continue
+		}
+		jobCron.Schedule(ZonedSchedule{schedule, location}, cron.FuncJob(func() {
+			if jitter > 0 {
+				delay := time.Duration(rand.Int63n(int64(jitter)))
+				s.logger.Info("delaying job %s for %s", jobName, delay)
+				time.Sleep(delay)
+			}
+			s.logger.Critical("Starting job %s", jobName)
+			s.RunJob(jobName, JobTrigger{Reason: RUN_REASON_SCHEDULE})
+		}))
+	}
+	s.crons[jobName] = jobCron
+	if s.started {
+		jobCron.Start()
+	}
+}
+
+// ZonedSchedule evaluates schedule in given time zone
+type ZonedSchedule struct {
+	Schedule cron.Schedule
+	Location *time.Location
+}
+
+func (z ZonedSchedule) Next(t time.Time) time.Time {
+	return z.Schedule.Next(t.In(z.Location)).In(t.Location())
+}
+
+// Start runs missed jobs once, restores deferred runs and starts cron
+func (s *Scheduler) Start() {
+	now := time.Now()
+	for _, jobName := range s.MissedJobs(now) {
+		s.logger.Critical("Starting missed job %s", jobName)
+		go s.RunJob(jobName, JobTrigger{Reason: RUN_REASON_CATCH_UP})
+	}
+	s.restoreDeferred()
+	s.lock.Lock()
+	for _, jobCron := range s.crons {
+		jobCron.Start()
+	}
+	s.started = true
+	s.lock.Unlock()
+}
+
+// RunJob runs job and then its downstream jobs one by one.
+// Not manual runs inside blackout window are skipped or deferred.
+// Downstream jobs of matrix sub-job are run once all sub-jobs finished.
+func (s *Scheduler) RunJob(jobName string, trigger JobTrigger) *JobMetadata {
+	metadata := s.RunSingleJob(jobName, trigger)
+	if metadata == nil {
+		return nil
+	}
+	upstream := map[string]*JobMetadata{jobName: metadata}
+	jobConfig, exist := s.Config().Jobs[jobName]
+	if exist && jobConfig.MatrixParent != "" && trigger.Reason != RUN_REASON_MANUAL {
+		upstream = s.matrixFanIn(jobConfig.MatrixParent, jobName, metadata)
+	}
+	if upstream != nil {
+		s.runDownstream(upstream)
+	}
+	return metadata
+}
+
+// matrixFanIn records finished run of matrix sub-job. Returns results
+// of all sub-jobs once each of them finished, nil otherwise.
+func (s *Scheduler) matrixFanIn(parent, jobName string, metadata *JobMetadata) map[string]*JobMetadata {
+	s.matrixLock.Lock()
+	defer s.matrixLock.Unlock()
+	run := s.matrixRuns[parent]
+	if run == nil {
+		run = map[string]*JobMetadata{}
+		s.matrixRuns[parent] = run
+	}
+	run[jobName] = metadata
+	for _, subName := range s.Config().MatrixSubJobs(parent) {
+		if run[subName] == nil {
+			s.logger.Info("job %s finished, waiting for other sub-jobs of %s", jobName, parent)
+			return nil
+		}
+	}
+	delete(s.matrixRuns, parent)
+	return run
+}
+
+// RunSingleJob runs job without triggering its downstream jobs
+func (s *Scheduler) RunSingleJob(jobName string, trigger JobTrigger) *JobMetadata {
+	config := s.Config()
+	if !s.storage.Running.Hold() {
+		s.logger.Warning("scheduler is shutting down, job %s not started", jobName)
+		return nil
+	}
+	defer s.storage.Running.Release()
+	jobConfig, exist := config.Jobs[jobName]
+	if !exist {
+		// removed by config reload
+		s.logger.Error("job %s not found, skipping", jobName)
+		return nil
+	}
+	if trigger.Reason == RUN_REASON_SCHEDULE || trigger.Reason == RUN_REASON_CATCH_UP {
+		// scheduled slot is taken only by started run
+		s.markRun(jobName, time.Now())
+	}
+	if trigger.Reason != RUN_REASON_MANUAL {
+		if window, end := config.ActiveBlackout(jobConfig, time.Now()); window != nil {
+			return s.blackoutJob(config, jobName, trigger, window, end)
+		}
+	}
+	var metadata *JobMetadata
+	if jobConfig.IsFanOut() {
+		metadata = RunFanOutJob(jobName, jobConfig, config, s.storage, trigger)
+	} else {
+		metadata = RunJob(jobName, jobConfig, config, s.storage, trigger)
+	}
+	return metadata
+}
+
+// runDownstream runs jobs triggered by finished upstream runs. Jobs
+// reachable from upstream are visited once in topological order, so
+// job depending on several of them runs once, after all of them.
+// It is triggered by first finished upstream listing it.
+func (s *Scheduler) runDownstream(upstream map[string]*JobMetadata) {
+	config := s.Config()
+	graph := config.dependencyGraph()
+
+	roots := make([]string, 0, len(upstream))
+	results := map[string]*JobMetadata{}
+	visited := map[string]bool{}
+	for jobName, metadata := range upstream {
+		roots = append(roots, jobName)
+		results[jobName] = metadata
+		visited[jobName] = true
+	}
+	sort.Strings(roots)
+
+	// number of not yet visited upstreams of each reachable job
+	pending := map[string]int{}
+	queue := append([]string{}, roots...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, next := range graph[name] {
+			pending[next]++
+			if !visited[next] {
+				visited[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	triggers := map[string]JobTrigger{}
+	ready := append([]string{}, roots...)
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		if trigger, triggered := triggers[name]; triggered {
+			if config.Jobs[name].Disabled {
+				s.logger.Warning("downstream job %s of %s disabled, skipping", name, trigger.UpstreamJob)
+			} else {
+				s.logger.Info("starting job %s triggered by %s[%s]", name, trigger.UpstreamJob, trigger.UpstreamTaskId)
+				results[name] = s.RunSingleJob(name, trigger)
+			}
+		}
+		if result := results[name]; result != nil {
+			for _, downstream := range result.DownstreamJobs {
+				if _, triggered := triggers[downstream]; !triggered {
+					triggers[downstream] = JobTrigger{
+						Reason:         RUN_REASON_DEPENDENCY,
+						UpstreamJob:    name,
+						UpstreamTaskId: result.TaskId,
+					}
+				}
+			}
+		}
+		for _, next := range graph[name] {
+			pending[next]--
+			if pending[next] == 0 && upstream[next] == nil {
+				ready = append(ready, next)
+			}
+		}
+	}
+}
+
+// blackoutJob records skipped run and schedules deferred one if needed.
+// Several runs deferred by one window are merged into single run.
+func (s *Scheduler) blackoutJob(config *Config, jobName string, trigger JobTrigger, window *BlackoutWindow, end time.Time) *JobMetadata {
+	jobConfig := config.Jobs[jobName]
+	reason := fmt.Sprintf("skipped due to blackout %s until %s", window.Name, end.In(jobConfig.Location()))
+	if window.Action == BLACKOUT_ACTION_DEFER {
+		reason = fmt.Sprintf("deferred due to blackout %s until %s", window.Name, end.In(jobConfig.Location()))
+		s.deferJob(jobName, end)
+	}
+	s.logger.Warning("job %s %s", jobName, reason)
+	metadata := NewSkippedJobMetadata(jobName, jobConfig, trigger, reason)
+	SaveJobMetadata(metadata, config)
+	return metadata
+}
+
+// deferJob schedules deferred job run at given time and saves it in
+// scheduler state. Job already having deferred run is not scheduled again.
+func (s *Scheduler) deferJob(jobName string, at time.Time) {
+	s.deferredLock.Lock()
+	defer s.deferredLock.Unlock()
+	if _, exist := s.deferred[jobName]; exist {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(at.Sub(time.Now()), func() {
+		s.deferredLock.Lock()
+		if s.deferred[jobName] != timer {
+			// cancelled by reload or shutdown
+			s.deferredLock.Unlock()
+			return
+		}
+		delete(s.deferred, jobName)
+		s.deferredLock.Unlock()
+		if err := s.state.ClearDeferred(jobName); err != nil {
+			s.logger.Warning("cannot save scheduler state: %s", err)
+		}
+		s.logger.Critical("Starting deferred job %s", jobName)
+		s.RunJob(jobName, JobTrigger{Reason: RUN_REASON_DEFERRED})
+	})
+	s.deferred[jobName] = timer
+	if err := s.state.SetDeferred(jobName, at); err != nil {
+		s.logger.Warning("cannot save scheduler state: %s", err)
+	}
+}
+
+// cancelDeferred stops pending deferred runs, they are kept in
+// scheduler state and restored by restoreDeferred
+func (s *Scheduler) cancelDeferred() {
+	s.deferredLock.Lock()
+	defer s.deferredLock.Unlock()
+	for jobName, timer := range s.deferred {
+		timer.Stop()
+		delete(s.deferred, jobName)
+	}
+}
+
+// dropDeferred cancels deferred run of removed or disabled job and
+// removes it from scheduler state
+func (s *Scheduler) dropDeferred(jobName string) {
+	s.deferredLock.Lock()
+	timer, exist := s.deferred[jobName]
+	if exist {
+		timer.Stop()
+		delete(s.deferred, jobName)
+	}
+	s.deferredLock.Unlock()
+	if _, saved := s.state.DeferredRuns()[jobName]; !exist && !saved {
+		return
+	}
+	s.logger.Warning("dropping deferred run of removed or disabled job %s", jobName)
+	if err := s.state.ClearDeferred(jobName); err != nil {
+		s.logger.Warning("cannot save scheduler state: %s", err)
+	}
+}
+
+// restoreDeferred schedules deferred runs saved in scheduler state.
+// Runs of removed or disabled jobs are dropped.
+func (s *Scheduler) restoreDeferred() {
+	config := s.Config()
+	for jobName, at := range s.state.DeferredRuns() {
+		jobConfig, exist := config.Jobs[jobName]
+		if !exist || jobConfig.Disabled {
+			s.logger.Warning("dropping deferred run of removed or disabled job %s", jobName)
+			if err := s.state.ClearDeferred(jobName); err != nil {
+				s.logger.Warning("cannot save scheduler state: %s", err)
+			}
+			continue
+		}
+		s.logger.Info("restoring deferred run of job %s at %s", jobName, at)
+		s.deferJob(jobName, at)
+	}
+}
+
+// JobsDiff is difference between job sets of two configs
+type JobsDiff struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// DiffJobs compares effective configs of jobs
+func DiffJobs(oldConfig, newConfig *Config) JobsDiff {
+	diff := JobsDiff{}
+	for jobName, jobConfig := range newConfig.Jobs {
+		oldJobConfig, exist := oldConfig.Jobs[jobName]
+		if !exist {
+			diff.Added = append(diff.Added, jobName)
+			continue
+		}
+		if string(oldJobConfig.EffectiveFmt()) != string(jobConfig.EffectiveFmt()) {
+			diff.Changed = append(diff.Changed, jobName)
+		}
+	}
+	for jobName := range oldConfig.Jobs {
+		if _, exist := newConfig.Jobs[jobName]; !exist {
+			diff.Removed = append(diff.Removed, jobName)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff
+}
+
+// Reload parses config again and replaces cron entries of added, removed
+// and changed jobs. Unchanged jobs keep their cron, pending jitter delays
+// and deferred runs. Running tasks are not touched. Invalid config is
+// rejected, previous one stays active. Storage settings require restart
+// and are not changed.
+func (s *Scheduler) Reload(configPath string) error {
+	newConfig, err := ParseConfig(configPath)
+	if err != nil {
+		s.logger.Error("config reload failed, keeping previous config: %s", err)
+		return err
+	}
+	oldConfig := s.Config()
+	if newConfig.Listen != oldConfig.Listen || newConfig.StorageDir != oldConfig.StorageDir ||
+		newConfig.MetadataDir != oldConfig.MetadataDir || newConfig.StatusListen != oldConfig.StatusListen {
+		s.logger.Warning("listen, status_listen, storage_dir and metadata_dir changes require restart, ignoring them")
+		newConfig.Listen = oldConfig.Listen
+		newConfig.StatusListen = oldConfig.StatusListen
+		newConfig.StorageDir = oldConfig.StorageDir
+		newConfig.MetadataDir = oldConfig.MetadataDir
+	}
+
+	diff := DiffJobs(oldConfig, newConfig)
+	s.logger.Info("reloading config: added jobs %v, removed jobs %v, changed jobs %v",
+		diff.Added, diff.Removed, diff.Changed)
+
+	s.lock.Lock()
+	s.config = newConfig
+	for _, jobNames := range [][]string{diff.Removed, diff.Changed, diff.Added} {
+		for _, jobName := range jobNames {
+			s.scheduleJob(jobName, newConfig.Jobs[jobName])
+		}
+	}
+	s.lock.Unlock()
+
+	for _, jobNames := range [][]string{diff.Removed, diff.Changed} {
+		for _, jobName := range jobNames {
+			if jobConfig, exist := newConfig.Jobs[jobName]; !exist || jobConfig.Disabled {
+				s.dropDeferred(jobName)
+			}
+		}
+	}
+	return nil
+}
+
+// Shutdown stops starting new jobs and waits up to grace period for
+// running ones. Commands of tasks still running after it are killed
+// and tasks are saved as aborted.
+// Returns number of aborted tasks.
+func (s *Scheduler) Shutdown(grace time.Duration) int {
+	s.lock.Lock()
+	if s.started {
+		for _, jobCron := range s.crons {
+			jobCron.Stop()
+		}
+		s.started = false
+	}
+	s.lock.Unlock()
+	s.cancelDeferred()
+
+	running := s.storage.Running
+	running.Close()
+	s.logger.Info("waiting up to %s for %d running tasks", grace, len(running.Tasks()))
+	if running.Wait(grace) {
+		s.logger.Info("all running tasks finished")
+		return 0
+	}
+	tasks := running.Tasks()
+	aborted := 0
+	for _, task := range tasks {
+		reason := fmt.Sprintf("scheduler shut down, task not finished in %s", grace)
+		abort := func() {
+			s.logger.Critical("task %s of job %s not finished in %s, aborting", task.TaskId, task.JobName, grace)
+			metadata := task.AbortedMetadata(reason)
+			// keep files and steps saved while task was running
+			saved, err := LoadJobMetadata(path.Join(s.Config().MetadataDir, string(task.TaskId)))
+			if err == nil {
+				saved.Aborted = true
+				saved.Success = false
+				saved.Status = JOB_STATUS_ABORTED
+				saved.Message = metadata.Message
+				saved.EndTime = metadata.EndTime
+				metadata = saved
+			}
+			SaveJobMetadata(metadata, s.Config())
+		}
+		if running.Abort(task.TaskId, abort) {
+			aborted++
+		}
+	}
+	return aborted
+}
@@ -0,0 +1,94 @@
+package bakapy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// SchedulerState keeps last scheduled run time of each job and runs
+// deferred by blackout windows between scheduler restarts.
+type SchedulerState struct {
+	LastRun  map[string]time.Time
+	Deferred map[string]time.Time
+	path     string
+	lock     sync.Mutex
+}
+
+// LoadSchedulerState reads state file, missing file means empty state
+func LoadSchedulerState(statePath string) (*SchedulerState, error) {
+	state := &SchedulerState{LastRun: map[string]time.Time{}, Deferred: map[string]time.Time{}, path: statePath}
+	raw, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(raw, state); err != nil {
+		return state, err
+	}
+	if state.LastRun == nil {
+		state.LastRun = map[string]time.Time{}
+	}
+	if state.Deferred == nil {
+		state.Deferred = map[string]time.Time{}
+	}
+	return state, nil
+}
+
+func (state *SchedulerState) Get(jobName string) (time.Time, bool) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	lastRun, exist := state.LastRun[jobName]
+	return lastRun, exist
+}
+
+// SetLastRun saves job run time to state file
+func (state *SchedulerState) SetLastRun(jobName string, t time.Time) error {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.LastRun[jobName] = t
+	return state.save()
+}
+
+// DeferredRuns returns jobs with pending deferred runs and their times
+func (state *SchedulerState) DeferredRuns() map[string]time.Time {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	deferred := make(map[string]time.Time, len(state.Deferred))
+	for jobName, t := range state.Deferred {
+		deferred[jobName] = t
+	}
+	return deferred
+}
+
+// SetDeferred saves time of deferred job run to state file
+func (state *SchedulerState) SetDeferred(jobName string, t time.Time) error {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.Deferred[jobName] = t
+	return state.save()
+}
+
+// ClearDeferred removes deferred job run from state file
+func (state *SchedulerState) ClearDeferred(jobName string) error {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if _, exist := state.Deferred[jobName]; !exist {
+		return nil
+	}
+	delete(state.Deferred, jobName)
+	return state.save()
+}
+
+// save writes state file, must be called with lock held
+func (state *SchedulerState) save() error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(state.path, raw)
+}
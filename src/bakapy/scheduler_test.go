@@ -0,0 +1,269 @@
+package bakapy
+
+import (
+	"github.com/robfig/cron"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestSchedulerConfig() *Config {
+	gConfig := NewConfig()
+	gConfig.Listen = "1.1.1.1:1234"
+	gConfig.MetadataDir, _ = ioutil.TempDir("", "")
+	gConfig.CommandDir, _ = ioutil.TempDir("", "")
+	os.Create(gConfig.CommandDir + "/" + "wow.cmd")
+	return gConfig
+}
+
+func removeTestSchedulerConfig(gConfig *Config) {
+	os.RemoveAll(gConfig.MetadataDir)
+	os.RemoveAll(MetadataJournalDir(gConfig.MetadataDir))
+	os.RemoveAll(gConfig.LogDir())
+	os.RemoveAll(gConfig.CommandDir)
+	os.Remove(gConfig.SchedulerStatePath())
+}
+
+func TestScheduler_RunJob_TriggersDownstream(t *testing.T) {
+	gConfig := newTestSchedulerConfig()
+	defer removeTestSchedulerConfig(gConfig)
+
+	verifyExecutor := &TestCountExecutor{}
+	disabledExecutor := &TestCountExecutor{}
+	gConfig.Jobs["dump"] = &JobConfig{Command: "wow.cmd", executor: &TestOkExecutor{}, OnFailure: []string{"disabled"}}
+	gConfig.Jobs["verify"] = &JobConfig{Command: "wow.cmd", executor: verifyExecutor, After: []string{"dump"}}
+	gConfig.Jobs["disabled"] = &JobConfig{Command: "wow.cmd", executor: disabledExecutor, Disabled: true, After: []string{"dump"}}
+
+	scheduler := NewScheduler(gConfig, NewStorage(gConfig))
+	metadata := scheduler.RunJob("dump", JobTrigger{Reason: RUN_REASON_MANUAL})
+
+	if verifyExecutor.calls != 1 {
+		t.Fatal("verify job must be run once, got", verifyExecutor.calls)
+	}
+	if disabledExecutor.calls != 0 {
+		t.Fatal("disabled job must not be run")
+	}
+	if len(metadata.DownstreamJobs) != 2 {
+		t.Fatal("wrong metadata.DownstreamJobs", metadata.DownstreamJobs)
+	}
+	if metadata.RunReason != RUN_REASON_MANUAL {
+		t.Fatal("metadata.RunReason must be manual not", metadata.RunReason)
+	}
+
+	files, _ := ioutil.ReadDir(gConfig.MetadataDir)
+	for _, f := range files {
+		m, err := LoadJobMetadata(gConfig.MetadataDir + "/" + f.Name())
+		if err != nil {
+			t.Fatal("cannot load metadata:", err)
+		}
+		if m.JobName != "verify" {
+			continue
+		}
+		if m.RunReason != RUN_REASON_DEPENDENCY {
+			t.Fatal("verify run reason must be dependency not", m.RunReason)
+		}
+		if m.UpstreamJob != "dump" || m.UpstreamTaskId != metadata.TaskId {
+			t.Fatal("wrong verify upstream", m.UpstreamJob, m.UpstreamTaskId)
+		}
+		return
+	}
+	t.Fatal("verify metadata not found")
+}
+
+func TestScheduler_RunJob_DiamondRunsOnce(t *testing.T) {
+	gConfig := newTestSchedulerConfig()
+	defer removeTestSchedulerConfig(gConfig)
+
+	executor := &TestCountExecutor{}
+	gConfig.Jobs["a"] = &JobConfig{Command: "wow.cmd", executor: &TestOkExecutor{}}
+	gConfig.Jobs["b"] = &JobConfig{Command: "wow.cmd", executor: &TestOkExecutor{}, After: []string{"a"}}
+	gConfig.Jobs["c"] = &JobConfig{Command: "wow.cmd", executor: &TestOkExecutor{}, After: []string{"a"}}
+	gConfig.Jobs["d"] = &JobConfig{Command: "wow.cmd", executor: executor, After: []string{"b", "c"}}
+
+	scheduler := NewScheduler(gConfig, NewStorage(gConfig))
+	scheduler.RunJob("a", JobTrigger{Reason: RUN_REASON_MANUAL})
+
+	if executor.calls != 1 {
+		t.Fatal("d job must be run once, got", executor.calls)
+	}
+}
+
+func TestScheduler_RunJob_AfterNotTriggeredOnFailure(t *testing.T) {
+	gConfig := newTestSchedulerConfig()
+	defer removeTestSchedulerConfig(gConfig)
+
+	verifyExecutor := &TestCountExecutor{}
+	alertExecutor := &TestCountExecutor{}
+	gConfig.Jobs["dump"] = &JobConfig{Command: "wow.cmd", executor: &TestFailExecutor{}, OnFailure: []string{"alert"}}
+	gConfig.Jobs["verify"] = &JobConfig{Command: "wow.cmd", executor: verifyExecutor, After: []string{"dump"}}
+	gConfig.Jobs["alert"] = &JobConfig{Command: "wow.cmd", executor: alertExecutor}
+
+	scheduler := NewScheduler(gConfig, NewStorage(gConfig))
+	scheduler.RunJob("dump", JobTrigger{Reason: RUN_REASON_MANUAL})
+
+	if verifyExecutor.calls != 0 {
+		t.Fatal("verify job must not be run after failed dump, got", verifyExecutor.calls)
+	}
+	if alertExecutor.calls != 1 {
+		t.Fatal("alert job must be run once, got", alertExecutor.calls)
+	}
+}
+
+func TestScheduler_RunJob_MatrixFanIn(t *testing.T) {
+	gConfig := newTestSchedulerConfig()
+	defer removeTestSchedulerConfig(gConfig)
+
+	executor := &TestCountExecutor{}
+	gConfig.Jobs["mysql[main]"] = &JobConfig{Command: "wow.cmd", executor: &TestOkExecutor{}, MatrixParent: "mysql"}
+	gConfig.Jobs["mysql[stats]"] = &JobConfig{Command: "wow.cmd", executor: &TestOkExecutor{}, MatrixParent: "mysql"}
+	gConfig.Jobs["report"] = &JobConfig{Command: "wow.cmd", executor: executor, After: []string{"mysql[main]", "mysql[stats]"}}
+
+	scheduler := NewScheduler(gConfig, NewStorage(gConfig))
+	scheduler.RunJob("mysql[main]", JobTrigger{Reason: RUN_REASON_SCHEDULE})
+	if executor.calls != 0 {
+		t.Fatal("report job must wait for all sub-jobs, got", executor.calls)
+	}
+	scheduler.RunJob("mysql[stats]", JobTrigger{Reason: RUN_REASON_SCHEDULE})
+	if executor.calls != 1 {
+		t.Fatal("report job must be run once, got", executor.calls)
+	}
+
+	scheduler.RunJob("mysql[stats]", JobTrigger{Reason: RUN_REASON_SCHEDULE})
+	scheduler.RunJob("mysql[main]", JobTrigger{Reason: RUN_REASON_SCHEDULE})
+	if executor.calls != 2 {
+		t.Fatal("report job must be run once per matrix run, got", executor.calls)
+	}
+}
+
+func TestScheduler_RunSingleJob_NoDownstream(t *testing.T) {
+	gConfig := newTestSchedulerConfig()
+	defer removeTestSchedulerConfig(gConfig)
+
+	executor := &TestCountExecutor{}
+	gConfig.Jobs["dump"] = &JobConfig{Command: "wow.cmd", executor: &TestOkExecutor{}}
+	gConfig.Jobs["verify"] = &JobConfig{Command: "wow.cmd", executor: executor, After: []string{"dump"}}
+
+	scheduler := NewScheduler(gConfig, NewStorage(gConfig))
+	metadata := scheduler.RunSingleJob("dump", JobTrigger{Reason: RUN_REASON_MANUAL})
+
+	if executor.calls != 0 {
+		t.Fatal("verify job must not be run, got", executor.calls)
+	}
+	if len(metadata.DownstreamJobs) != 1 {
+		t.Fatal("wrong metadata.DownstreamJobs", metadata.DownstreamJobs)
+	}
+}
+
+func TestZonedSchedule_Next(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	schedule, _ := cron.Parse("0 0 3 * * *")
+	zoned := ZonedSchedule{schedule, tokyo}
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	next := zoned.Next(now)
+	expected := time.Date(2026, 10, 19, 18, 0, 0, 0, time.UTC)
+	if !next.Equal(expected) {
+		t.Fatal("next run must be", expected, "not", next)
+	}
+	if next.Location() != time.UTC {
+		t.Fatal("next run must be in caller location, not", next.Location())
+	}
+}
+
+func TestScheduler_MissedJobs(t *testing.T) {
+	gConfig := newTestSchedulerConfig()
+	defer removeTestSchedulerConfig(gConfig)
+	gConfig.CatchUp = 6 * time.Hour
+	daily := RunAtSpec{Specs: []string{"0 0 2 * * *"}}
+	gConfig.Jobs["missed"] = &JobConfig{RunAt: daily}
+	gConfig.Jobs["too-old"] = &JobConfig{RunAt: daily, CatchUp: time.Hour}
+	gConfig.Jobs["not-missed"] = &JobConfig{RunAt: daily}
+	gConfig.Jobs["new"] = &JobConfig{RunAt: daily}
+
+	now := time.Date(2026, 10, 19, 4, 0, 0, 0, time.Local)
+	scheduler := NewScheduler(gConfig, NewStorage(gConfig))
+	scheduler.markRun("missed", now.Add(-26*time.Hour))
+	scheduler.markRun("too-old", now.Add(-26*time.Hour))
+	scheduler.markRun("not-missed", now.Add(-2*time.Hour))
+
+	// state must survive restart
+	scheduler = NewScheduler(gConfig, NewStorage(gConfig))
+	missed := scheduler.MissedJobs(now)
+	if len(missed) != 1 || missed[0] != "missed" {
+		t.Fatal("missed jobs must be [missed] not", missed)
+	}
+	if lastRun, exist := scheduler.state.Get("new"); !exist || !lastRun.Equal(now) {
+		t.Fatal("new job last run must be initialized with now, got", lastRun)
+	}
+}
+
+func TestScheduler_RunJob_MarksRunOnlyWhenStarted(t *testing.T) {
+	gConfig := newTestSchedulerConfig()
+	defer removeTestSchedulerConfig(gConfig)
+
+	gConfig.Jobs["dump"] = &JobConfig{Command: "wow.cmd", executor: &TestOkExecutor{}}
+	gConfig.Jobs["files"] = &JobConfig{Command: "wow.cmd", executor: &TestOkExecutor{}}
+
+	scheduler := NewScheduler(gConfig, NewStorage(gConfig))
+	scheduler.RunJob("dump", JobTrigger{Reason: RUN_REASON_SCHEDULE})
+	if _, exist := scheduler.state.Get("dump"); !exist {
+		t.Fatal("started scheduled run must be recorded")
+	}
+
+	scheduler.Shutdown(time.Second)
+	scheduler.RunJob("files", JobTrigger{Reason: RUN_REASON_SCHEDULE})
+	if lastRun, exist := scheduler.state.Get("files"); exist {
+		t.Fatal("not started run must not be recorded, got", lastRun)
+	}
+}
+
+func TestScheduler_Reload(t *testing.T) {
+	gConfig := newTestSchedulerConfig()
+	defer removeTestSchedulerConfig(gConfig)
+	cfg, _ := ioutil.TempFile("", "test_config")
+	defer os.Remove(cfg.Name())
+	writeConfig := func(jobs string) {
+		ioutil.WriteFile(cfg.Name(), []byte("metadata_dir: "+gConfig.MetadataDir+"\njobs:\n"+jobs), 0644)
+	}
+
+	writeConfig("  kept: {run_at: '@daily'}\n  removed: {run_at: '@daily'}\n  same: {run_at: '@daily'}\n")
+	config, err := ParseConfig(cfg.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler := NewScheduler(config, NewStorage(config))
+	scheduler.AddJobs()
+	scheduler.Start()
+	defer scheduler.Shutdown(time.Second)
+	sameCron := scheduler.crons["same"]
+
+	writeConfig("  kept: {run_at: '@hourly'}\n  added: {run_at: '@daily'}\n  same: {run_at: '@daily'}\n")
+	if err := scheduler.Reload(cfg.Name()); err != nil {
+		t.Fatal(err)
+	}
+	diff := DiffJobs(config, scheduler.Config())
+	if len(diff.Added) != 1 || len(diff.Removed) != 1 || len(diff.Changed) != 1 {
+		t.Fatal("unexpected jobs diff", diff)
+	}
+	if len(scheduler.crons) != 3 || scheduler.crons["removed"] != nil {
+		t.Fatal("crons of kept, added and same jobs must be registered, not", scheduler.crons)
+	}
+	if scheduler.crons["same"] != sameCron {
+		t.Fatal("cron of unchanged job must be kept")
+	}
+	if scheduler.RunJob("removed", JobTrigger{Reason: RUN_REASON_SCHEDULE}) != nil {
+		t.Fatal("removed job must not be run")
+	}
+
+	writeConfig("  broken: {max_age_day: 1}\n")
+	if err := scheduler.Reload(cfg.Name()); err == nil {
+		t.Fatal("invalid config must be rejected")
+	}
+	if _, exist := scheduler.Config().Jobs["added"]; !exist {
+		t.Fatal("previous config must stay active")
+	}
+}
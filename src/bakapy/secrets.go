@@ -0,0 +1,110 @@
+package bakapy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Job argument value referencing external secret source, e.g.
+// ${env:MYSQL_PWD}, ${file:/etc/bakapy/secrets/mysql} or ${cmd:mysql/root}
+var SECRET_REF_RE = regexp.MustCompile(`^\$\{(file|env|cmd):(.+)\}$`)
+
+const (
+	SECRET_PROVIDER_FILE = "file"
+	SECRET_PROVIDER_ENV  = "env"
+	SECRET_PROVIDER_CMD  = "cmd"
+)
+
+type SecretRef struct {
+	Provider string
+	Key      string
+}
+
+func (ref *SecretRef) String() string {
+	return fmt.Sprintf("${%s:%s}", ref.Provider, ref.Key)
+}
+
+func ParseSecretRef(value string) (*SecretRef, bool) {
+	match := SECRET_REF_RE.FindStringSubmatch(value)
+	if match == nil {
+		return nil, false
+	}
+	return &SecretRef{Provider: match[1], Key: match[2]}, true
+}
+
+// SecretResolver fetches secret values at job run time. Command is
+// a local helper invoked with the secret key as the last argument,
+// it must print the secret value to stdout within Timeout.
+type SecretResolver struct {
+	Command string
+	Timeout time.Duration
+}
+
+func NewSecretResolver(command string) *SecretResolver {
+	return &SecretResolver{Command: command, Timeout: SECRET_TIMEOUT}
+}
+
+// Validate checks reference syntax without resolving it
+func (r *SecretResolver) Validate(ref *SecretRef) error {
+	switch ref.Provider {
+	case SECRET_PROVIDER_FILE:
+		if !path.IsAbs(ref.Key) {
+			return errors.New(fmt.Sprintf("secret file path must be absolute: %s", ref))
+		}
+	case SECRET_PROVIDER_ENV:
+		if !ARG_NAME_RE.MatchString(ref.Key) {
+			return errors.New(fmt.Sprintf("invalid environment variable name: %s", ref))
+		}
+	case SECRET_PROVIDER_CMD:
+		if r.Command == "" {
+			return errors.New(fmt.Sprintf("secret_command is not configured: %s", ref))
+		}
+	}
+	return nil
+}
+
+func (r *SecretResolver) Resolve(ref *SecretRef) (string, error) {
+	if err := r.Validate(ref); err != nil {
+		return "", err
+	}
+	switch ref.Provider {
+	case SECRET_PROVIDER_FILE:
+		value, err := ioutil.ReadFile(ref.Key)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("cannot read secret %s: %s", ref, err))
+		}
+		return strings.TrimRight(string(value), "\r\n"), nil
+	case SECRET_PROVIDER_ENV:
+		value, exist := os.LookupEnv(ref.Key)
+		if !exist {
+			return "", errors.New(fmt.Sprintf("environment variable for secret %s is not set", ref))
+		}
+		return value, nil
+	case SECRET_PROVIDER_CMD:
+		args := append(strings.Fields(r.Command), ref.Key)
+		cmd := exec.Command(args[0], args[1:]...)
+		output := new(bytes.Buffer)
+		errput := new(bytes.Buffer)
+		cmd.Stdout = output
+		cmd.Stderr = errput
+		timedOut, err := runWithTimeout(cmd, r.Timeout)
+		value := output.Bytes()
+		if timedOut {
+			return "", errors.New(fmt.Sprintf("secret command for %s timed out after %s", ref, r.Timeout))
+		}
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("secret command for %s failed: %s: %s",
+				ref, err, strings.TrimSpace(errput.String())))
+		}
+		return strings.TrimRight(string(value), "\r\n"), nil
+	}
+	return "", errors.New(fmt.Sprintf("unknown secret provider: %s", ref))
+}
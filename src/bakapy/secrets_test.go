@@ -0,0 +1,149 @@
+package bakapy
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseSecretRef(t *testing.T) {
+	ref, isRef := ParseSecretRef("${file:/etc/bakapy/mysql}")
+	if !isRef {
+		t.Fatal("must be secret reference")
+	}
+	if ref.Provider != "file" || ref.Key != "/etc/bakapy/mysql" {
+		t.Fatal("wrong reference parsed:", ref)
+	}
+	if _, isRef := ParseSecretRef("plain ${env:X} value"); isRef {
+		t.Fatal("plain value must not be a reference")
+	}
+	if _, isRef := ParseSecretRef("${vault:X}"); isRef {
+		t.Fatal("unknown provider must not be a reference")
+	}
+}
+
+func TestSecretResolver_Resolve_File(t *testing.T) {
+	secretFile, _ := ioutil.TempFile("", "secret")
+	secretFile.Write([]byte("topsecret\n"))
+	secretFile.Close()
+	defer os.Remove(secretFile.Name())
+
+	value, err := NewSecretResolver("").Resolve(&SecretRef{Provider: "file", Key: secretFile.Name()})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if value != "topsecret" {
+		t.Fatal("value must be 'topsecret' not", value)
+	}
+}
+
+func TestSecretResolver_Resolve_FileRelative(t *testing.T) {
+	_, err := NewSecretResolver("").Resolve(&SecretRef{Provider: "file", Key: "secret.txt"})
+	expectedErr := "secret file path must be absolute: ${file:secret.txt}"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+}
+
+func TestSecretResolver_Resolve_Env(t *testing.T) {
+	os.Setenv("BAKAPY_TEST_SECRET", "topsecret")
+	defer os.Unsetenv("BAKAPY_TEST_SECRET")
+
+	value, err := NewSecretResolver("").Resolve(&SecretRef{Provider: "env", Key: "BAKAPY_TEST_SECRET"})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if value != "topsecret" {
+		t.Fatal("value must be 'topsecret' not", value)
+	}
+}
+
+func TestSecretResolver_Resolve_Cmd(t *testing.T) {
+	value, err := NewSecretResolver("echo secret-for").Resolve(&SecretRef{Provider: "cmd", Key: "mysql/root"})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if value != "secret-for mysql/root" {
+		t.Fatal("value must be 'secret-for mysql/root' not", value)
+	}
+}
+
+func TestSecretResolver_Resolve_CmdNotConfigured(t *testing.T) {
+	_, err := NewSecretResolver("").Resolve(&SecretRef{Provider: "cmd", Key: "mysql/root"})
+	expectedErr := "secret_command is not configured: ${cmd:mysql/root}"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+}
+
+func TestSecretResolver_Resolve_CmdFailed(t *testing.T) {
+	_, err := NewSecretResolver("false").Resolve(&SecretRef{Provider: "cmd", Key: "mysql/root"})
+	expectedErr := "secret command for ${cmd:mysql/root} failed: exit status 1: "
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+}
+
+func TestSecretResolver_Resolve_CmdTimeout(t *testing.T) {
+	// key is passed as sleep interval
+	resolver := NewSecretResolver("sleep")
+	resolver.Timeout = 100 * time.Millisecond
+	started := time.Now()
+	_, err := resolver.Resolve(&SecretRef{Provider: "cmd", Key: "10"})
+	expectedErr := "secret command for ${cmd:10} timed out after 100ms"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+	if time.Since(started) > 5*time.Second {
+		t.Fatal("secret command must be killed on timeout")
+	}
+
+	// background child holding output open is killed too
+	resolver = NewSecretResolver("sh -c")
+	resolver.Timeout = 100 * time.Millisecond
+	started = time.Now()
+	_, err = resolver.Resolve(&SecretRef{Provider: "cmd", Key: "sleep 10 & sleep 10"})
+	if err == nil || time.Since(started) > 5*time.Second {
+		t.Fatal("secret command with children must be killed on timeout, got", err)
+	}
+}
+
+func TestParseConfig_SecretRefNotResolved(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+secret_command: /usr/local/bin/get-secret
+jobs:
+    wow:
+      args:
+        mysql_pwd: ${cmd:mysql/root}
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	config, err := ParseConfig(cfg.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Jobs["wow"].Args["mysql_pwd"] != "${cmd:mysql/root}" {
+		t.Fatal("secret reference must be kept as is, got", config.Jobs["wow"].Args["mysql_pwd"])
+	}
+}
+
+func TestParseConfig_SecretCmdNotConfigured(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+jobs:
+    wow:
+      args:
+        mysql_pwd: ${cmd:mysql/root}
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	_, err := ParseConfig(cfg.Name())
+	expectedErr := "job wow: argument mysql_pwd: secret_command is not configured: ${cmd:mysql/root}"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+}
@@ -0,0 +1,79 @@
+package bakapy
+
+import (
+	"encoding/json"
+	"github.com/op/go-logging"
+	"net"
+	"net/http"
+)
+
+// StatusServer exposes scheduler state over HTTP as JSON
+type StatusServer struct {
+	listenAddr string
+	storage    *Storage
+	mux        *http.ServeMux
+	logger     *logging.Logger
+}
+
+func NewStatusServer(cfg *Config, storage *Storage) *StatusServer {
+	s := &StatusServer{
+		listenAddr: cfg.StatusListen,
+		storage:    storage,
+		mux:        http.NewServeMux(),
+		logger:     logging.MustGetLogger("bakapy.status"),
+	}
+	s.mux.HandleFunc("/progress", s.handleProgress)
+	s.mux.HandleFunc("/tasks", s.handleTasks)
+	return s
+}
+
+// Start listens on status address and serves requests in background
+func (s *StatusServer) Start() error {
+	ln, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("Status server listening on %s", s.listenAddr)
+	go func() {
+		err := http.Serve(ln, s)
+		s.logger.Error("status server stopped: %s", err)
+	}()
+	return nil
+}
+
+func (s *StatusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *StatusServer) writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		s.logger.Warning("cannot write status response: %s", err)
+	}
+}
+
+func (s *StatusServer) handleProgress(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, s.storage.TaskProgress())
+}
+
+// handleTasks returns indexed task metadata filtered by query parameters
+func (s *StatusServer) handleTasks(w http.ResponseWriter, r *http.Request) {
+	q, err := ParseMetadataQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	index, err := s.storage.Index()
+	if err != nil {
+		s.logger.Warning("cannot open metadata index: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries, err := index.Query(q)
+	if err != nil {
+		s.logger.Warning("cannot query metadata index: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeJSON(w, entries)
+}
@@ -10,6 +10,8 @@ import (
 	"net"
 	"os"
 	"path"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,6 +23,8 @@ type Jober interface {
 
 type StorageCurrentJob struct {
 	TaskId      TaskId
+	JobName     string
+	StartTime   time.Time
 	FileAddChan chan JobMetadataFile
 	Namespace   string
 	Gzip        bool
@@ -30,8 +34,14 @@ type Storage struct {
 	*StorageJobManager
 	RootDir     string
 	MetadataDir string
+	Progress    *ProgressRegistry
+	Running     *RunningTasks
 	currentJobs map[TaskId]StorageCurrentJob
 	listenAddr  string
+	listener    net.Listener
+	stopped     int32
+	index       *MetadataIndex
+	indexLock   sync.Mutex
 	connections chan *StorageConn
 	logger      *logging.Logger
 }
@@ -41,6 +51,8 @@ func NewStorage(cfg *Config) *Storage {
 		StorageJobManager: NewStorageJobManager(),
 		MetadataDir:       cfg.MetadataDir,
 		RootDir:           cfg.StorageDir,
+		Progress:          NewProgressRegistry(),
+		Running:           NewRunningTasks(),
 		currentJobs:       make(map[TaskId]StorageCurrentJob),
 		connections:       make(chan *StorageConn),
 		listenAddr:        cfg.Listen,
@@ -50,9 +62,34 @@ func NewStorage(cfg *Config) *Storage {
 
 func (stor *Storage) Start() {
 	ln := stor.Listen()
+	stor.listener = ln
 	go stor.Serve(ln)
 }
 
+// Index returns index of metadata dir, opened on first call
+func (stor *Storage) Index() (*MetadataIndex, error) {
+	stor.indexLock.Lock()
+	defer stor.indexLock.Unlock()
+	if stor.index == nil {
+		index, err := OpenMetadataIndex(stor.MetadataDir)
+		if err != nil {
+			return nil, err
+		}
+		stor.index = index
+	}
+	return stor.index, nil
+}
+
+// Stop closes storage listener, new connections are not accepted
+func (stor *Storage) Stop() {
+	if stor.listener == nil {
+		return
+	}
+	stor.logger.Info("stop listening on %s", stor.listenAddr)
+	atomic.StoreInt32(&stor.stopped, 1)
+	stor.listener.Close()
+}
+
 func (stor *Storage) Listen() net.Listener {
 	stor.logger.Info("Listening on %s", stor.listenAddr)
 	ln, err := net.Listen("tcp", stor.listenAddr)
@@ -66,6 +103,9 @@ func (stor *Storage) Serve(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if atomic.LoadInt32(&stor.stopped) == 1 {
+				return
+			}
 			stor.logger.Error("Error during accept() call: %v", err)
 			return
 		}
@@ -74,7 +114,9 @@ func (stor *Storage) Serve(ln net.Listener) {
 		loggerName := fmt.Sprintf("bakapy.storage.conn[%s]", conn.RemoteAddr().String())
 		logger := logging.MustGetLogger(loggerName)
 		go func() {
-			err := stor.HandleConnection(NewStorageConn(conn, logger))
+			storageConn := NewStorageConn(conn, logger)
+			storageConn.Progress = stor.Progress
+			err := stor.HandleConnection(storageConn)
 			if err != nil {
 				stor.logger.Warning("Error during connection from %s: %s", conn.RemoteAddr(), err)
 			} else {
@@ -3,37 +3,21 @@ package bakapy
 import (
 	"os"
 	"path"
-	"path/filepath"
-	"sort"
 	"time"
 )
 
 func (stor *Storage) CleanupExpired() error {
-	jobMetadataList := map[string][]JobMetadata{}
-	corrupted := []string{}
 	corruptedDir := stor.MetadataDir + "_corrupted"
 	if err := os.MkdirAll(corruptedDir, 0755); err != nil {
 		return err
 	}
 
-	visit := func(metaPath string, f os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if f.IsDir() {
-			return nil
-		}
-		metadata, err := LoadJobMetadata(metaPath)
-		if err != nil {
-			corrupted = append(corrupted, metaPath)
-			return nil
-		}
-		metadata.Filepath = metaPath
-		jobMetadataList[metadata.JobName] = append(jobMetadataList[metadata.JobName], *metadata)
-		return nil
+	index, err := stor.Index()
+	if err != nil {
+		return err
 	}
-
-	if err := filepath.Walk(stor.MetadataDir, visit); err != nil {
+	corrupted, err := index.Sync()
+	if err != nil {
 		return err
 	}
 
@@ -46,26 +30,63 @@ func (stor *Storage) CleanupExpired() error {
 		}
 	}
 
-	for jobName, jobMetadatas := range jobMetadataList {
-		sort.Sort(MetadataSortByStartTime(jobMetadatas))
+	entries, err := index.Query(MetadataQuery{})
+	if err != nil {
+		return err
+	}
+	jobEntries := map[string][]MetadataIndexEntry{}
+	for _, entry := range entries {
+		if entry.Status == JOB_STATUS_RUNNING {
+			if time.Now().Before(entry.ExpireTime) {
+				continue
+			}
+			// running past expire time, its process may be gone
+			metadata, err := LoadJobMetadata(index.Path(entry.File))
+			if err != nil || processAlive(metadata.Pid, metadata.PidIdentity) {
+				continue
+			}
+			stor.logger.Warning("task %s of job %s expired while running, process %d gone, treating as interrupted",
+				entry.TaskId, entry.JobName, metadata.Pid)
+			entry.Status = JOB_STATUS_INTERRUPTED
+			entry.Success = false
+		}
+		jobEntries[entry.JobName] = append(jobEntries[entry.JobName], entry)
+	}
 
-		if !jobMetadatas[len(jobMetadatas)-1].Success {
+	for jobName, jobEntries := range jobEntries {
+		// runs skipped by blackout are not failures
+		lastFailed := false
+		for idx := len(jobEntries) - 1; idx >= 0; idx-- {
+			if jobEntries[idx].Status != JOB_STATUS_SKIPPED {
+				lastFailed = !jobEntries[idx].Success
+				break
+			}
+		}
+		if lastFailed {
 			stor.logger.Warning("skipping cleanup for job %s due to last task failure", jobName)
 			continue
 		}
 
-		for _, metadata := range jobMetadatas {
-			if time.Now().Before(metadata.ExpireTime) {
+		for _, entry := range jobEntries {
+			if time.Now().Before(entry.ExpireTime) {
 				continue
 			}
-			for _, fileMeta := range metadata.Files {
-				dataFilePath := path.Join(stor.RootDir, metadata.Namespace, fileMeta.Name)
+			metadataPath := index.Path(entry.File)
+			for _, fileMeta := range entry.Files {
+				dataFilePath := path.Join(stor.RootDir, entry.Namespace, fileMeta.Name)
 				stor.logger.Info("removing file %s", dataFilePath)
 				if err := os.Remove(dataFilePath); err != nil {
 					stor.logger.Warning("failed to remove file %s: %s", dataFilePath, err)
 				}
 			}
-			if err := os.Remove(metadata.Filepath); err != nil {
+			if metadata, err := LoadJobMetadata(metadataPath); err == nil {
+				for _, logPath := range metadata.LogFiles() {
+					if err := os.Remove(logPath); err != nil && !os.IsNotExist(err) {
+						stor.logger.Warning("failed to remove output log %s: %s", logPath, err)
+					}
+				}
+			}
+			if err := RemoveJobMetadata(metadataPath); err != nil {
 				stor.logger.Warning("failed to remove metadata file: %s", err)
 			}
 		}
@@ -24,6 +24,9 @@ func TestStorage_CleanupExpired_Behavior(t *testing.T) {
 	config.MetadataDir, _ = ioutil.TempDir("", "")
 	config.StorageDir, _ = ioutil.TempDir("", "")
 	defer os.RemoveAll(config.MetadataDir)
+	defer os.RemoveAll(MetadataJournalDir(config.MetadataDir))
+	defer os.Remove(MetadataIndexPath(config.MetadataDir))
+	defer os.RemoveAll(config.MetadataDir + "_corrupted")
 	defer os.RemoveAll(config.StorageDir)
 	storage := NewStorage(config)
 	os.MkdirAll(config.StorageDir+"/some_empty_dir", 0755)
@@ -152,3 +155,77 @@ func TestStorage_CleanupExpired_Behavior(t *testing.T) {
 	}
 
 }
+
+func TestStorage_CleanupExpired_SkippedRunIsNotFailure(t *testing.T) {
+	config := NewConfig()
+	config.MetadataDir, _ = ioutil.TempDir("", "")
+	config.StorageDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(config.MetadataDir)
+	defer os.RemoveAll(MetadataJournalDir(config.MetadataDir))
+	defer os.Remove(MetadataIndexPath(config.MetadataDir))
+	defer os.RemoveAll(config.MetadataDir + "_corrupted")
+	defer os.RemoveAll(config.StorageDir)
+	storage := NewStorage(config)
+
+	expiredPath := path.Join(config.MetadataDir, "expired")
+	(&JobMetadata{
+		TaskId:     "expired",
+		JobName:    "testjob",
+		Success:    true,
+		Status:     JOB_STATUS_FINISHED,
+		StartTime:  time.Now().Add(-2 * time.Hour),
+		ExpireTime: time.Now().Add(-time.Hour),
+	}).Save(expiredPath)
+	(&JobMetadata{
+		TaskId:     "skipped",
+		JobName:    "testjob",
+		Status:     JOB_STATUS_SKIPPED,
+		Skipped:    "skipped due to blackout",
+		StartTime:  time.Now(),
+		ExpireTime: time.Now().Add(time.Hour),
+	}).Save(path.Join(config.MetadataDir, "skipped"))
+
+	if err := storage.CleanupExpired(); err != nil {
+		t.Fatal("error:", err)
+	}
+	if _, err := os.Stat(expiredPath); err == nil {
+		t.Fatal("expired metadata must be removed after skipped run")
+	}
+}
+
+func TestStorage_CleanupExpired_StaleRunningTask(t *testing.T) {
+	config := NewConfig()
+	config.MetadataDir, _ = ioutil.TempDir("", "")
+	config.StorageDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(config.MetadataDir)
+	defer os.RemoveAll(MetadataJournalDir(config.MetadataDir))
+	defer os.Remove(MetadataIndexPath(config.MetadataDir))
+	defer os.RemoveAll(config.MetadataDir + "_corrupted")
+	defer os.RemoveAll(config.StorageDir)
+	storage := NewStorage(config)
+
+	stalePath := path.Join(config.MetadataDir, "stale")
+	(&JobMetadata{
+		TaskId:     "stale",
+		JobName:    "testjob",
+		Status:     JOB_STATUS_RUNNING,
+		Pid:        os.Getpid(),
+		StartTime:  time.Now().Add(-2 * time.Hour),
+		ExpireTime: time.Now().Add(-time.Hour),
+	}).Save(stalePath)
+	(&JobMetadata{
+		TaskId:     "finished",
+		JobName:    "testjob",
+		Success:    true,
+		Status:     JOB_STATUS_FINISHED,
+		StartTime:  time.Now(),
+		ExpireTime: time.Now().Add(time.Hour),
+	}).Save(path.Join(config.MetadataDir, "finished"))
+
+	if err := storage.CleanupExpired(); err != nil {
+		t.Fatal("error:", err)
+	}
+	if _, err := os.Stat(stalePath); err == nil {
+		t.Fatal("expired running task without process must be removed")
+	}
+}
@@ -25,7 +25,10 @@ type StorageProtocolHandler interface {
 
 type StorageConn struct {
 	RemoteReader
+	Progress   *ProgressRegistry
 	currentJob StorageCurrentJob
+	taskId     TaskId
+	filename   string
 	logger     *logging.Logger
 	State      StorageConnState
 }
@@ -55,6 +58,7 @@ func (sc *StorageConn) ReadTaskId() (TaskId, error) {
 
 	taskId := TaskId(taskIdBuf)
 	sc.logger.Debug("task id '%s' successfully readed.", taskId)
+	sc.taskId = taskId
 	sc.State = STATE_WAIT_FILENAME
 	loggerName := fmt.Sprintf("bakapy.storage.conn[%s][%s]", sc.RemoteAddr().String(), taskId)
 	sc.logger = logging.MustGetLogger(loggerName)
@@ -91,6 +95,7 @@ func (sc *StorageConn) ReadFilename() (string, error) {
 	}
 	sc.logger.Debug("readed %d bytes: %s", readed, filename)
 
+	sc.filename = string(filename)
 	sc.State = STATE_WAIT_DATA
 	return string(filename), nil
 }
@@ -103,6 +108,12 @@ func (sc *StorageConn) ReadContent(output io.Writer) (int64, error) {
 
 	sc.State = STATE_RECEIVING
 
+	if sc.Progress != nil {
+		transfer := sc.Progress.StartTransfer(sc.taskId, sc.filename, sc.RemoteAddr().String())
+		defer transfer.Finish()
+		output = io.MultiWriter(output, transfer)
+	}
+
 	written, err := io.Copy(output, sc)
 	if err != nil {
 		msg := fmt.Sprintf("read file content error: %s", err)
@@ -88,6 +88,17 @@ func (m *StorageJobManager) GetJob(id TaskId) (StorageCurrentJob, bool) {
 	return job, exist
 }
 
+// Jobs returns snapshot of current jobs
+func (m *StorageJobManager) Jobs() []StorageCurrentJob {
+	m.jobMu.RLock()
+	defer m.jobMu.RUnlock()
+	jobs := make([]StorageCurrentJob, 0, len(m.currentJobs))
+	for _, job := range m.currentJobs {
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
 func (m *StorageJobManager) WaitJob(taskId TaskId) {
 	for {
 		_, jobExist := m.GetJob(taskId)
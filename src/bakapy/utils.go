@@ -6,11 +6,20 @@ import (
 	"log/syslog"
 	"net/smtp"
 	"os"
+	"os/exec"
 	"os/user"
 	"path"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// ShellQuote quotes string for safe use as a single bash word
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
 func SetupLogging(logLevel string) error {
 	format := "%{level:.8s} %{module} %{message}"
 	stderrBackend := logging.NewLogBackend(os.Stderr, "", 0)
@@ -98,23 +107,98 @@ func SendFailedJobNotification(cfg SMTPConfig, meta *JobMetadata) error {
 	return nil
 }
 
-func RunJob(jobName string, jConfig *JobConfig, gConfig *Config, storage *Storage) string {
+// SaveJobMetadata saves task metadata to metadata dir and sets its Filepath
+func SaveJobMetadata(metadata *JobMetadata, gConfig *Config) {
+	logger := logging.MustGetLogger("bakapy.job")
+	saveTo := path.Join(gConfig.MetadataDir, string(metadata.TaskId))
+	metadata.Filepath = saveTo
+	err := metadata.Save(saveTo)
+	if err != nil {
+		logger.Critical("cannot save metadata: %s", err)
+		return
+	}
+	logger.Info("metadata for job %s successfully saved to %s", metadata.TaskId, saveTo)
+}
+
+// runWithTimeout runs command in its own process group. Whole group is
+// killed if command does not finish in timeout, so children holding its
+// output open do not block Wait. Returns true if command was killed.
+func runWithTimeout(cmd *exec.Cmd, timeout time.Duration) (bool, error) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	lock := sync.Mutex{}
+	finished, timedOut := false, false
+	timer := time.AfterFunc(timeout, func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if !finished {
+			timedOut = true
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	})
+	err := cmd.Wait()
+	timer.Stop()
+	lock.Lock()
+	defer lock.Unlock()
+	finished = true
+	return timedOut, err
+}
+
+// throttle allows action at most once per interval, first one always
+type throttle struct {
+	interval time.Duration
+	last     time.Time
+}
+
+func (t *throttle) Allow(now time.Time) bool {
+	if !t.last.IsZero() && now.Sub(t.last) < t.interval {
+		return false
+	}
+	t.last = now
+	return true
+}
+
+func RunJob(jobName string, jConfig *JobConfig, gConfig *Config, storage *Storage, trigger JobTrigger) *JobMetadata {
 	logger := logging.MustGetLogger("bakapy.job")
 	executor := jConfig.executor
 	if executor == nil {
-		executor = NewBashExecutor(jConfig.Args, jConfig.Host, jConfig.Port, jConfig.Sudo)
+		bashExecutor := NewBashExecutor(jConfig.Args, jConfig.Host, jConfig.Port, jConfig.Sudo)
+		bashExecutor.SSHOptions = jConfig.SSHOptions
+		bashExecutor.SecretArgs = jConfig.SecretArgs
+		bashExecutor.Secrets = NewSecretResolver(gConfig.SecretCommand)
+		bashExecutor.Secrets.Timeout = gConfig.GetSecretTimeout()
+		executor = bashExecutor
 	}
 	job := NewJob(
 		jobName, jConfig, gConfig.Listen,
 		gConfig.CommandDir, storage, executor,
 	)
+	job.StorageDir = gConfig.StorageDir
+	job.LogDir = gConfig.LogDir()
+	job.OutputLog = gConfig.OutputLog
+	// snapshots are saved right away, job throttles output progress
+	// itself, final metadata is saved after run unless task was aborted
+	job.OnProgress = func(m *JobMetadata) {
+		m.SetTrigger(trigger)
+		storage.Running.Progress(job.TaskId, func() { SaveJobMetadata(m, gConfig) })
+	}
+	if bashExecutor, ok := executor.(*BashExecutor); ok {
+		bashExecutor.OnProcess = func(pid int) { storage.Running.SetPid(job.TaskId, pid) }
+	}
+	storage.Running.Add(jobName, job.TaskId, jConfig, trigger)
+	defer storage.Running.Done(job.TaskId)
 	metadata := job.Run()
-	saveTo := path.Join(gConfig.MetadataDir, string(metadata.TaskId))
-	err := metadata.Save(saveTo)
-	if err != nil {
-		logger.Critical("cannot save metadata: %s", err)
+	metadata.SetTrigger(trigger)
+	metadata.DownstreamJobs = gConfig.Downstream(jobName, metadata.Success)
+	if !storage.Running.Finish(job.TaskId, func() { SaveJobMetadata(metadata, gConfig) }) {
+		logger.Warning("task %s of job '%s' aborted by shutdown", job.TaskId, job.Name)
+		return metadata
 	}
-	logger.Info("metadata for job %s successfully saved to %s", metadata.TaskId, saveTo)
 	if !metadata.Success {
 		logger.Debug("sending failed job notification to current user")
 		if err := SendFailedJobNotification(gConfig.SMTP, metadata); err != nil {
@@ -125,5 +209,5 @@ func RunJob(jobName string, jConfig *JobConfig, gConfig *Config, storage *Storag
 	} else {
 		logger.Info("job '%s' finished", job.Name)
 	}
-	return saveTo
+	return metadata
 }
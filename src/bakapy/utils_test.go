@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestRunJob_MetadataCreated(t *testing.T) {
@@ -12,6 +13,8 @@ func TestRunJob_MetadataCreated(t *testing.T) {
 
 	gConfig.MetadataDir, _ = ioutil.TempDir("", "")
 	defer os.RemoveAll(gConfig.MetadataDir)
+	defer os.RemoveAll(MetadataJournalDir(gConfig.MetadataDir))
+	defer os.RemoveAll(gConfig.LogDir())
 
 	gConfig.CommandDir, _ = ioutil.TempDir("", "")
 	defer os.RemoveAll(gConfig.CommandDir)
@@ -22,8 +25,8 @@ func TestRunJob_MetadataCreated(t *testing.T) {
 		executor: &TestOkExecutor{},
 	}
 	os.Create(gConfig.CommandDir + "/" + "wow.cmd")
-	metadataPath := RunJob("testjob", jConfig, gConfig, storage)
-	meta, err := LoadJobMetadata(metadataPath)
+	metadata := RunJob("testjob", jConfig, gConfig, storage, JobTrigger{Reason: RUN_REASON_MANUAL})
+	meta, err := LoadJobMetadata(metadata.Filepath)
 	if err != nil {
 		t.Fatal("cannot load metadata:", err)
 	}
@@ -45,9 +48,26 @@ func TestRunJob_MetadataDirDoesNotExist(t *testing.T) {
 		executor: &TestOkExecutor{},
 	}
 	os.Create(gConfig.CommandDir + "/" + "wow.cmd")
-	metadataPath := RunJob("testjob", jConfig, gConfig, storage)
-	_, err := LoadJobMetadata(metadataPath)
+	metadata := RunJob("testjob", jConfig, gConfig, storage, JobTrigger{Reason: RUN_REASON_MANUAL})
+	_, err := LoadJobMetadata(metadata.Filepath)
 	if err == nil {
 		t.Fatal("metadata loaded but not expected")
 	}
 }
+
+func TestThrottle_Allow(t *testing.T) {
+	saves := &throttle{interval: 5 * time.Second}
+	start := time.Now()
+	if !saves.Allow(start) {
+		t.Fatal("first save must be allowed")
+	}
+	if saves.Allow(start.Add(time.Second)) {
+		t.Fatal("save within interval must be skipped")
+	}
+	if !saves.Allow(start.Add(6 * time.Second)) {
+		t.Fatal("save after interval must be allowed")
+	}
+	if saves.Allow(start.Add(7 * time.Second)) {
+		t.Fatal("interval must count from last allowed save")
+	}
+}